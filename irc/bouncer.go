@@ -0,0 +1,23 @@
+package irc
+
+const (
+	DefaultBouncerReplay = 256
+)
+
+// BouncerConfig allows clients authenticated to an account to attach
+// further connections to the account's client. If AlwaysOn is set the
+// client stays on the server, in its channels, when its last
+// connection closes, and up to Replay lines sent to it while detached
+// are replayed to the next connection that attaches.
+type BouncerConfig struct {
+	Enabled  bool
+	AlwaysOn bool
+	Replay   int
+}
+
+func (config BouncerConfig) replay() int {
+	if config.Replay == 0 {
+		return DefaultBouncerReplay
+	}
+	return config.Replay
+}
@@ -0,0 +1,207 @@
+package irc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientDetach(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &Config{}
+	config.Server.Bouncer = BouncerConfig{Enabled: true, AlwaysOn: true, Replay: 2}
+	client := &Client{
+		hasQuit:    NewSyncBool(false),
+		registered: true,
+		sasl:       NewSaslState(),
+		server:     &Server{config: config},
+	}
+	first, second := &Session{}, &Session{}
+	client.sessions = []*Session{first, second}
+
+	assert.True(client.detach(first))
+	assert.Equal([]*Session{second}, client.Sessions())
+	assert.True(client.detach(first))
+
+	assert.False(client.AlwaysOn())
+	assert.False(client.detach(second))
+
+	client.sasl.Login("admin")
+	assert.True(client.AlwaysOn())
+	assert.True(client.detach(second))
+	assert.Empty(client.Sessions())
+
+	for i := 0; i < 3; i++ {
+		client.Reply(fmt.Sprint(i))
+	}
+	var lines []string
+	for _, line := range client.replay {
+		assert.False(line.tags.Time.IsZero())
+		lines = append(lines, line.line)
+	}
+	assert.Equal([]string{"1", "2"}, lines)
+}
+
+var (
+	bouncerServer     *Server
+	bouncerServerOnce sync.Once
+)
+
+// testBouncerServer returns a server, without listeners, with the
+// bouncer enabled and an account named away. The server is shared by
+// the tests, which each use their own accounts.
+func testBouncerServer() *Server {
+	bouncerServerOnce.Do(func() {
+		config := &Config{}
+		config.Network.Name = "Test"
+		config.Network.Cloak.Keys = []string{"test"}
+		config.Server.Name = "test"
+		config.Server.Bouncer = BouncerConfig{Enabled: true, AlwaysOn: true}
+		config.Metrics.Disabled = true
+		config.Account = map[string]*PassConfig{
+			"away":    {Password: "JDJhJDA0JGtUU1JVc1JOUy9DbEh1WEdvYVlMdGVnclp6YnA3NDBOZGY1WUZhdTZtRzVmb1VKdXQ5ckZD"},
+			"offline": {Password: "JDJhJDA0JGtUU1JVc1JOUy9DbEh1WEdvYVlMdGVnclp6YnA3NDBOZGY1WUZhdTZtRzVmb1VKdXQ5ckZD"},
+		}
+		bouncerServer = NewServer(config)
+	})
+	return bouncerServer
+}
+
+// testConnect returns a new unregistered client of server, logged in
+// to account if it isn't empty, and its session. What the session is
+// sent is kept in its send queue.
+func testConnect(server *Server, account string) (*Client, *Session) {
+	conn, _ := net.Pipe()
+	client := newClient(server)
+	session := newSession(client, conn, ":6667")
+	client.sessions = []*Session{session}
+	if account != "" {
+		client.sasl.Login(account)
+	}
+	return client, session
+}
+
+// testRegister sends the NICK and USER commands for nick on session.
+func testRegister(client *Client, session *Session, nick string) {
+	client.handleLine(session, "NICK "+nick)
+	client.handleLine(session, "USER "+nick+" 0 * :"+nick)
+}
+
+// testSent returns the lines queued for session since the last call.
+func testSent(session *Session) string {
+	lines, _ := session.sendq.Drain()
+	return strings.Join(lines, "\n")
+}
+
+func TestClientAttach(t *testing.T) {
+	assert := assert.New(t)
+	server := testBouncerServer()
+
+	identity, first := testConnect(server, "attacher")
+	testRegister(identity, first, "attacher")
+	assert.True(identity.registered)
+	assert.Equal(identity, server.clients.Get("attacher"))
+
+	identity.detach(first)
+	identity.Reply(":test NOTICE attacher :while you were away")
+
+	conn, second := testConnect(server, "attacher")
+	testRegister(conn, second, "attacher")
+
+	assert.False(conn.registered)
+	assert.Empty(conn.Sessions())
+	assert.Equal(identity, second.client)
+	assert.Equal([]*Session{second}, identity.Sessions())
+	assert.Empty(identity.replay)
+	assert.Equal(identity, server.clients.Get("attacher"))
+	assert.False(server.connected.Has(conn))
+
+	sent := testSent(second)
+	assert.Contains(sent, " 001 attacher ")
+	assert.Contains(sent, "while you were away")
+
+	// commands of the attached session are handled for the identity
+	identity.handleLine(second, "PING x")
+	assert.Contains(testSent(second), "PONG")
+}
+
+func TestNickHeldByIdentity(t *testing.T) {
+	assert := assert.New(t)
+	server := testBouncerServer()
+
+	identity, session := testConnect(server, "holder")
+	testRegister(identity, session, "holder")
+	assert.True(identity.registered)
+
+	// a client that already has a nick can't take the identity's
+	other, otherSession := testConnect(server, "")
+	testRegister(other, otherSession, "taker")
+	other.handleLine(otherSession, "NICK holder")
+	assert.Equal(Name("taker"), other.nick)
+	assert.Contains(testSent(otherSession), " 433 taker holder ")
+
+	// a client of another account is told the nick is in use once it
+	// tries to register, and may then choose another
+	stranger, strangerSession := testConnect(server, "mallory")
+	stranger.handleLine(strangerSession, "NICK holder")
+	assert.Equal(Name("holder"), stranger.nick)
+	stranger.handleLine(strangerSession, "USER holder 0 * :holder")
+	assert.False(stranger.registered)
+	assert.Equal(Name(""), stranger.nick)
+	assert.Contains(testSent(strangerSession), " 433 * holder ")
+	assert.Equal(identity, server.clients.Get("holder"))
+
+	testRegister(stranger, strangerSession, "stranger")
+	assert.True(stranger.registered)
+	assert.Equal(stranger, server.clients.Get("stranger"))
+}
+
+func TestResumeClientSessions(t *testing.T) {
+	assert := assert.New(t)
+	server := testBouncerServer()
+
+	var fds []int
+	for i := 0; i < 2; i++ {
+		pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+		assert.NoError(err)
+		defer syscall.Close(pair[1])
+		fds = append(fds, pair[0])
+	}
+
+	client, err := server.resumeClient(upgradeClient{
+		Nick:     "resumed",
+		Username: "resumed",
+		Account:  "resumed",
+		Modes:    "r",
+		Sessions: []upgradeSession{
+			{FD: fds[0], Capabilities: []Capability{ServerTime}, Output: []string{"first"}},
+			{FD: fds[1], Output: []string{"second"}},
+			{FD: -1},
+		},
+		Replay: []upgradeReplayLine{{Line: "replayed"}},
+	})
+	assert.NoError(err)
+	assert.True(client.registered)
+	assert.Equal(client, server.clients.Get("resumed"))
+
+	sessions := client.Sessions()
+	assert.Len(sessions, 2)
+	assert.True(sessions[0].capabilities[ServerTime])
+	assert.False(sessions[1].capabilities[ServerTime])
+	assert.Equal("first", testSent(sessions[0]))
+	assert.Equal("second", testSent(sessions[1]))
+	assert.Len(client.replay, 1)
+
+	_, err = server.resumeClient(upgradeClient{
+		Nick:     "lost",
+		Sessions: []upgradeSession{{FD: -1}},
+	})
+	assert.Equal(ErrNoSessions, err)
+	assert.Nil(server.clients.Get("lost"))
+}
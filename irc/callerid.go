@@ -0,0 +1,236 @@
+package irc
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	MaxAcceptList  = 100
+	MaxSilenceList = 32
+
+	// CallerIDNotifyInterval is how often a +g client is told that
+	// clients it doesn't accept are messaging it.
+	CallerIDNotifyInterval = time.Minute
+)
+
+var (
+	ErrAcceptListFull  = errors.New("accept list is full")
+	ErrSilenceListFull = errors.New("silence list is full")
+)
+
+// IgnoreLists are the nicks a client accepts private messages from
+// while it is +g and the masks it silences.
+type IgnoreLists struct {
+	sync.RWMutex
+	accept   map[Name]Name
+	silence  *UserMaskSet
+	notified time.Time
+}
+
+func NewIgnoreLists() *IgnoreLists {
+	return &IgnoreLists{
+		accept:  make(map[Name]Name),
+		silence: NewUserMaskSet(),
+	}
+}
+
+// Accept adds nick to the accept list and returns false if it is
+// already on it.
+func (lists *IgnoreLists) Accept(nick Name) (bool, error) {
+	lists.Lock()
+	defer lists.Unlock()
+	key := nick.ToLower()
+	if _, ok := lists.accept[key]; ok {
+		return false, nil
+	}
+	if len(lists.accept) >= MaxAcceptList {
+		return false, ErrAcceptListFull
+	}
+	lists.accept[key] = nick
+	return true, nil
+}
+
+// Unaccept removes nick from the accept list and returns false if it
+// isn't on it.
+func (lists *IgnoreLists) Unaccept(nick Name) bool {
+	lists.Lock()
+	defer lists.Unlock()
+	key := nick.ToLower()
+	if _, ok := lists.accept[key]; !ok {
+		return false
+	}
+	delete(lists.accept, key)
+	return true
+}
+
+func (lists *IgnoreLists) Accepts(nick Name) bool {
+	lists.RLock()
+	defer lists.RUnlock()
+	_, ok := lists.accept[nick.ToLower()]
+	return ok
+}
+
+func (lists *IgnoreLists) AcceptList() []Name {
+	lists.RLock()
+	defer lists.RUnlock()
+	nicks := make([]Name, 0, len(lists.accept))
+	for _, nick := range lists.accept {
+		nicks = append(nicks, nick)
+	}
+	return nicks
+}
+
+// Silence adds mask to the silence list and returns false if it is
+// already on it.
+func (lists *IgnoreLists) Silence(mask Name) (bool, error) {
+	lists.Lock()
+	defer lists.Unlock()
+	if lists.silence.masks[mask] {
+		return false, nil
+	}
+	if len(lists.silence.masks) >= MaxSilenceList {
+		return false, ErrSilenceListFull
+	}
+	return lists.silence.Add(mask), nil
+}
+
+// Unsilence removes mask from the silence list and returns false if it
+// isn't on it.
+func (lists *IgnoreLists) Unsilence(mask Name) bool {
+	lists.Lock()
+	defer lists.Unlock()
+	return lists.silence.Remove(mask)
+}
+
+// Silenced reports whether any of userhosts matches a silenced mask.
+func (lists *IgnoreLists) Silenced(userhosts []Name) bool {
+	lists.RLock()
+	defer lists.RUnlock()
+	return lists.silence.MatchAny(userhosts)
+}
+
+func (lists *IgnoreLists) SilenceList() []Name {
+	lists.RLock()
+	defer lists.RUnlock()
+	masks := make([]Name, 0, len(lists.silence.masks))
+	for mask := range lists.silence.masks {
+		masks = append(masks, mask)
+	}
+	return masks
+}
+
+// notify returns true if the client should be told it is being
+// messaged while +g, at most once per CallerIDNotifyInterval.
+func (lists *IgnoreLists) notify() bool {
+	lists.Lock()
+	defer lists.Unlock()
+	if time.Since(lists.notified) < CallerIDNotifyInterval {
+		return false
+	}
+	lists.notified = time.Now()
+	return true
+}
+
+// AcceptsFrom returns true if target takes private messages and
+// invites from client. Otherwise client is told why, unless target
+// silences it, and a +g target is told that client tried.
+func (target *Client) AcceptsFrom(client *Client) bool {
+	if client == target || client.modes.Has(Operator) {
+		return true
+	}
+
+	if target.ignores.Silenced(client.UserHosts()) {
+		return false
+	}
+
+	if target.modes.Has(RegisteredOnly) && client.sasl.Id() == "" {
+		client.ErrNoNonReg(target)
+		return false
+	}
+
+	if target.modes.Has(CallerID) && !target.ignores.Accepts(client.nick) {
+		client.ErrTargUModeG(target)
+		if target.ignores.notify() {
+			client.RplTargNotify(target)
+			target.RplUModeGMsg(client)
+		}
+		return false
+	}
+
+	return true
+}
+
+func (msg *AcceptCommand) HandleServer(server *Server) {
+	client := msg.Client()
+
+	for _, nick := range msg.nicks {
+		switch {
+		case nick == "*":
+			for _, accepted := range client.ignores.AcceptList() {
+				client.RplAcceptList(accepted)
+			}
+			client.RplEndOfAccept()
+
+		case nick[0] == '-':
+			nick = nick[1:]
+			if !client.ignores.Unaccept(nick) {
+				client.ErrAcceptNot(nick)
+			}
+
+		default:
+			if server.clients.Get(nick) == nil {
+				client.ErrNoSuchNick(nick)
+				continue
+			}
+			added, err := client.ignores.Accept(nick)
+			if err != nil {
+				client.ErrAcceptFull()
+				return
+			}
+			if !added {
+				client.ErrAcceptExist(nick)
+			}
+		}
+	}
+}
+
+func (msg *SilenceCommand) HandleServer(server *Server) {
+	client := msg.Client()
+
+	if len(msg.masks) == 0 {
+		for _, mask := range client.ignores.SilenceList() {
+			client.RplSileList(mask)
+		}
+		client.RplEndOfSileList()
+		return
+	}
+
+	for _, mask := range msg.masks {
+		op := Add
+		switch mask[0] {
+		case '+', '-':
+			op, mask = ModeOp(mask[0]), mask[1:]
+		}
+		if mask == "" {
+			continue
+		}
+		mask = ExpandUserHost(mask)
+
+		if op == Remove {
+			if client.ignores.Unsilence(mask) {
+				client.Respond(RplSilence(client, op, mask))
+			}
+			continue
+		}
+		added, err := client.ignores.Silence(mask)
+		if err != nil {
+			client.ErrSileListFull(mask)
+			return
+		}
+		if added {
+			client.Respond(RplSilence(client, op, mask))
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package irc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIgnoreLists(t *testing.T) {
+	assert := assert.New(t)
+
+	lists := NewIgnoreLists()
+
+	added, err := lists.Accept("Alice")
+	assert.True(added)
+	assert.NoError(err)
+	added, err = lists.Accept("alice")
+	assert.False(added)
+	assert.NoError(err)
+	assert.True(lists.Accepts("ALICE"))
+	assert.Equal([]Name{"Alice"}, lists.AcceptList())
+	assert.True(lists.Unaccept("alice"))
+	assert.False(lists.Unaccept("alice"))
+	assert.False(lists.Accepts("Alice"))
+
+	added, err = lists.Silence(ExpandUserHost("*@*.example.com"))
+	assert.True(added)
+	assert.NoError(err)
+	assert.True(lists.Silenced([]Name{"bob!bob@host.example.com"}))
+	assert.False(lists.Silenced([]Name{"bob!bob@example.org"}))
+	assert.True(lists.Unsilence("*!*@*.example.com"))
+	assert.False(lists.Silenced([]Name{"bob!bob@host.example.com"}))
+
+	for i := 0; i < MaxSilenceList; i++ {
+		_, err = lists.Silence(NewName(string(rune('a'+i%26)) + string(rune('a'+i/26)) + "!*@*"))
+		assert.NoError(err)
+	}
+	_, err = lists.Silence("full!*@*")
+	assert.Equal(ErrSilenceListFull, err)
+}
@@ -1,7 +1,9 @@
 package irc
 
 import (
+	"fmt"
 	"strings"
+	"time"
 )
 
 type CapSubCommand string
@@ -20,14 +22,35 @@ const (
 type Capability string
 
 const (
-	MultiPrefix Capability = "multi-prefix"
-	SASL        Capability = "sasl"
+	Batch         Capability = "batch"
+	ChatHistory   Capability = "draft/chathistory"
+	ChgHost       Capability = "chghost"
+	EventPlayback Capability = "draft/event-playback"
+	MultiPrefix   Capability = "multi-prefix"
+	ReadMarker    Capability = "draft/read-marker"
+	SASL          Capability = "sasl"
+	ServerTime    Capability = "server-time"
+	STS           Capability = "sts"
+)
+
+const (
+	// CapVersion302 is the CAP LS version that allows capability values.
+	CapVersion302 = 302
+
+	// DefaultSTSDuration is used when the STS policy has no duration.
+	DefaultSTSDuration = 30 * 24 * time.Hour
 )
 
 var (
 	SupportedCapabilities = CapabilitySet{
-		MultiPrefix: true,
-		SASL:        true,
+		Batch:         true,
+		ChatHistory:   true,
+		ChgHost:       true,
+		EventPlayback: true,
+		MultiPrefix:   true,
+		ReadMarker:    true,
+		SASL:          true,
+		ServerTime:    true,
 	}
 )
 
@@ -79,36 +102,79 @@ func (set CapabilitySet) DisableString() string {
 	return strings.Join(parts, " ")
 }
 
+// STSPolicy returns the value of the sts capability for client, or
+// an empty string if no policy applies to its connection.
+func (server *Server) STSPolicy(client *Client) string {
+	sts := server.Config().Network.STS
+	if !sts.Enabled {
+		return ""
+	}
+
+	if client.modes.Has(SecureConn) {
+		duration := sts.Duration
+		if duration == 0 {
+			duration = DefaultSTSDuration
+		}
+		policy := fmt.Sprintf("duration=%d", int64(duration.Seconds()))
+		if sts.Preload {
+			policy += ",preload"
+		}
+		return policy
+	}
+
+	port := server.Config().STSPort()
+	if port == 0 {
+		return ""
+	}
+	return fmt.Sprintf("port=%d", port)
+}
+
+// LSString returns the capabilities advertised to client by CAP LS.
+// Capability values are only sent to clients that asked for CAP 302.
+func (set CapabilitySet) LSString(server *Server, client *Client, version int) string {
+	caps := set.String()
+	if version < CapVersion302 {
+		return caps
+	}
+
+	if policy := server.STSPolicy(client); policy != "" {
+		caps += " " + STS.String() + "=" + policy
+	}
+	return caps
+}
+
 func (msg *CapCommand) HandleRegServer(server *Server) {
 	client := msg.Client()
+	session := msg.Session()
 
 	switch msg.subCommand {
 	case CAP_LS:
-		client.capState = CapNegotiating
-		client.Reply(RplCap(client, CAP_LS, SupportedCapabilities))
+		session.capState = CapNegotiating
+		client.Respond(RplCap(client, CAP_LS,
+			SupportedCapabilities.LSString(server, client, msg.version)))
 
 	case CAP_LIST:
-		client.Reply(RplCap(client, CAP_LIST, client.capabilities))
+		client.Respond(RplCap(client, CAP_LIST, session.capabilities))
 
 	case CAP_REQ:
 		for capability := range msg.capabilities {
 			if !SupportedCapabilities[capability] {
-				client.Reply(RplCap(client, CAP_NAK, msg.capabilities))
+				client.Respond(RplCap(client, CAP_NAK, msg.capabilities))
 				return
 			}
 		}
 		for capability := range msg.capabilities {
-			client.capabilities[capability] = true
+			session.capabilities[capability] = true
 		}
-		client.Reply(RplCap(client, CAP_ACK, msg.capabilities))
+		client.Respond(RplCap(client, CAP_ACK, msg.capabilities))
 
 	case CAP_CLEAR:
-		reply := RplCap(client, CAP_ACK, client.capabilities.DisableString())
-		client.capabilities = make(CapabilitySet)
-		client.Reply(reply)
+		reply := RplCap(client, CAP_ACK, session.capabilities.DisableString())
+		session.capabilities = make(CapabilitySet)
+		client.Respond(reply)
 
 	case CAP_END:
-		client.capState = CapNegotiated
+		session.capState = CapNegotiated
 		server.tryRegister(client)
 
 	default:
@@ -5,14 +5,19 @@ import (
 )
 
 type Channel struct {
-	flags     *ChannelModeSet
-	lists     map[ChannelMode]*UserMaskSet
-	key       Text
-	members   *MemberSet
-	name      Name
-	server    *Server
-	topic     Text
-	userLimit uint64
+	flags        *ChannelModeSet
+	flood        *channelFlood
+	floodLimit   *FloodLimit
+	forward      Name
+	joinThrottle *JoinThrottle
+	lists        map[ChannelMode]*UserMaskSet
+	key          Text
+	members      *MemberSet
+	name         Name
+	playback     *Playback
+	server       *Server
+	topic        Text
+	userLimit    uint64
 }
 
 // NewChannel creates a new channel from a `Server` and a `name`
@@ -20,10 +25,12 @@ type Channel struct {
 func NewChannel(s *Server, name Name, addDefaultModes bool) *Channel {
 	channel := &Channel{
 		flags: NewChannelModeSet(),
+		flood: newChannelFlood(),
 		lists: map[ChannelMode]*UserMaskSet{
 			BanMask:    NewUserMaskSet(),
 			ExceptMask: NewUserMaskSet(),
 			InviteMask: NewUserMaskSet(),
+			QuietMask:  NewUserMaskSet(),
 		},
 		members: NewMemberSet(),
 		name:    name,
@@ -50,32 +57,100 @@ func (channel *Channel) Names(client *Client) {
 	client.RplEndOfNames(channel)
 }
 
+// modeRank returns the rank of a member mode, higher ranks being more
+// privileged, or 0 if mode isn't a member mode.
+func modeRank(mode ChannelMode) int {
+	for i, member := range MemberModes {
+		if member == mode {
+			return len(MemberModes) - i
+		}
+	}
+	return 0
+}
+
+// memberRank returns the rank of the most privileged of a member's
+// modes, or 0 if it has none. The channel creator ranks as an owner.
+func memberRank(modes *ChannelModeSet) int {
+	if modes == nil {
+		return 0
+	}
+	if modes.Has(ChannelCreator) {
+		return modeRank(ChannelOwner)
+	}
+	for _, mode := range MemberModes {
+		if modes.Has(mode) {
+			return modeRank(mode)
+		}
+	}
+	return 0
+}
+
+// memberPrefixes returns the prefixes of a member's modes, only the
+// most privileged one unless multiPrefix.
+func memberPrefixes(modes *ChannelModeSet, multiPrefix bool) (prefixes string) {
+	if modes == nil {
+		return
+	}
+	for _, mode := range MemberModes {
+		if modes.Has(mode) {
+			prefixes += MemberPrefixes[mode]
+			if !multiPrefix {
+				break
+			}
+		}
+	}
+	return
+}
+
+// Rank returns client's privilege rank in the channel. IRC operators
+// outrank every member.
+func (channel *Channel) Rank(client *Client) int {
+	if client.modes.Has(Operator) {
+		return len(MemberModes) + 1
+	}
+	return memberRank(channel.members.Get(client))
+}
+
+// Prefixes returns the prefixes of client's member modes.
+func (channel *Channel) Prefixes(client *Client, multiPrefix bool) string {
+	return memberPrefixes(channel.members.Get(client), multiPrefix)
+}
+
+// ClientIsOperator returns true if client is a channel operator or
+// ranks above one.
 func (channel *Channel) ClientIsOperator(client *Client) bool {
-	return client.modes.Has(Operator) || channel.members.HasMode(client, ChannelOperator)
+	return channel.Rank(client) >= modeRank(ChannelOperator)
+}
+
+// ClientIsHalfOp returns true if client is a half-operator or ranks
+// above one.
+func (channel *Channel) ClientIsHalfOp(client *Client) bool {
+	return channel.Rank(client) >= modeRank(HalfOp)
+}
+
+// IsQuieted returns true if client matches the quiet list and isn't
+// excepted.
+func (channel *Channel) IsQuieted(client *Client) bool {
+	return channel.lists[QuietMask].MatchClient(client) &&
+		!channel.lists[ExceptMask].MatchClient(client)
+}
+
+// isBanned returns true if client matches the ban list and isn't
+// excepted. Extbans referring to other channels aren't followed if
+// nested.
+func (channel *Channel) isBanned(client *Client, nested bool) bool {
+	return channel.lists[BanMask].matchClient(client, nested) &&
+		!channel.lists[ExceptMask].matchClient(client, nested)
 }
 
 func (channel *Channel) Nicks(target *Client) []string {
-	isMultiPrefix := (target != nil) && target.capabilities[MultiPrefix]
+	isMultiPrefix := (target != nil) && target.HasCapability(MultiPrefix)
 	channel.members.RLock()
 	defer channel.members.RUnlock()
 	nicks := make([]string, channel.members.Count())
 	i := 0
 	channel.members.Range(func(client *Client, modes *ChannelModeSet) bool {
-		if isMultiPrefix {
-			if modes.Has(ChannelOperator) {
-				nicks[i] += "@"
-			}
-			if modes.Has(Voice) {
-				nicks[i] += "+"
-			}
-		} else {
-			if modes.Has(ChannelOperator) {
-				nicks[i] += "@"
-			} else if modes.Has(Voice) {
-				nicks[i] += "+"
-			}
-		}
-		nicks[i] += client.Nick().String()
+		nicks[i] = memberPrefixes(modes, isMultiPrefix) + client.Nick().String()
 		i++
 		return true
 	})
@@ -99,6 +174,10 @@ func (channel *Channel) ModeString(client *Client) (str string) {
 	isMember := client.modes.Has(Operator) || channel.members.Has(client)
 	showKey := isMember && (channel.key != "")
 	showUserLimit := channel.userLimit > 0
+	showPlayback := channel.playback != nil
+	showJoinThrottle := channel.joinThrottle != nil
+	showFloodLimit := channel.floodLimit != nil
+	showForward := channel.forward != ""
 
 	// flags with args
 	if showKey {
@@ -107,6 +186,18 @@ func (channel *Channel) ModeString(client *Client) (str string) {
 	if showUserLimit {
 		str += UserLimit.String()
 	}
+	if showPlayback {
+		str += PlaybackMode.String()
+	}
+	if showJoinThrottle {
+		str += JoinThrottleMode.String()
+	}
+	if showFloodLimit {
+		str += FloodLimitMode.String()
+	}
+	if showForward {
+		str += Forward.String()
+	}
 
 	// flags
 	channel.flags.Range(func(mode ChannelMode) bool {
@@ -124,6 +215,18 @@ func (channel *Channel) ModeString(client *Client) (str string) {
 	if showUserLimit {
 		str += " " + strconv.FormatUint(channel.userLimit, 10)
 	}
+	if showPlayback {
+		str += " " + channel.playback.String()
+	}
+	if showJoinThrottle {
+		str += " " + channel.joinThrottle.String()
+	}
+	if showFloodLimit {
+		str += " " + channel.floodLimit.String()
+	}
+	if showForward {
+		str += " " + channel.forward.String()
+	}
 
 	return
 }
@@ -138,6 +241,13 @@ func (channel *Channel) CheckKey(key Text) bool {
 }
 
 func (channel *Channel) Join(client *Client, key Text) {
+	channel.join(client, key, false)
+}
+
+// join adds client to the channel, or to the channel's forward channel
+// if it is full, invite only or client is banned, unless client was
+// forwarded already.
+func (channel *Channel) join(client *Client, key Text, forwarded bool) {
 	if channel.members.Has(client) {
 		// already joined, no message?
 		return
@@ -146,7 +256,9 @@ func (channel *Channel) Join(client *Client, key Text) {
 	isOperator := channel.ClientIsOperator(client)
 
 	if !isOperator && channel.IsFull() {
-		client.ErrChannelIsFull(channel)
+		if !channel.forwardJoin(client, forwarded) {
+			client.ErrChannelIsFull(channel)
+		}
 		return
 	}
 
@@ -155,17 +267,23 @@ func (channel *Channel) Join(client *Client, key Text) {
 		return
 	}
 
-	isInvited := channel.lists[InviteMask].Match(client.UserHost(false))
+	isInvited := channel.lists[InviteMask].MatchClient(client)
 	if !isOperator && channel.flags.Has(InviteOnly) && !isInvited {
-		client.ErrInviteOnlyChan(channel)
+		if !channel.forwardJoin(client, forwarded) {
+			client.ErrInviteOnlyChan(channel)
+		}
+		return
+	}
+
+	if channel.isBanned(client, false) && !isInvited && !isOperator {
+		if !channel.forwardJoin(client, forwarded) {
+			client.ErrBannedFromChan(channel)
+		}
 		return
 	}
 
-	if channel.lists[BanMask].Match(client.UserHost(false)) &&
-		!isInvited &&
-		!isOperator &&
-		!channel.lists[ExceptMask].Match(client.UserHost(false)) {
-		client.ErrBannedFromChan(channel)
+	if !isOperator && !isInvited && !channel.allowJoin() {
+		client.ErrThrottle(channel)
 		return
 	}
 
@@ -177,12 +295,17 @@ func (channel *Channel) Join(client *Client, key Text) {
 	}
 
 	reply := RplJoin(client, channel)
+	tags := channel.record(JOIN, reply)
 	channel.members.Range(func(member *Client, _ *ChannelModeSet) bool {
-		member.Reply(reply)
+		member.TaggedReply(tags, reply)
 		return true
 	})
-	channel.GetTopic(client)
-	channel.Names(client)
+	client.RespondAll(func() {
+		client.RplMarkRead(channel.name)
+		channel.GetTopic(client)
+		channel.Names(client)
+		channel.Playback(client)
+	})
 }
 
 func (channel *Channel) Part(client *Client, message Text) {
@@ -192,8 +315,9 @@ func (channel *Channel) Part(client *Client, message Text) {
 	}
 
 	reply := RplPart(client, channel, message)
+	tags := channel.record(PART, reply)
 	channel.members.Range(func(member *Client, _ *ChannelModeSet) bool {
-		member.Reply(reply)
+		member.TaggedReply(tags, reply)
 		return true
 	})
 	channel.Quit(client)
@@ -227,21 +351,28 @@ func (channel *Channel) SetTopic(client *Client, topic Text) {
 	channel.topic = topic
 
 	reply := RplTopicMsg(client, channel)
+	tags := channel.record(TOPIC, reply)
 	channel.members.Range(func(member *Client, _ *ChannelModeSet) bool {
-		member.Reply(reply)
+		member.TaggedReply(tags, reply)
 		return true
 	})
 }
 
 func (channel *Channel) CanSpeak(client *Client) bool {
-	if channel.ClientIsOperator(client) {
+	// IRC operators rank by their member modes here, like everyone
+	// else, so they don't get past +n, +m and +q by being opers.
+	rank := memberRank(channel.members.Get(client))
+	if rank >= modeRank(ChannelOperator) {
 		return true
 	}
 	if channel.flags.Has(NoOutside) && !channel.members.Has(client) {
 		return false
 	}
-	if channel.flags.Has(Moderated) && !(channel.members.HasMode(client, Voice) ||
-		channel.members.HasMode(client, ChannelOperator)) {
+	isVoiced := rank >= modeRank(Voice)
+	if channel.flags.Has(Moderated) && !isVoiced {
+		return false
+	}
+	if !isVoiced && channel.IsQuieted(client) {
 		return false
 	}
 	if channel.flags.Has(SecureChan) && !client.modes.Has(SecureConn) {
@@ -250,18 +381,50 @@ func (channel *Channel) CanSpeak(client *Client) bool {
 	return true
 }
 
+// filter applies the channel's content filters to a message from
+// client and returns false if it is blocked. Channel operators may
+// send colours, CTCPs and notices.
+func (channel *Channel) filter(client *Client, command StringCode, message *Text) bool {
+	if !channel.ClientIsOperator(client) {
+		if command == NOTICE && channel.flags.Has(NoNotice) {
+			client.ErrCannotSendToChanReason(channel, "notices are not permitted")
+			return false
+		}
+		if ctcp, ok := message.CTCP(); ok && ctcp != "ACTION" && channel.flags.Has(NoCTCP) {
+			client.ErrCannotSendToChanReason(channel, "CTCPs are not permitted")
+			return false
+		}
+		if message.HasColor() && channel.flags.Has(NoColor) {
+			client.ErrCannotSendToChanReason(channel, "colours are not permitted")
+			return false
+		}
+	}
+	if channel.flags.Has(StripFormatting) {
+		*message = message.StripFormatting()
+	}
+	return true
+}
+
 func (channel *Channel) PrivMsg(client *Client, message Text) {
 	if !channel.CanSpeak(client) {
 		client.ErrCannotSendToChan(channel)
 		return
 	}
+	if !channel.filter(client, PRIVMSG, &message) {
+		return
+	}
+	if !channel.checkFlood(client) {
+		return
+	}
 	reply := RplPrivMsg(client, channel, message)
+	tags := channel.record(PRIVMSG, reply)
+	client.Echo(tags, reply)
 	channel.members.Range(func(member *Client, _ *ChannelModeSet) bool {
 		if member == client {
 			return true
 		}
 		client.server.metrics.Counter("client", "messages").Inc()
-		member.Reply(reply)
+		member.TaggedReply(tags, reply)
 		return true
 	})
 }
@@ -291,13 +454,11 @@ func (channel *Channel) applyModeFlag(client *Client, mode ChannelMode,
 	return false
 }
 
+// applyModeMember gives or takes a member mode. Half-operators may only
+// change voice, and others modes up to their own rank, of members that
+// don't outrank them, but anyone may take their own modes.
 func (channel *Channel) applyModeMember(client *Client, mode ChannelMode,
 	op ModeOp, nick Name) bool {
-	if !channel.ClientIsOperator(client) {
-		client.ErrChanOPrivIsNeeded(channel)
-		return false
-	}
-
 	if nick == "" {
 		client.ErrNeedMoreParams("MODE")
 		return false
@@ -314,6 +475,16 @@ func (channel *Channel) applyModeMember(client *Client, mode ChannelMode,
 		return false
 	}
 
+	rank := channel.Rank(client)
+	if !(target == client && op == Remove) &&
+		(!channel.ClientIsHalfOp(client) ||
+			(mode != Voice && !channel.ClientIsOperator(client)) ||
+			modeRank(mode) > rank ||
+			memberRank(channel.members.Get(target)) > rank) {
+		client.ErrChanOPrivIsNeeded(channel)
+		return false
+	}
+
 	switch op {
 	case Add:
 		if channel.members.Get(target).Has(mode) {
@@ -352,12 +523,20 @@ func (channel *Channel) applyModeMask(client *Client, mode ChannelMode, op ModeO
 		return false
 	}
 
-	if !channel.ClientIsOperator(client) {
+	// half-operators may only change the ban and quiet lists
+	if !channel.ClientIsHalfOp(client) ||
+		(mode != BanMask && mode != QuietMask && !channel.ClientIsOperator(client)) {
 		client.ErrChanOPrivIsNeeded(channel)
 		return false
 	}
 
 	if op == Add {
+		if IsExtBan(mask) {
+			if _, err := ParseExtBan(mask); err != nil {
+				client.ErrInvalidModeParam(channel, mode, mask, err)
+				return false
+			}
+		}
 		return list.Add(mask)
 	}
 
@@ -370,11 +549,12 @@ func (channel *Channel) applyModeMask(client *Client, mode ChannelMode, op ModeO
 
 func (channel *Channel) applyMode(client *Client, change *ChannelModeChange) bool {
 	switch change.mode {
-	case BanMask, ExceptMask, InviteMask:
+	case BanMask, ExceptMask, InviteMask, QuietMask:
 		return channel.applyModeMask(client, change.mode, change.op,
 			NewName(change.arg))
 
-	case InviteOnly, Moderated, NoOutside, OpOnlyTopic, Private, Secret, SecureChan:
+	case InviteOnly, Moderated, NoColor, NoCTCP, NoNotice, NoOutside, OpOnlyTopic,
+		Private, Secret, SecureChan, StripFormatting:
 		return channel.applyModeFlag(client, change.mode, change.op)
 
 	case Key:
@@ -403,19 +583,154 @@ func (channel *Channel) applyMode(client *Client, change *ChannelModeChange) boo
 		}
 
 	case UserLimit:
-		limit, err := strconv.ParseUint(change.arg, 10, 64)
-		if err != nil {
-			client.ErrNeedMoreParams("MODE")
+		if !channel.ClientIsOperator(client) {
+			client.ErrChanOPrivIsNeeded(channel)
 			return false
 		}
-		if (limit == 0) || (limit == channel.userLimit) {
+
+		switch change.op {
+		case Add:
+			limit, err := strconv.ParseUint(change.arg, 10, 64)
+			if err != nil {
+				client.ErrNeedMoreParams("MODE")
+				return false
+			}
+			if (limit == 0) || (limit == channel.userLimit) {
+				return false
+			}
+
+			channel.userLimit = limit
+			return true
+
+		case Remove:
+			if channel.userLimit == 0 {
+				return false
+			}
+			channel.userLimit = 0
+			return true
+		}
+
+	case JoinThrottleMode:
+		if !channel.ClientIsOperator(client) {
+			client.ErrChanOPrivIsNeeded(channel)
 			return false
 		}
 
-		channel.userLimit = limit
-		return true
+		switch change.op {
+		case Add:
+			throttle, err := ParseJoinThrottle(change.arg)
+			if err != nil {
+				client.ErrInvalidModeParam(channel, change.mode, NewName(change.arg), err)
+				return false
+			}
+			if channel.joinThrottle != nil && *channel.joinThrottle == throttle {
+				return false
+			}
+			channel.joinThrottle = &throttle
+			channel.flood.reset()
+			change.arg = throttle.String()
+			return true
+
+		case Remove:
+			if channel.joinThrottle == nil {
+				return false
+			}
+			channel.joinThrottle = nil
+			return true
+		}
 
-	case ChannelOperator, Voice:
+	case FloodLimitMode:
+		if !channel.ClientIsOperator(client) {
+			client.ErrChanOPrivIsNeeded(channel)
+			return false
+		}
+
+		switch change.op {
+		case Add:
+			limit, err := ParseFloodLimit(change.arg)
+			if err != nil {
+				client.ErrInvalidModeParam(channel, change.mode, NewName(change.arg), err)
+				return false
+			}
+			if channel.floodLimit != nil && *channel.floodLimit == limit {
+				return false
+			}
+			channel.floodLimit = &limit
+			channel.flood.reset()
+			change.arg = limit.String()
+			return true
+
+		case Remove:
+			if channel.floodLimit == nil {
+				return false
+			}
+			channel.floodLimit = nil
+			return true
+		}
+
+	case Forward:
+		if !channel.ClientIsOperator(client) {
+			client.ErrChanOPrivIsNeeded(channel)
+			return false
+		}
+
+		switch change.op {
+		case Add:
+			name := NewName(change.arg)
+			target := channel.server.channels.Get(name)
+			if target == nil || target == channel {
+				client.ErrNoSuchChannel(name)
+				return false
+			}
+			// forwarding fills the target, so its operators must agree
+			if !target.ClientIsOperator(client) {
+				client.ErrChanOPrivIsNeeded(target)
+				return false
+			}
+			if channel.forward == target.name {
+				return false
+			}
+			channel.forward = target.name
+			change.arg = target.name.String()
+			return true
+
+		case Remove:
+			if channel.forward == "" {
+				return false
+			}
+			channel.forward = ""
+			return true
+		}
+
+	case PlaybackMode:
+		if !channel.ClientIsOperator(client) {
+			client.ErrChanOPrivIsNeeded(channel)
+			return false
+		}
+
+		switch change.op {
+		case Add:
+			playback, err := ParsePlayback(change.arg)
+			if err != nil {
+				client.ErrNeedMoreParams("MODE")
+				return false
+			}
+			if channel.playback != nil && *channel.playback == playback {
+				return false
+			}
+			channel.playback = &playback
+			change.arg = playback.String()
+			return true
+
+		case Remove:
+			if channel.playback == nil {
+				return false
+			}
+			channel.playback = nil
+			return true
+		}
+
+	case ChannelOwner, ChannelAdmin, ChannelOperator, HalfOp, Voice:
 		return channel.applyModeMember(client, change.mode, change.op,
 			NewName(change.arg))
 
@@ -452,19 +767,41 @@ func (channel *Channel) Notice(client *Client, message Text) {
 		client.ErrCannotSendToChan(channel)
 		return
 	}
+	if !channel.filter(client, NOTICE, &message) {
+		return
+	}
+	if !channel.checkFlood(client) {
+		return
+	}
 	reply := RplNotice(client, channel, message)
+	tags := channel.record(NOTICE, reply)
+	client.Echo(tags, reply)
 	channel.members.Range(func(member *Client, _ *ChannelModeSet) bool {
 		if member == client {
 			return true
 		}
 		client.server.metrics.Counter("client", "messages").Inc()
-		member.Reply(reply)
+		member.TaggedReply(tags, reply)
 		return true
 	})
 }
 
+// record adds an event to the channel's history and returns the tags
+// it is sent to members with.
+func (channel *Channel) record(command StringCode, reply string) MessageTags {
+	tags := NewMessageTags()
+	channel.server.history.Add(channel.name, HistoryItem{
+		Time:    tags.Time,
+		MsgID:   tags.MsgID,
+		Command: command,
+		Line:    reply,
+	})
+	return tags
+}
+
 func (channel *Channel) Quit(client *Client) {
 	channel.members.Remove(client)
+	channel.flood.remove(client)
 	// XXX: Race Condition from client.destroy()
 	//      Do we need to?
 	// client.channels.Remove(channel)
@@ -474,12 +811,14 @@ func (channel *Channel) Quit(client *Client) {
 	}
 }
 
+// Kick removes target from the channel. Half-operators and above may
+// kick members that don't outrank them.
 func (channel *Channel) Kick(client *Client, target *Client, comment Text) {
 	if !(channel.ClientIsOperator(client) || channel.members.Has(client)) {
 		client.ErrNotOnChannel(channel)
 		return
 	}
-	if !channel.ClientIsOperator(client) {
+	if !channel.ClientIsHalfOp(client) {
 		client.ErrChanOPrivIsNeeded(channel)
 		return
 	}
@@ -487,10 +826,15 @@ func (channel *Channel) Kick(client *Client, target *Client, comment Text) {
 		client.ErrUserNotInChannel(channel, target)
 		return
 	}
+	if memberRank(channel.members.Get(target)) > channel.Rank(client) {
+		client.ErrChanOPrivIsNeeded(channel)
+		return
+	}
 
 	reply := RplKick(channel, client, target, comment)
+	tags := channel.record(KICK, reply)
 	channel.members.Range(func(member *Client, _ *ChannelModeSet) bool {
-		member.Reply(reply)
+		member.TaggedReply(tags, reply)
 		return true
 	})
 	channel.Quit(target)
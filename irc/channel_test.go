@@ -0,0 +1,103 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemberRank(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(modeRank(ChannelOwner) > modeRank(ChannelAdmin))
+	assert.True(modeRank(ChannelAdmin) > modeRank(ChannelOperator))
+	assert.True(modeRank(ChannelOperator) > modeRank(HalfOp))
+	assert.True(modeRank(HalfOp) > modeRank(Voice))
+	assert.True(modeRank(Voice) > 0)
+	assert.Equal(0, modeRank(BanMask))
+
+	modes := NewChannelModeSet()
+	assert.Equal(0, memberRank(modes))
+	assert.Equal("", memberPrefixes(modes, true))
+
+	modes.Set(Voice)
+	modes.Set(HalfOp)
+	modes.Set(ChannelOwner)
+	assert.Equal(modeRank(ChannelOwner), memberRank(modes))
+	assert.Equal("~", memberPrefixes(modes, false))
+	assert.Equal("~%+", memberPrefixes(modes, true))
+
+	creator := NewChannelModeSet()
+	creator.Set(ChannelCreator)
+	creator.Set(ChannelOperator)
+	assert.Equal(modeRank(ChannelOwner), memberRank(creator))
+	assert.Equal("@", memberPrefixes(creator, false))
+
+	assert.Equal(0, memberRank(nil))
+}
+
+func TestChannelModesChanModes(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("Ibeq,k,FHfjl,CSTZcimnpst", SupportedChannelModes.ChanModes())
+	assert.Equal(",,,", ChannelModes{}.ChanModes())
+}
+
+func TestChannelCanSpeak(t *testing.T) {
+	assert := assert.New(t)
+	server := testBouncerServer()
+
+	channel := NewChannel(server, "#canspeak", false)
+	channel.flags.Set(NoOutside)
+	channel.flags.Set(Moderated)
+
+	oper, session := testConnect(server, "")
+	testRegister(oper, session, "speakoper")
+	oper.modes.Set(Operator)
+	assert.False(channel.CanSpeak(oper))
+
+	member, session := testConnect(server, "")
+	testRegister(member, session, "speaker")
+	channel.members.Add(member)
+	assert.False(channel.CanSpeak(member))
+
+	channel.members.Get(member).Set(Voice)
+	assert.True(channel.CanSpeak(member))
+
+	channel.flags.Unset(Moderated)
+	channel.lists[QuietMask].Add("speaker!*@*")
+	channel.members.Get(member).Unset(Voice)
+	assert.False(channel.CanSpeak(member))
+
+	channel.members.Get(member).Set(ChannelOperator)
+	assert.True(channel.CanSpeak(member))
+}
+
+func TestChannelApplyMode(t *testing.T) {
+	assert := assert.New(t)
+	server := testBouncerServer()
+
+	channel := NewChannel(server, "#applymode", false)
+	halfop, session := testConnect(server, "")
+	testRegister(halfop, session, "halfop")
+	channel.members.Add(halfop)
+	channel.members.Get(halfop).Set(HalfOp)
+	testSent(session)
+
+	assert.True(channel.applyMode(halfop, &ChannelModeChange{mode: BanMask, op: Add, arg: "a!*@*"}))
+	assert.True(channel.applyMode(halfop, &ChannelModeChange{mode: QuietMask, op: Add, arg: "b!*@*"}))
+	assert.False(channel.applyMode(halfop, &ChannelModeChange{mode: ExceptMask, op: Add, arg: "c!*@*"}))
+	assert.False(channel.applyMode(halfop, &ChannelModeChange{mode: InviteMask, op: Add, arg: "d!*@*"}))
+	assert.False(channel.applyMode(halfop, &ChannelModeChange{mode: UserLimit, op: Add, arg: "10"}))
+	assert.Equal(uint64(0), channel.userLimit)
+	assert.Equal(3, strings.Count(testSent(session), " 482 "))
+
+	channel.members.Get(halfop).Set(ChannelOperator)
+	assert.True(channel.applyMode(halfop, &ChannelModeChange{mode: UserLimit, op: Add, arg: "10"}))
+	assert.Equal(uint64(10), channel.userLimit)
+	assert.True(channel.applyMode(halfop, &ChannelModeChange{mode: UserLimit, op: Remove}))
+	assert.Equal(uint64(0), channel.userLimit)
+	assert.False(channel.applyMode(halfop, &ChannelModeChange{mode: UserLimit, op: Remove}))
+	assert.Empty(testSent(session))
+}
@@ -0,0 +1,323 @@
+package irc
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultClassName = "default"
+)
+
+// ClassConfig is a connection class. Clients are placed in the most
+// specific class whose criteria they match: every criteria that is set
+// must match, and a class matching on fingerprint beats one matching on
+// account, which beats host, which beats listener.
+type ClassConfig struct {
+	Listen       []string
+	Hosts        []string
+	Accounts     []string
+	Fingerprints []string
+
+	MaxClients    int
+	MaxChannels   int
+	MaxMonitor    int
+	PingFrequency time.Duration
+	PingTimeout   time.Duration
+	FloodConfig   `yaml:",inline"`
+}
+
+// Class is a connection class with its configuration resolved against
+// the server defaults.
+type Class struct {
+	name    string
+	score   int
+	config  ClassConfig
+	hosts   []*net.IPNet
+	clients *Counter
+}
+
+func NewClass(name string, config ClassConfig, flood FloodConfig) *Class {
+	if config.PingFrequency == 0 {
+		config.PingFrequency = IDLE_TIMEOUT
+	}
+	if config.PingTimeout == 0 {
+		config.PingTimeout = QUIT_TIMEOUT
+	}
+	if config.MaxMonitor == 0 {
+		config.MaxMonitor = DefaultMaxMonitor
+	}
+	config.FloodConfig = config.FloodConfig.Merge(flood).WithDefaults()
+
+	class := &Class{
+		name:    name,
+		config:  config,
+		hosts:   ParseNets(config.Hosts),
+		clients: &Counter{},
+	}
+
+	if len(config.Fingerprints) > 0 {
+		class.score += 8
+	}
+	if len(config.Accounts) > 0 {
+		class.score += 4
+	}
+	if len(config.Hosts) > 0 {
+		class.score += 2
+	}
+	if len(config.Listen) > 0 {
+		class.score++
+	}
+	return class
+}
+
+func (class *Class) Name() string {
+	return class.name
+}
+
+func (class *Class) String() string {
+	return class.name
+}
+
+func (class *Class) Flood() FloodConfig {
+	return class.config.FloodConfig
+}
+
+func (class *Class) PingFrequency() time.Duration {
+	return class.config.PingFrequency
+}
+
+func (class *Class) PingTimeout() time.Duration {
+	return class.config.PingTimeout
+}
+
+func (class *Class) MaxChannels() int {
+	return class.config.MaxChannels
+}
+
+// MaxMonitor returns the most nicks a client may MONITOR.
+func (class *Class) MaxMonitor() int {
+	return class.config.MaxMonitor
+}
+
+func (class *Class) MaxClients() int {
+	return class.config.MaxClients
+}
+
+func (class *Class) Clients() int {
+	return class.clients.Value()
+}
+
+// IsFull returns true if the class has reached its client limit.
+func (class *Class) IsFull() bool {
+	return class.config.MaxClients > 0 && class.clients.Value() >= class.config.MaxClients
+}
+
+func containsFold(strs []string, str string) bool {
+	for _, s := range strs {
+		if strings.EqualFold(s, str) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns true if client satisfies all of the class's criteria.
+func (class *Class) Match(client *Client) bool {
+	config := class.config
+	session := client.session()
+
+	if len(config.Listen) > 0 && (session == nil || !containsFold(config.Listen, session.listener)) {
+		return false
+	}
+
+	if len(config.Hosts) > 0 {
+		if session == nil {
+			return false
+		}
+		ip := net.ParseIP(IPString(session.socket.Conn().RemoteAddr()).String())
+		if ip == nil || !matchNets(class.hosts, ip) {
+			return false
+		}
+	}
+
+	if len(config.Accounts) > 0 {
+		account := client.sasl.Id()
+		if account == "" || !containsFold(config.Accounts, account) {
+			return false
+		}
+	}
+
+	if len(config.Fingerprints) > 0 {
+		certfp := client.CertFP()
+		if certfp == "" || !containsFold(config.Fingerprints, certfp) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ClassSet holds the configured connection classes.
+type ClassSet struct {
+	sync.RWMutex
+	classes []*Class
+	def     *Class
+}
+
+func NewClassSet(config *Config) *ClassSet {
+	cs := &ClassSet{}
+	cs.SetConfig(config)
+	return cs
+}
+
+// SetConfig rebuilds the classes from config. Client counts are kept
+// for classes whose name didn't change.
+func (cs *ClassSet) SetConfig(config *Config) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	counters := make(map[string]*Counter)
+	for _, class := range cs.classes {
+		counters[class.name] = class.clients
+	}
+	if cs.def != nil {
+		counters[cs.def.name] = cs.def.clients
+	}
+
+	classes := make([]*Class, 0, len(config.Class))
+	var def *Class
+	for name, classConfig := range config.Class {
+		class := NewClass(name, *classConfig, config.Server.Flood)
+		if name == DefaultClassName {
+			def = class
+			continue
+		}
+		classes = append(classes, class)
+	}
+	if def == nil {
+		def = NewClass(DefaultClassName, ClassConfig{}, config.Server.Flood)
+	}
+
+	sort.Slice(classes, func(i, j int) bool {
+		if classes[i].score != classes[j].score {
+			return classes[i].score > classes[j].score
+		}
+		return classes[i].name < classes[j].name
+	})
+
+	for _, class := range classes {
+		if counter, ok := counters[class.name]; ok {
+			class.clients = counter
+		}
+	}
+	if counter, ok := counters[def.name]; ok {
+		def.clients = counter
+	}
+
+	cs.classes = classes
+	cs.def = def
+}
+
+// Get returns the class called name, or nil if there isn't one.
+func (cs *ClassSet) Get(name string) *Class {
+	cs.RLock()
+	defer cs.RUnlock()
+
+	if name == cs.def.name {
+		return cs.def
+	}
+	for _, class := range cs.classes {
+		if class.name == name {
+			return class
+		}
+	}
+	return nil
+}
+
+// Match returns the most specific class matching client.
+func (cs *ClassSet) Match(client *Client) *Class {
+	cs.RLock()
+	defer cs.RUnlock()
+
+	for _, class := range cs.classes {
+		if class.Match(client) {
+			return class
+		}
+	}
+	return cs.def
+}
+
+// Default returns the class used for clients that match no other class.
+func (cs *ClassSet) Default() *Class {
+	cs.RLock()
+	defer cs.RUnlock()
+	return cs.def
+}
+
+// Range ranges over the classes, most specific first, calling f.
+func (cs *ClassSet) Range(f func(class *Class) bool) {
+	cs.RLock()
+	defer cs.RUnlock()
+	for _, class := range cs.classes {
+		if !f(class) {
+			return
+		}
+	}
+	f(cs.def)
+}
+
+// TooManyChannels reports whether the client has joined as many
+// channels as its class allows. IRC operators aren't limited.
+func (c *Client) TooManyChannels() bool {
+	max := c.class.MaxChannels()
+	return max > 0 && c.channels.Count() >= max && !c.modes.Has(Operator)
+}
+
+// updateClass moves a registered client into its class as reconfigured
+// by a rehash: the class of the same name, or the class it now matches
+// if that was removed. The new limits apply to its current sessions.
+func (c *Client) updateClass() {
+	c.commands.Lock()
+	defer c.commands.Unlock()
+
+	if !c.registered || c.hasQuit.Get() {
+		return
+	}
+	class := c.server.classes.Get(c.class.Name())
+	if class == nil {
+		class = c.server.classes.Match(c)
+	}
+	if class.clients != c.class.clients {
+		c.class.clients.Dec()
+		class.clients.Inc()
+	}
+	c.class = class
+	for _, session := range c.Sessions() {
+		session.updateFlood(class.Flood())
+	}
+}
+
+// CertFP returns the SHA-256 fingerprint of the client's TLS
+// certificate, or an empty string if it didn't present one.
+func (c *Client) CertFP() string {
+	session := c.session()
+	if session == nil {
+		return ""
+	}
+	conn, ok := session.socket.Conn().(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(certs[0].Raw))
+}
@@ -0,0 +1,124 @@
+package irc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassSetMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &Config{}
+	config.Server.Flood.SendQ = 1024
+	config.Class = map[string]*ClassConfig{
+		"tls": {
+			Listen: []string{":6697"},
+		},
+		"bots": {
+			Listen:        []string{":6697"},
+			Accounts:      []string{"bot"},
+			PingFrequency: 5 * time.Minute,
+			MaxChannels:   100,
+		},
+	}
+	cs := NewClassSet(config)
+
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	client := &Client{sasl: NewSaslState()}
+	session := &Session{listener: ":6667", socket: NewSocket(conn)}
+	client.sessions = []*Session{session}
+
+	class := cs.Match(client)
+	assert.Equal(DefaultClassName, class.Name())
+	assert.Equal(IDLE_TIMEOUT, class.PingFrequency())
+	assert.Equal(1024, class.Flood().SendQ)
+	assert.Equal(DefaultRecvQ, class.Flood().RecvQ)
+
+	session.listener = ":6697"
+	assert.Equal("tls", cs.Match(client).Name())
+
+	client.sasl.Login("bot")
+	class = cs.Match(client)
+	assert.Equal("bots", class.Name())
+	assert.Equal(5*time.Minute, class.PingFrequency())
+	assert.Equal(100, class.MaxChannels())
+}
+
+func TestClassIsFull(t *testing.T) {
+	assert := assert.New(t)
+
+	class := NewClass("test", ClassConfig{MaxClients: 1}, FloodConfig{})
+	assert.False(class.IsFull())
+	class.clients.Inc()
+	assert.True(class.IsFull())
+}
+
+func TestClientSetClass(t *testing.T) {
+	assert := assert.New(t)
+
+	flood := FloodConfig{SendQ: 100, RecvQ: 2, Penalty: time.Second, Burst: 5 * time.Second}
+	class := NewClass("small", ClassConfig{FloodConfig: flood}, FloodConfig{})
+
+	session := &Session{sendq: NewSendQueue(DefaultSendQ)}
+	client := &Client{sessions: []*Session{session}}
+	client.SetClass(class)
+
+	assert.Equal(class, client.class)
+	assert.Equal(2, cap(session.recvq))
+	assert.Equal(100, session.sendq.max)
+	assert.Equal(time.Second, session.fakelag.penalty)
+	assert.Equal(5*time.Second, session.fakelag.burst)
+}
+
+func TestClientUpdateClass(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &Config{}
+	config.Class = map[string]*ClassConfig{
+		"bots": {Accounts: []string{"bot"}, PingFrequency: time.Minute},
+	}
+	server := &Server{classes: NewClassSet(config)}
+
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	session := &Session{
+		listener: ":6667",
+		socket:   NewSocket(conn),
+		sendq:    NewSendQueue(DefaultSendQ),
+		fakelag:  NewFakeLag(DefaultFloodPenalty, DefaultFloodBurst),
+	}
+	client := &Client{
+		hasQuit:    NewSyncBool(false),
+		registered: true,
+		sasl:       NewSaslState(),
+		server:     server,
+		sessions:   []*Session{session},
+	}
+	client.sasl.Login("bot")
+	client.class = server.classes.Get("bots")
+	client.class.clients.Inc()
+
+	config.Class["bots"] = &ClassConfig{
+		PingFrequency: 5 * time.Minute,
+		FloodConfig:   FloodConfig{SendQ: 100, Penalty: time.Second, Burst: 2 * time.Second},
+	}
+	server.classes.SetConfig(config)
+	client.updateClass()
+	assert.Equal("bots", client.class.Name())
+	assert.Equal(5*time.Minute, client.class.PingFrequency())
+	assert.Equal(100, session.sendq.max)
+	assert.Equal(2*time.Second, session.fakelag.burst)
+	assert.Equal(1, client.class.Clients())
+
+	// the client is moved to the class it matches when its class is removed
+	delete(config.Class, "bots")
+	server.classes.SetConfig(config)
+	client.updateClass()
+	assert.Equal(DefaultClassName, client.class.Name())
+	assert.Equal(1, client.class.Clients())
+	assert.Equal(DefaultSendQ, session.sendq.max)
+}
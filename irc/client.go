@@ -1,12 +1,12 @@
 package irc
 
 import (
-	"crypto/tls"
 	"fmt"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/eyedeekay/sam3/i2pkeys"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -40,117 +40,383 @@ func (sb *SyncBool) Set(value bool) {
 }
 
 type Client struct {
-	atime        time.Time
-	authorized   bool
-	awayMessage  Text
-	capabilities CapabilitySet
-	capState     CapState
-	channels     *ChannelSet
-	ctime        time.Time
-	modes        *UserModeSet
-	hasQuit      *SyncBool
-	hops         uint
-	hostname     Name
-	hostmask     Name // Cloacked hostname (SHA256)
-	pingTime     time.Time
-	idleTimer    *time.Timer
-	nick         Name
-	quitTimer    *time.Timer
-	realname     Text
-	registered   bool
-	sasl         *SaslState
-	server       *Server
-	socket       *Socket
-	replies      chan string
-	username     Name
-}
-
-func NewClient(server *Server, conn net.Conn) *Client {
+	atime         time.Time
+	authorized    bool
+	awayMessage   Text
+	channels      *ChannelSet
+	class         *Class
+	commands      sync.Mutex
+	ctime         time.Time
+	modes         *UserModeSet
+	hasQuit       *SyncBool
+	hops          uint
+	hostname      Name
+	hostmask      Name // Cloacked hostname
+	ignores       *IgnoreLists
+	lookup        chan Name
+	nick          Name
+	realname      Text
+	registered    bool
+	replay        []replayLine
+	replyTo       *Session
+	sasl          *SaslState
+	server        *Server
+	sessions      []*Session
+	sessionsMutex sync.RWMutex
+	username      Name
+}
+
+// replayLine is a line kept for replay while a client is detached.
+type replayLine struct {
+	tags MessageTags
+	line string
+}
+
+func NewClient(server *Server, conn net.Conn, listener string, limit *LimiterKey) *Client {
+	c := newClient(server)
+	session := newSession(c, conn, listener)
+	session.limit = limit
+	c.sessions = []*Session{session}
+	if session.IsSecure() {
+		c.modes.Set(SecureConn)
+	}
+	c.lookupHostname()
+	session.start()
+	return c
+}
+
+// newClient allocates a client without any sessions.
+func newClient(server *Server) *Client {
 	now := time.Now()
 	c := &Client{
-		atime:        now,
-		authorized:   len(server.password) == 0,
-		capState:     CapNone,
-		capabilities: make(CapabilitySet),
-		channels:     NewChannelSet(),
-		ctime:        now,
-		modes:        NewUserModeSet(),
-		hasQuit:      NewSyncBool(false),
-		sasl:         NewSaslState(),
-		server:       server,
-		socket:       NewSocket(conn),
-		replies:      make(chan string),
-	}
-
-	if _, ok := conn.(*tls.Conn); ok {
-		c.modes.Set(SecureConn)
+		atime:      now,
+		authorized: len(server.serverPassword()) == 0,
+		channels:   NewChannelSet(),
+		class:      server.classes.Default(),
+		ctime:      now,
+		modes:      NewUserModeSet(),
+		hasQuit:    NewSyncBool(false),
+		ignores:    NewIgnoreLists(),
+		sasl:       NewSaslState(),
+		server:     server,
 	}
 
-	c.Touch()
-	go c.writeloop()
-	go c.readloop()
+	server.connected.Add(c)
 
 	return c
 }
 
+//
+// sessions
+//
+
+// Sessions returns the client's sessions.
+func (c *Client) Sessions() []*Session {
+	c.sessionsMutex.RLock()
+	defer c.sessionsMutex.RUnlock()
+	return append([]*Session(nil), c.sessions...)
+}
+
+// session returns the session whose command is being handled, or
+// else the client's first session. Unregistered clients have exactly
+// one session.
+func (c *Client) session() *Session {
+	c.sessionsMutex.RLock()
+	defer c.sessionsMutex.RUnlock()
+	if c.replyTo != nil {
+		return c.replyTo
+	}
+	if len(c.sessions) == 0 {
+		return nil
+	}
+	return c.sessions[0]
+}
+
+func (c *Client) setReplyTo(session *Session) {
+	c.sessionsMutex.Lock()
+	defer c.sessionsMutex.Unlock()
+	c.replyTo = session
+}
+
+// replySessions returns the sessions responses are sent to: the
+// session whose command is being handled, or else every session.
+func (c *Client) replySessions() []*Session {
+	c.sessionsMutex.RLock()
+	defer c.sessionsMutex.RUnlock()
+	if c.replyTo != nil {
+		return []*Session{c.replyTo}
+	}
+	return append([]*Session(nil), c.sessions...)
+}
+
+// HasCapability returns true if every session the client's responses
+// are sent to has enabled capability.
+func (c *Client) HasCapability(capability Capability) bool {
+	sessions := c.replySessions()
+	for _, session := range sessions {
+		if !session.capabilities[capability] {
+			return false
+		}
+	}
+	return len(sessions) > 0
+}
+
+// AlwaysOn returns true if the client stays on the server when its
+// last session closes.
+func (c *Client) AlwaysOn() bool {
+	config := c.server.Config().Server.Bouncer
+	return config.Enabled && config.AlwaysOn && c.registered && c.sasl.Id() != ""
+}
+
+// detach removes session from the client, unless it is the last
+// session of a client that isn't always-on, and returns whether it
+// did.
+func (c *Client) detach(session *Session) bool {
+	c.sessionsMutex.Lock()
+	defer c.sessionsMutex.Unlock()
+
+	for i, s := range c.sessions {
+		if s != session {
+			continue
+		}
+		if len(c.sessions) == 1 && !c.AlwaysOn() {
+			return false
+		}
+		c.sessions = append(c.sessions[:i], c.sessions[i+1:]...)
+		if c.replyTo == session {
+			c.replyTo = nil
+		}
+		if len(c.sessions) == 0 {
+			c.logger().Info("detached")
+		}
+		return true
+	}
+	return true
+}
+
+// attach moves the session of conn, a connection that has just
+// completed registration, to the client. The session is welcomed as
+// the client and sent the client's channels and whatever was kept for
+// replay while the client was detached.
+func (c *Client) attach(conn *Client) {
+	session := conn.session()
+	conn.sessionsMutex.Lock()
+	conn.sessions = nil
+	conn.sessionsMutex.Unlock()
+	c.server.clients.Remove(conn)
+	c.server.connected.Remove(conn)
+
+	c.commands.Lock()
+	defer c.commands.Unlock()
+
+	session.client = c
+	session.SetFlood(c.class.Flood())
+	c.sessionsMutex.Lock()
+	c.sessions = append(c.sessions, session)
+	replay := c.replay
+	c.replay = nil
+	c.sessionsMutex.Unlock()
+	c.logger().WithField("remote", session.String()).Info("attached")
+
+	c.setReplyTo(session)
+	defer c.setReplyTo(nil)
+	c.server.welcome(c)
+	c.channels.Range(func(channel *Channel) bool {
+		session.Reply(RplJoin(c, channel))
+		c.RplMarkRead(channel.name)
+		channel.GetTopic(c)
+		channel.Names(c)
+		return true
+	})
+	for _, line := range replay {
+		session.TaggedReply(line.tags, line.line)
+	}
+}
+
 //
 // command goroutine
 //
 
-func (c *Client) writeloop() {
-	for {
-		select {
-		case reply, ok := <-c.replies:
-			if !ok || reply == "" || c.socket == nil {
-				return
-			}
-			c.socket.Write(reply)
+func (c *Client) handleLine(session *Session, line string) {
+	command, err := ParseCommand(line)
+	if err != nil {
+		session.logger().Debugf("parse error: %s: %s", err, line)
+		switch err {
+		case ErrParseCommand:
+			//TODO(dan): use the real failed numeric for this (400)
+			session.Reply(RplNotice(c.server, c, NewText("failed to parse command")))
+
+		case NotEnoughArgsError:
+			// TODO
 		}
+		return
 	}
+
+	if checkPass, ok := command.(checkPasswordCommand); ok {
+		checkPass.LoadPassword(c.server)
+		// Block the client thread while handling a potentially expensive
+		// password bcrypt operation. Since the server is single-threaded
+		// for commands, we don't want the server to perform the bcrypt,
+		// blocking anyone else from sending commands until it
+		// completes. This could be a form of DoS if handled naively.
+		checkPass.CheckPassword()
+	}
+
+	c.processCommand(session, command)
 }
 
-func (c *Client) readloop() {
-	var command Command
-	var err error
-	var line string
+// lookupHostname sets the client's hostname to its IP address and, if
+// enabled for its listener, starts looking up its real hostname in the
+// background. The result is applied by waitHostname.
+//
+// Clients of I2P and Tor listeners are given the listener's virtual
+// hostname instead; I2P clients keep their .b32.i2p destination as
+// their real hostname. Clients of unix socket listeners are local and
+// are given "localhost".
+func (c *Client) lookupHostname() {
+	session := c.session()
+	if _, ok := session.socket.Conn().RemoteAddr().(*net.UnixAddr); ok {
+		c.hostname = "localhost"
+		c.hostmask = c.cloakedHost()
+		return
+	}
 
-	// Set the hostname for this client.
-	c.hostname = AddrLookupHostname(c.socket.conn.RemoteAddr())
-	c.hostmask = NewName(SHA256(c.hostname.String()))
+	if hostname, ok := c.server.Config().ListenerHostname(session.listener); ok {
+		c.hostname = hostname
+		c.hostmask = hostname
+		if addr, ok := session.socket.Conn().RemoteAddr().(i2pkeys.I2PAddr); ok {
+			c.hostname = NewName(addr.Base32())
+		}
+		return
+	}
 
-	for err == nil {
-		if line, err = c.socket.Read(); err != nil {
-			command = NewQuitCommand("connection closed")
+	ip := IPString(session.socket.Conn().RemoteAddr())
+	c.hostname = ip
+	c.hostmask = c.server.cloaker.Cloak(ip)
 
-		} else if command, err = ParseCommand(line); err != nil {
-			switch err {
-			case ErrParseCommand:
-				//TODO(dan): use the real failed numeric for this (400)
-				c.Reply(RplNotice(c.server, c, NewText("failed to parse command")))
+	if !c.server.resolver.Enabled(session.listener) {
+		return
+	}
 
-			case NotEnoughArgsError:
-				// TODO
-			}
-			// so the read loop will continue
-			err = nil
-			continue
+	// the replies are built here as the client's nick may change while
+	// the lookup runs
+	foundReply := RplNotice(c.server, c, "*** Found your hostname")
+	notFoundReply := RplNotice(c.server, c,
+		"*** Couldn't look up your hostname, using your IP address instead")
+	c.lookup = make(chan Name, 1)
+	c.Reply(RplNotice(c.server, c, "*** Looking up your hostname..."))
+	go func() {
+		hostname, found := c.server.resolver.Lookup(ip)
+		if found {
+			c.Reply(foundReply)
+		} else {
+			c.Reply(notFoundReply)
+		}
+		c.lookup <- hostname
+	}()
+}
 
-		} else if checkPass, ok := command.(checkPasswordCommand); ok {
-			checkPass.LoadPassword(c.server)
-			// Block the client thread while handling a potentially expensive
-			// password bcrypt operation. Since the server is single-threaded
-			// for commands, we don't want the server to perform the bcrypt,
-			// blocking anyone else from sending commands until it
-			// completes. This could be a form of DoS if handled naively.
-			checkPass.CheckPassword()
+// waitHostname waits for a hostname lookup started by lookupHostname.
+func (c *Client) waitHostname() {
+	if c.lookup == nil {
+		return
+	}
+	c.hostname = <-c.lookup
+	c.hostmask = c.cloakedHost()
+	c.lookup = nil
+}
+
+// cloakedHost returns the host shown for the client when it has no
+// vhost.
+func (c *Client) cloakedHost() Name {
+	if session := c.session(); session != nil {
+		if hostname, ok := c.server.Config().ListenerHostname(session.listener); ok {
+			return hostname
 		}
+	}
+	return c.server.cloaker.Cloak(c.hostname)
+}
+
+// ChangeHost changes the client's displayed host. Friends with the
+// chghost capability are sent a CHGHOST, everyone else sees the client
+// quit and rejoin its channels.
+func (c *Client) ChangeHost(hostmask Name) {
+	if hostmask == c.hostmask {
+		return
+	}
+	if !c.registered {
+		c.hostmask = hostmask
+		return
+	}
+
+	// Make replies before changing host to capture original source id.
+	chghost := RplChgHost(c, hostmask)
+	quit := RplQuit(c, "Changing host")
+	c.hostmask = hostmask
 
-		c.processCommand(command)
+	for _, session := range c.Sessions() {
+		if session.capabilities[ChgHost] {
+			session.Reply(chghost)
+		}
 	}
+	c.RplHostHidden(hostmask)
+
+	friends := c.Friends()
+	friends.Remove(c)
+	fallback := NewClientSet()
+	friends.Range(func(friend *Client) bool {
+		if friend.HasCapability(ChgHost) {
+			friend.Reply(chghost)
+		} else {
+			friend.Reply(quit)
+			fallback.Add(friend)
+		}
+		return true
+	})
+	if fallback.Count() == 0 {
+		return
+	}
+
+	c.channels.Range(func(channel *Channel) bool {
+		join := RplJoin(c, channel)
+		changes := ChannelModeChanges{}
+		channel.members.Get(c).Range(func(mode ChannelMode) bool {
+			changes = append(changes, &ChannelModeChange{
+				mode: mode,
+				op:   Add,
+				arg:  c.nick.String(),
+			})
+			return true
+		})
+		var modes string
+		if len(changes) > 0 {
+			modes = NewStringReply(c.server, MODE, "%s %s", channel, changes)
+		}
+		channel.members.Range(func(member *Client, _ *ChannelModeSet) bool {
+			if fallback.Has(member) {
+				member.Reply(join)
+				if modes != "" {
+					member.Reply(modes)
+				}
+			}
+			return true
+		})
+		return true
+	})
 }
 
-func (c *Client) processCommand(cmd Command) {
+// processCommand handles a command received on session. Commands of
+// a client's sessions are handled one at a time, and numeric replies
+// to them are sent only to the session.
+func (c *Client) processCommand(session *Session, cmd Command) {
+	c.commands.Lock()
+	defer c.commands.Unlock()
+
 	cmd.SetClient(c)
+	cmd.SetSession(session)
+	c.setReplyTo(session)
+	defer c.setReplyTo(nil)
+	session.logger().WithField("command", cmd.Code().String()).Debug("processing command")
 
 	if !c.registered {
 		regCmd, ok := cmd.(RegServerCommand)
@@ -177,33 +443,19 @@ func (c *Client) processCommand(cmd Command) {
 
 	switch srvCmd.(type) {
 	case *PingCommand, *PongCommand:
-		c.Touch()
+		session.Touch()
 
 	case *QuitCommand:
 		// no-op
 
 	default:
 		c.Active()
-		c.Touch()
+		session.Touch()
 	}
 
 	srvCmd.HandleServer(c.server)
 }
 
-// quit timer goroutine
-
-func (c *Client) connectionTimeout() {
-	c.processCommand(NewQuitCommand("connection timeout"))
-}
-
-//
-// idle timer goroutine
-//
-
-func (c *Client) connectionIdle() {
-	c.server.idle <- c
-}
-
 //
 // server goroutine
 //
@@ -212,26 +464,12 @@ func (c *Client) Active() {
 	c.atime = time.Now()
 }
 
-func (c *Client) Touch() {
-	if c.quitTimer != nil {
-		c.quitTimer.Stop()
-	}
-
-	if c.idleTimer == nil {
-		c.idleTimer = time.AfterFunc(IDLE_TIMEOUT, c.connectionIdle)
-	} else {
-		c.idleTimer.Reset(IDLE_TIMEOUT)
-	}
-}
-
-func (c *Client) Idle() {
-	c.pingTime = time.Now()
-	c.Reply(RplPing(c.server))
-
-	if c.quitTimer == nil {
-		c.quitTimer = time.AfterFunc(QUIT_TIMEOUT, c.connectionTimeout)
-	} else {
-		c.quitTimer.Reset(QUIT_TIMEOUT)
+// SetClass moves the client into class, applying its limits. It must
+// be called before the client registers.
+func (c *Client) SetClass(class *Class) {
+	c.class = class
+	for _, session := range c.Sessions() {
+		session.SetFlood(class.Flood())
 	}
 }
 
@@ -240,8 +478,11 @@ func (c *Client) Register() {
 		return
 	}
 	c.registered = true
+	c.class.clients.Inc()
 	c.modes.Set(HostMask)
-	c.Touch()
+	for _, session := range c.Sessions() {
+		session.Touch()
+	}
 }
 
 func (c *Client) destroy() {
@@ -254,29 +495,14 @@ func (c *Client) destroy() {
 
 	// clean up server
 
-	if _, ok := c.socket.conn.(*tls.Conn); ok {
-		c.server.metrics.GaugeVec("server", "clients").WithLabelValues("secure").Dec()
-	} else {
-		c.server.metrics.GaugeVec("server", "clients").WithLabelValues("insecure").Dec()
+	if c.registered {
+		c.class.clients.Dec()
 	}
-
-	c.server.connections.Dec()
 	c.server.clients.Remove(c)
+	c.server.connected.Remove(c)
+	c.server.monitors.RemoveAll(c)
 
-	// clean up self
-
-	if c.idleTimer != nil {
-		c.idleTimer.Stop()
-	}
-	if c.quitTimer != nil {
-		c.quitTimer.Stop()
-	}
-
-	close(c.replies)
-
-	c.socket.Close()
-
-	log.Debugf("%s: destroyed", c)
+	c.logger().Debug("destroyed")
 }
 
 func (c *Client) IdleTime() time.Duration {
@@ -323,12 +549,28 @@ func (c *Client) UserHost(cloacked bool) Name {
 	return Name(fmt.Sprintf("%s!%s@%s", c.nick, username, c.hostname))
 }
 
+// UserHosts returns the client's real userhost followed by its cloaked
+// userhosts under every configured cloak key, for matching ban masks.
+func (c *Client) UserHosts() []Name {
+	username := "*"
+	if c.username != "" {
+		username = c.username.String()
+	}
+	userhosts := []Name{c.UserHost(false), c.UserHost(true)}
+	for _, cloak := range c.server.cloaker.CloakAll(c.hostname) {
+		if cloak != c.hostmask {
+			userhosts = append(userhosts, Name(fmt.Sprintf("%s!%s@%s", c.nick, username, cloak)))
+		}
+	}
+	return userhosts
+}
+
 func (c *Client) Server() Name {
-	return c.server.name
+	return c.server.Id()
 }
 
 func (c *Client) ServerInfo() string {
-	return c.server.description
+	return c.server.Description()
 }
 
 func (c *Client) Nick() Name {
@@ -342,6 +584,10 @@ func (c *Client) Id() Name {
 	return c.UserHost(true)
 }
 
+func (c *Client) logger() *log.Entry {
+	return log.WithField("client", c.Id().String())
+}
+
 func (c *Client) String() string {
 	return c.Id().String()
 }
@@ -361,7 +607,7 @@ func (c *Client) Friends() *ClientSet {
 
 func (c *Client) SetNickname(nickname Name) {
 	if c.nick != "" {
-		log.Errorf("%s nickname already set!", c)
+		c.logger().Error("nickname already set!")
 		return
 	}
 	c.nick = nickname
@@ -373,31 +619,119 @@ func (c *Client) ChangeNickname(nickname Name) {
 	reply := RplNick(c, nickname)
 	c.server.clients.Remove(c)
 	c.server.whoWas.Append(c)
+	oldNick := c.nick
 	c.nick = nickname
 	c.server.clients.Add(c)
 	c.Friends().Range(func(friend *Client) bool {
 		friend.Reply(reply)
 		return true
 	})
+	if c.registered && oldNick.ToLower() != nickname.ToLower() {
+		c.server.monitorOffline(oldNick)
+		c.server.monitorOnline(c)
+	}
 }
 
+// Reply sends reply to every session of the client, or keeps it for
+// replay if the client is detached.
 func (c *Client) Reply(reply string) {
-	if !c.hasQuit.Get() {
-		c.replies <- reply
+	c.TaggedReply(MessageTags{}, reply)
+}
+
+// TaggedReply sends reply to every session with the tags it has
+// enabled, or keeps it for replay if the client is detached.
+func (c *Client) TaggedReply(tags MessageTags, reply string) {
+	if c.hasQuit.Get() {
+		return
+	}
+	sessions := c.Sessions()
+	for _, session := range sessions {
+		session.TaggedReply(tags, reply)
+	}
+	if len(sessions) == 0 && c.registered {
+		c.keep(tags, reply)
 	}
 }
 
+// Respond sends reply to the session whose command is being handled,
+// or to every session if there is none.
+func (c *Client) Respond(reply string) {
+	if c.hasQuit.Get() {
+		return
+	}
+	for _, session := range c.replySessions() {
+		session.Reply(reply)
+	}
+}
+
+// RespondAll sends the responses of f to every session.
+func (c *Client) RespondAll(f func()) {
+	c.sessionsMutex.RLock()
+	replyTo := c.replyTo
+	c.sessionsMutex.RUnlock()
+	c.setReplyTo(nil)
+	defer c.setReplyTo(replyTo)
+	f()
+}
+
+// Echo sends reply, a message the client sent, to its other sessions.
+func (c *Client) Echo(tags MessageTags, reply string) {
+	c.sessionsMutex.RLock()
+	replyTo := c.replyTo
+	c.sessionsMutex.RUnlock()
+	for _, session := range c.Sessions() {
+		if session != replyTo {
+			session.TaggedReply(tags, reply)
+		}
+	}
+}
+
+// keep keeps reply for replay when a session attaches, dropping the
+// oldest lines beyond the configured limit.
+func (c *Client) keep(tags MessageTags, reply string) {
+	if tags.Time.IsZero() {
+		tags.Time = time.Now()
+	}
+	c.sessionsMutex.Lock()
+	defer c.sessionsMutex.Unlock()
+	c.replay = append(c.replay, replayLine{tags, reply})
+	if max := c.server.Config().Server.Bouncer.replay(); len(c.replay) > max {
+		c.replay = c.replay[len(c.replay)-max:]
+	}
+}
+
+// serverQuit quits the client on behalf of the server, taking the
+// command lock that Quit must be called with. It must not be called
+// while handling one of the client's commands.
+func (c *Client) serverQuit(message Text) {
+	c.commands.Lock()
+	defer c.commands.Unlock()
+	c.Quit(message)
+}
+
+// Quit quits the client with all of its sessions.
 func (c *Client) Quit(message Text) {
 	if c.hasQuit.Get() {
 		return
 	}
 
 	c.hasQuit.Set(true)
-	c.Reply(RplError("quit"))
+	c.sessionsMutex.Lock()
+	sessions := c.sessions
+	c.sessions = nil
+	c.replyTo = nil
+	c.sessionsMutex.Unlock()
+	for _, session := range sessions {
+		session.close(message)
+	}
+
 	c.server.whoWas.Append(c)
 	friends := c.Friends()
 	friends.Remove(c)
 	c.destroy()
+	if c.registered {
+		c.server.monitorOffline(c.nick)
+	}
 
 	if friends.Count() > 0 {
 		reply := RplQuit(c, message)
@@ -19,7 +19,11 @@ func ExpandUserHost(userhost Name) (expanded Name) {
 	expanded = userhost
 	// fill in missing wildcards for nicks
 	if !strings.Contains(expanded.String(), "!") {
-		expanded += "!*"
+		if strings.Contains(expanded.String(), "@") {
+			expanded = "*!" + expanded
+		} else {
+			expanded += "!*"
+		}
 	}
 	if !strings.Contains(expanded.String(), "@") {
 		expanded += "@*"
@@ -135,8 +139,9 @@ func (clients *ClientLookupSet) Find(userhost Name) *Client {
 //
 
 type UserMaskSet struct {
-	masks  map[Name]bool
-	regexp *regexp.Regexp
+	masks   map[Name]bool
+	regexp  *regexp.Regexp
+	extbans []*ExtBan
 }
 
 func NewUserMaskSet() *UserMaskSet {
@@ -181,6 +186,34 @@ func (set *UserMaskSet) Match(userhost Name) bool {
 	return set.regexp.MatchString(userhost.String())
 }
 
+// MatchAny reports whether any of userhosts matches a mask in the set.
+func (set *UserMaskSet) MatchAny(userhosts []Name) bool {
+	for _, userhost := range userhosts {
+		if set.Match(userhost) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchClient reports whether any of client's userhosts matches a mask
+// in the set or client matches an extban in it.
+func (set *UserMaskSet) MatchClient(client *Client) bool {
+	return set.matchClient(client, false)
+}
+
+func (set *UserMaskSet) matchClient(client *Client, nested bool) bool {
+	if set.MatchAny(client.UserHosts()) {
+		return true
+	}
+	for _, ban := range set.extbans {
+		if ban.Match(client, nested) {
+			return true
+		}
+	}
+	return false
+}
+
 func (set *UserMaskSet) String() string {
 	masks := make([]string, len(set.masks))
 	index := 0
@@ -196,28 +229,40 @@ func (set *UserMaskSet) String() string {
 // `?`. All the pieces are meta-escaped. `*` is replaced with `.*`,
 // the regexp equivalent. Likewise, `?` is replaced with `.`. The
 // parts are re-joined and finally all masks are joined into a big
-// or-expression.
+// or-expression. Extbans are parsed separately and invalid ones are
+// ignored.
 func (set *UserMaskSet) setRegexp() {
-	if len(set.masks) == 0 {
-		set.regexp = nil
-		return
-	}
+	set.regexp = nil
+	set.extbans = nil
 
-	maskExprs := make([]string, len(set.masks))
-	index := 0
+	var maskExprs []string
 	for mask := range set.masks {
-		manyParts := strings.Split(mask.String(), "*")
-		manyExprs := make([]string, len(manyParts))
-		for mindex, manyPart := range manyParts {
-			oneParts := strings.Split(manyPart, "?")
-			oneExprs := make([]string, len(oneParts))
-			for oindex, onePart := range oneParts {
-				oneExprs[oindex] = regexp.QuoteMeta(onePart)
+		if IsExtBan(mask) {
+			if ban, err := ParseExtBan(mask); err == nil {
+				set.extbans = append(set.extbans, ban)
 			}
-			manyExprs[mindex] = strings.Join(oneExprs, ".")
+			continue
 		}
-		maskExprs[index] = strings.Join(manyExprs, ".*")
+		maskExprs = append(maskExprs, globExpr(mask.String()))
+	}
+	if len(maskExprs) == 0 {
+		return
 	}
-	expr := "^" + strings.Join(maskExprs, "|") + "$"
+	expr := "^(?:" + strings.Join(maskExprs, "|") + ")$"
 	set.regexp, _ = regexp.Compile(expr)
 }
+
+// globExpr returns the regular expression equivalent of a glob.
+func globExpr(glob string) string {
+	manyParts := strings.Split(glob, "*")
+	manyExprs := make([]string, len(manyParts))
+	for mindex, manyPart := range manyParts {
+		oneParts := strings.Split(manyPart, "?")
+		oneExprs := make([]string, len(oneParts))
+		for oindex, onePart := range oneParts {
+			oneExprs[oindex] = regexp.QuoteMeta(onePart)
+		}
+		manyExprs[mindex] = strings.Join(oneExprs, ".")
+	}
+	return strings.Join(manyExprs, ".*")
+}
@@ -0,0 +1,129 @@
+package irc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultCloakSuffix = "ip"
+)
+
+// CloakConfig configures host cloaking. The first key is used to cloak
+// hosts; any further keys are old keys still honoured when matching
+// ban masks, so keys can be rotated by prepending a new one. Suffix is
+// appended to cloaked IP addresses.
+type CloakConfig struct {
+	Keys   []string
+	Suffix string
+}
+
+// KeyBytes returns the configured keys, skipping empty ones.
+func (config CloakConfig) KeyBytes() [][]byte {
+	keys := make([][]byte, 0, len(config.Keys))
+	for _, key := range config.Keys {
+		if key != "" {
+			keys = append(keys, []byte(key))
+		}
+	}
+	return keys
+}
+
+// Cloaker produces HMAC keyed host cloaks that keep enough structure
+// to ban ranges: cloaked IPv4 addresses contain hashes of the /32, /24
+// and /16, IPv6 addresses of the /128, /64 and /48, and hostnames keep
+// their domain.
+type Cloaker struct {
+	sync.RWMutex
+	keys   [][]byte
+	suffix string
+}
+
+func NewCloaker(config CloakConfig) *Cloaker {
+	cloaker := &Cloaker{}
+	cloaker.SetConfig(config)
+	return cloaker
+}
+
+// SetConfig replaces the cloaking keys and suffix. Config.Validate
+// requires a key, since cloaks made with a key that isn't kept across
+// restarts would stop matching bans.
+func (cloaker *Cloaker) SetConfig(config CloakConfig) {
+	cloaker.Lock()
+	defer cloaker.Unlock()
+
+	keys := config.KeyBytes()
+	if len(keys) == 0 {
+		keys = cloaker.keys
+	}
+
+	suffix := config.Suffix
+	if suffix == "" {
+		suffix = DefaultCloakSuffix
+	}
+
+	cloaker.keys = keys
+	cloaker.suffix = suffix
+}
+
+// Cloak returns the cloak of host using the current key.
+func (cloaker *Cloaker) Cloak(host Name) Name {
+	cloaker.RLock()
+	defer cloaker.RUnlock()
+	return cloaker.cloak(cloaker.keys[0], host)
+}
+
+// CloakAll returns the cloaks of host under every configured key.
+func (cloaker *Cloaker) CloakAll(host Name) []Name {
+	cloaker.RLock()
+	defer cloaker.RUnlock()
+
+	cloaks := make([]Name, len(cloaker.keys))
+	for i, key := range cloaker.keys {
+		cloaks[i] = cloaker.cloak(key, host)
+	}
+	return cloaks
+}
+
+func cloakSegment(key []byte, data string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil)[:4])
+}
+
+func (cloaker *Cloaker) cloak(key []byte, host Name) Name {
+	str := host.String()
+
+	if ip := net.ParseIP(str); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return Name(strings.Join([]string{
+				cloakSegment(key, ip4.String()),
+				cloakSegment(key, ip4.Mask(net.CIDRMask(24, 32)).String()),
+				cloakSegment(key, ip4.Mask(net.CIDRMask(16, 32)).String()),
+				cloaker.suffix,
+			}, "."))
+		}
+		return Name(strings.Join([]string{
+			cloakSegment(key, ip.String()),
+			cloakSegment(key, ip.Mask(net.CIDRMask(64, 128)).String()),
+			cloakSegment(key, ip.Mask(net.CIDRMask(48, 128)).String()),
+			cloaker.suffix,
+		}, ":"))
+	}
+
+	labels := strings.Split(str, ".")
+	switch {
+	case len(labels) > 2:
+		parent := strings.Join(labels[1:], ".")
+		domain := strings.Join(labels[len(labels)-2:], ".")
+		return Name(cloakSegment(key, str) + "." + cloakSegment(key, parent) + "." + domain)
+	case len(labels) == 2:
+		return Name(cloakSegment(key, str) + "." + str)
+	default:
+		return Name(cloakSegment(key, str) + "." + cloaker.suffix)
+	}
+}
@@ -0,0 +1,70 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloakIPv4(t *testing.T) {
+	assert := assert.New(t)
+
+	cloaker := NewCloaker(CloakConfig{Keys: []string{"secret"}, Suffix: "users.test"})
+
+	a := strings.Split(cloaker.Cloak("10.1.2.3").String(), ".")
+	b := strings.Split(cloaker.Cloak("10.1.2.4").String(), ".")
+	c := strings.Split(cloaker.Cloak("10.1.3.4").String(), ".")
+
+	assert.Len(a, 5)
+	assert.Equal([]string{"users", "test"}, a[3:])
+	assert.NotEqual(a[0], b[0])
+	assert.Equal(a[1:], b[1:])
+	assert.NotEqual(a[1], c[1])
+	assert.Equal(a[2:], c[2:])
+}
+
+func TestCloakIPv6(t *testing.T) {
+	assert := assert.New(t)
+
+	cloaker := NewCloaker(CloakConfig{Keys: []string{"secret"}})
+
+	a := strings.Split(cloaker.Cloak("2001:db8:1:1::1").String(), ":")
+	b := strings.Split(cloaker.Cloak("2001:db8:1:1::2").String(), ":")
+
+	assert.Len(a, 4)
+	assert.Equal(DefaultCloakSuffix, a[3])
+	assert.NotEqual(a[0], b[0])
+	assert.Equal(a[1:], b[1:])
+}
+
+func TestCloakHostname(t *testing.T) {
+	assert := assert.New(t)
+
+	cloaker := NewCloaker(CloakConfig{Keys: []string{"secret"}})
+
+	cloak := cloaker.Cloak("dsl-1-2-3.pool.example.com").String()
+	assert.Regexp(`^[0-9a-f]{8}\.[0-9a-f]{8}\.example\.com$`, cloak)
+	assert.NotContains(cloak, "pool")
+
+	assert.Regexp(`^[0-9a-f]{8}\.example\.com$`, cloaker.Cloak("example.com").String())
+	assert.Regexp(`^[0-9a-f]{8}\.ip$`, cloaker.Cloak("localhost").String())
+}
+
+func TestCloakKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	old := NewCloaker(CloakConfig{Keys: []string{"old"}})
+	cloaker := NewCloaker(CloakConfig{Keys: []string{"new", "old"}})
+
+	assert.NotEqual(old.Cloak("10.1.2.3"), cloaker.Cloak("10.1.2.3"))
+	assert.Equal(
+		[]Name{cloaker.Cloak("10.1.2.3"), old.Cloak("10.1.2.3")},
+		cloaker.CloakAll("10.1.2.3"),
+	)
+
+	// keys are kept if a config without any is applied
+	cloaker.SetConfig(CloakConfig{Keys: []string{""}})
+	assert.Equal(old.Cloak("10.1.2.3"), cloaker.CloakAll("10.1.2.3")[1])
+	assert.Len(cloaker.keys, 2)
+}
@@ -11,8 +11,10 @@ import (
 type Command interface {
 	Client() *Client
 	Code() StringCode
+	Session() *Session
 	SetClient(*Client)
 	SetCode(StringCode)
+	SetSession(*Session)
 }
 
 type checkPasswordCommand interface {
@@ -26,16 +28,21 @@ var (
 	NotEnoughArgsError = errors.New("not enough arguments")
 	ErrParseCommand    = errors.New("failed to parse message")
 	parseCommandFuncs  = map[StringCode]parseCommandFunc{
+		ACCEPT:       ParseAcceptCommand,
 		AUTHENTICATE: ParseAuthenticateCommand,
 		AWAY:         ParseAwayCommand,
 		CAP:          ParseCapCommand,
+		CHATHISTORY:  ParseChatHistoryCommand,
+		CHGHOST:      ParseChgHostCommand,
 		INVITE:       ParseInviteCommand,
 		ISON:         ParseIsOnCommand,
 		JOIN:         ParseJoinCommand,
 		KICK:         ParseKickCommand,
 		KILL:         ParseKillCommand,
 		LIST:         ParseListCommand,
+		MARKREAD:     ParseMarkReadCommand,
 		MODE:         ParseModeCommand,
+		MONITOR:      ParseMonitorCommand,
 		MOTD:         ParseMOTDCommand,
 		NAMES:        ParseNamesCommand,
 		NICK:         ParseNickCommand,
@@ -43,17 +50,22 @@ var (
 		ONICK:        ParseOperNickCommand,
 		OPER:         ParseOperCommand,
 		REHASH:       ParseRehashCommand,
+		SILENCE:      ParseSilenceCommand,
+		UPGRADE:      ParseUpgradeCommand,
 		PART:         ParsePartCommand,
 		PASS:         ParsePassCommand,
 		PING:         ParsePingCommand,
 		PONG:         ParsePongCommand,
 		PRIVMSG:      ParsePrivMsgCommand,
 		QUIT:         ParseQuitCommand,
+		STARTTLS:     ParseStartTLSCommand,
+		STATS:        ParseStatsCommand,
 		TIME:         ParseTimeCommand,
 		LUSERS:       ParseLUsersCommand,
 		TOPIC:        ParseTopicCommand,
 		USER:         ParseUserCommand,
 		VERSION:      ParseVersionCommand,
+		VHOST:        ParseVhostCommand,
 		WALLOPS:      ParseWallopsCommand,
 		WHO:          ParseWhoCommand,
 		WHOIS:        ParseWhoisCommand,
@@ -62,8 +74,9 @@ var (
 )
 
 type BaseCommand struct {
-	client *Client
-	code   StringCode
+	client  *Client
+	code    StringCode
+	session *Session
 }
 
 func (command *BaseCommand) Client() *Client {
@@ -82,6 +95,15 @@ func (command *BaseCommand) SetCode(code StringCode) {
 	command.code = code
 }
 
+// Session returns the session the command was received on.
+func (command *BaseCommand) Session() *Session {
+	return command.session
+}
+
+func (command *BaseCommand) SetSession(session *Session) {
+	command.session = session
+}
+
 func ParseCommand(line string) (cmd Command, err error) {
 	code, args := ParseLine(line)
 	constructor := parseCommandFuncs[code]
@@ -113,6 +135,10 @@ func splitArg(line string) (arg string, rest string) {
 
 func ParseLine(line string) (command StringCode, args []string) {
 	args = make([]string, 0)
+	if strings.HasPrefix(line, "@") {
+		// message tags are ignored
+		_, line = splitArg(line)
+	}
 	if strings.HasPrefix(line, ":") {
 		_, line = splitArg(line)
 	}
@@ -210,7 +236,7 @@ type PassCommand struct {
 }
 
 func (cmd *PassCommand) LoadPassword(server *Server) {
-	cmd.hash = server.password
+	cmd.hash = server.serverPassword()
 }
 
 func (cmd *PassCommand) CheckPassword() {
@@ -562,12 +588,18 @@ func ParseChannelModeCommand(channel Name, args []string) (Command, error) {
 				op:   op,
 			}
 			switch change.mode {
-			case Key, BanMask, ExceptMask, InviteMask, UserLimit,
-				ChannelOperator, ChannelCreator, Voice:
+			case Key, BanMask, ExceptMask, InviteMask, QuietMask,
+				ChannelCreator, ChannelOwner, ChannelAdmin, ChannelOperator,
+				HalfOp, Voice:
 				if len(args) > skipArgs {
 					change.arg = args[skipArgs]
 					skipArgs += 1
 				}
+			case PlaybackMode, JoinThrottleMode, FloodLimitMode, Forward, UserLimit:
+				if op == Add && len(args) > skipArgs {
+					change.arg = args[skipArgs]
+					skipArgs += 1
+				}
 			}
 			cmd.changes = append(cmd.changes, change)
 		}
@@ -645,7 +677,7 @@ type OperCommand struct {
 }
 
 func (msg *OperCommand) LoadPassword(server *Server) {
-	msg.hash = server.operators[msg.name]
+	msg.hash = server.operatorPassword(msg.name)
 }
 
 // OPER <name> <password>
@@ -670,10 +702,120 @@ func ParseRehashCommand(args []string) (Command, error) {
 	return &RehashCommand{}, nil
 }
 
+type UpgradeCommand struct {
+	BaseCommand
+}
+
+// UPGRADE
+func ParseUpgradeCommand(args []string) (Command, error) {
+	return &UpgradeCommand{}, nil
+}
+
+type ChatHistoryCommand struct {
+	BaseCommand
+	subCommand string
+	args       []string
+}
+
+// CHATHISTORY <subcommand> <target> <reference> [<reference>] <limit>
+// CHATHISTORY TARGETS <timestamp> <timestamp> <limit>
+func ParseChatHistoryCommand(args []string) (Command, error) {
+	if len(args) < 1 {
+		return nil, NotEnoughArgsError
+	}
+	return &ChatHistoryCommand{
+		subCommand: strings.ToUpper(args[0]),
+		args:       args[1:],
+	}, nil
+}
+
+type MonitorCommand struct {
+	BaseCommand
+	subCommand string
+	targets    []Name
+}
+
+// MONITOR <+|-> <target>{,<target>}
+// MONITOR <C|L|S>
+func ParseMonitorCommand(args []string) (Command, error) {
+	if len(args) < 1 {
+		return nil, NotEnoughArgsError
+	}
+	cmd := &MonitorCommand{
+		subCommand: strings.ToUpper(args[0]),
+	}
+	if len(args) > 1 {
+		for _, target := range strings.Split(args[1], ",") {
+			if target != "" {
+				cmd.targets = append(cmd.targets, NewName(target))
+			}
+		}
+	}
+	return cmd, nil
+}
+
+type AcceptCommand struct {
+	BaseCommand
+	nicks []Name
+}
+
+// ACCEPT <nick>{,<nick>}
+// ACCEPT -<nick>{,-<nick>}
+// ACCEPT *
+func ParseAcceptCommand(args []string) (Command, error) {
+	if len(args) < 1 {
+		return nil, NotEnoughArgsError
+	}
+	cmd := &AcceptCommand{}
+	for _, nick := range strings.Split(args[0], ",") {
+		if nick != "" && nick != "-" {
+			cmd.nicks = append(cmd.nicks, NewName(nick))
+		}
+	}
+	return cmd, nil
+}
+
+type SilenceCommand struct {
+	BaseCommand
+	masks []Name
+}
+
+// SILENCE [[+|-]<mask>{,[+|-]<mask>}]
+func ParseSilenceCommand(args []string) (Command, error) {
+	cmd := &SilenceCommand{}
+	if len(args) > 0 {
+		for _, mask := range strings.Split(args[0], ",") {
+			if mask != "" {
+				cmd.masks = append(cmd.masks, NewName(mask))
+			}
+		}
+	}
+	return cmd, nil
+}
+
+type MarkReadCommand struct {
+	BaseCommand
+	target    Name
+	timestamp string
+}
+
+// MARKREAD <target> [timestamp=<timestamp>]
+func ParseMarkReadCommand(args []string) (Command, error) {
+	cmd := &MarkReadCommand{}
+	if len(args) > 0 {
+		cmd.target = NewName(args[0])
+	}
+	if len(args) > 1 {
+		cmd.timestamp = args[1]
+	}
+	return cmd, nil
+}
+
 type CapCommand struct {
 	BaseCommand
 	subCommand   CapSubCommand
 	capabilities CapabilitySet
+	version      int
 }
 
 func ParseCapCommand(args []string) (Command, error) {
@@ -686,6 +828,13 @@ func ParseCapCommand(args []string) (Command, error) {
 		capabilities: make(CapabilitySet),
 	}
 
+	if cmd.subCommand == CAP_LS {
+		if len(args) > 1 {
+			cmd.version, _ = strconv.Atoi(args[1])
+		}
+		return cmd, nil
+	}
+
 	if len(args) > 1 {
 		strs := spacesExpr.Split(args[1], -1)
 		for _, str := range strs {
@@ -869,6 +1018,33 @@ func ParseTimeCommand(args []string) (Command, error) {
 	return cmd, nil
 }
 
+type StartTLSCommand struct {
+	BaseCommand
+}
+
+// STARTTLS
+func ParseStartTLSCommand(args []string) (Command, error) {
+	return &StartTLSCommand{}, nil
+}
+
+type StatsCommand struct {
+	BaseCommand
+	query  string
+	target Name
+}
+
+// STATS [ <query> [ <target> ] ]
+func ParseStatsCommand(args []string) (Command, error) {
+	cmd := &StatsCommand{}
+	if len(args) > 0 {
+		cmd.query = args[0]
+	}
+	if len(args) > 1 {
+		cmd.target = NewName(args[1])
+	}
+	return cmd, nil
+}
+
 type LUsersCommand struct {
 	BaseCommand
 }
@@ -893,6 +1069,43 @@ func ParseKillCommand(args []string) (Command, error) {
 	}, nil
 }
 
+type ChgHostCommand struct {
+	BaseCommand
+	nickname Name
+	hostname Name
+}
+
+// CHGHOST <nickname> <hostname>
+func ParseChgHostCommand(args []string) (Command, error) {
+	if len(args) < 2 {
+		return nil, NotEnoughArgsError
+	}
+	return &ChgHostCommand{
+		nickname: NewName(args[0]),
+		hostname: NewName(args[1]),
+	}, nil
+}
+
+type VhostCommand struct {
+	BaseCommand
+	subCommand string
+	args       []string
+}
+
+// VHOST REQUEST <vhost>
+// VHOST SET <account> <vhost>
+// VHOST DEL|APPROVE|REJECT <account>
+// VHOST LIST
+func ParseVhostCommand(args []string) (Command, error) {
+	if len(args) < 1 {
+		return nil, NotEnoughArgsError
+	}
+	return &VhostCommand{
+		subCommand: strings.ToUpper(args[0]),
+		args:       args[1:],
+	}, nil
+}
+
 type WallopsCommand struct {
 	BaseCommand
 	message Text
@@ -1,12 +1,20 @@
 package irc
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
-	"sync"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/imdario/mergo"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v2"
 )
 
@@ -20,15 +28,32 @@ type TLSConfig struct {
 }
 
 type I2PConfig struct {
-	I2Pkeys string
-	SAMaddr string
-	Base32  string
+	I2Pkeys  string
+	SAMaddr  string
+	Base32   string
+	Hostname string
 }
 
 type TorConfig struct {
 	Torkeys     string
 	ControlPort int
 	Onion       string
+	Hostname    string
+}
+
+const (
+	DefaultI2PHostPrefix = "i2p.users."
+	DefaultTorHostPrefix = "tor.users."
+	DefaultTLSPort       = 6697
+)
+
+// STSConfig is the IRCv3 Strict Transport Security policy advertised
+// to clients. If Port is not set it is derived from Server.TLSListen.
+type STSConfig struct {
+	Enabled  bool
+	Port     int
+	Duration time.Duration
+	Preload  bool
 }
 
 func (conf *PassConfig) PasswordBytes() []byte {
@@ -40,11 +65,12 @@ func (conf *PassConfig) PasswordBytes() []byte {
 }
 
 type Config struct {
-	sync.Mutex
 	filename string
 
 	Network struct {
-		Name string
+		Name  string
+		STS   STSConfig
+		Cloak CloakConfig
 	}
 
 	Server struct {
@@ -53,10 +79,17 @@ type Config struct {
 		TLSListen   map[string]*TLSConfig
 		I2PListen   map[string]*I2PConfig
 		TorListen   map[string]*TorConfig
-		Log         string
+		Log         LogConfigs
 		MOTD        string
 		Name        string
 		Description string
+		Limits      LimitsConfig
+		Flood       FloodConfig
+		DNS         DNSConfig
+		Vhosts      VhostConfig
+		Shutdown    ShutdownConfig
+		History     HistoryConfig
+		Bouncer     BouncerConfig
 	}
 
 	WWW struct {
@@ -67,7 +100,10 @@ type Config struct {
 	}
 	Operator    map[string]*PassConfig
 	Account     map[string]*PassConfig
+	Class       map[string]*ClassConfig
 	TemplateDir string
+	Metrics     MetricsConfig
+	Pprof       PprofConfig
 }
 
 func (conf *Config) Operators() map[Name][]byte {
@@ -86,27 +122,70 @@ func (conf *Config) Accounts() map[string][]byte {
 	return accounts
 }
 
-func (conf *Config) Name() string {
-	return conf.filename
-}
+// STSPort returns the port advertised in the STS upgrade policy,
+// or 0 if there is no TLS listener to upgrade to. Without an explicit
+// port the standard TLS port is preferred if it's listened on, and
+// otherwise the lowest TLS listener port.
+func (conf *Config) STSPort() int {
+	if conf.Network.STS.Port != 0 {
+		return conf.Network.STS.Port
+	}
 
-func (conf *Config) Reload() error {
-	conf.Lock()
-	defer conf.Unlock()
+	ports := make([]int, 0, len(conf.Server.TLSListen))
+	for addr := range conf.Server.TLSListen {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			continue
+		}
+		if n == DefaultTLSPort {
+			return n
+		}
+		ports = append(ports, n)
+	}
+	if len(ports) == 0 {
+		return 0
+	}
+	sort.Ints(ports)
+	return ports[0]
+}
 
-	newconf, err := LoadConfig(conf.filename)
-	if err != nil {
-		return nil
+// ListenerHostname returns the virtual hostname given to clients of an
+// I2P or Tor listener, and false for any other listener.
+func (conf *Config) ListenerHostname(listener string) (Name, bool) {
+	if i2pconfig, ok := conf.Server.I2PListen[listener]; ok {
+		if i2pconfig == nil || i2pconfig.Hostname == "" {
+			return conf.defaultListenerHostname(DefaultI2PHostPrefix), true
+		}
+		return NewName(i2pconfig.Hostname), true
+	}
+	if torconfig, ok := conf.Server.TorListen[listener]; ok {
+		if torconfig == nil || torconfig.Hostname == "" {
+			return conf.defaultListenerHostname(DefaultTorHostPrefix), true
+		}
+		return NewName(torconfig.Hostname), true
 	}
+	return "", false
+}
 
-	err = mergo.MergeWithOverwrite(conf, newconf)
-	if err != nil {
-		return nil
+// defaultListenerHostname returns prefix followed by the network name,
+// or by the server name if the network name can't be used in a hostname.
+func (conf *Config) defaultListenerHostname(prefix string) Name {
+	if hostname := prefix + strings.ToLower(conf.Network.Name); IsHostname(hostname) {
+		return NewName(hostname)
 	}
+	return NewName(prefix + conf.Server.Name)
+}
 
-	return nil
+func (conf *Config) Name() string {
+	return conf.filename
 }
 
+// LoadConfig reads and validates the config in filename. If the config
+// is invalid the error is a ConfigErrors listing every problem found.
 func LoadConfig(filename string) (config *Config, err error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -117,26 +196,264 @@ func LoadConfig(filename string) (config *Config, err error) {
 	if err != nil {
 		return nil, err
 	}
+	if config == nil {
+		return nil, errors.New("config is empty")
+	}
 
 	config.filename = filename
 
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// ConfigErrors is the list of problems found validating a config.
+type ConfigErrors []error
+
+func (errs ConfigErrors) Error() string {
+	strs := make([]string, len(errs))
+	for i, err := range errs {
+		strs[i] = err.Error()
+	}
+	return strings.Join(strs, "; ")
+}
+
+// Validate checks the whole config and returns a ConfigErrors with
+// every problem found, or nil if the config is valid.
+func (config *Config) Validate() error {
+	var errs ConfigErrors
+	errorf := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
 	if config.Network.Name == "" {
-		return nil, errors.New("Network name missing")
+		errorf("Network name missing")
+	}
+	if len(config.Network.Cloak.KeyBytes()) == 0 {
+		errorf("network.cloak: at least one key is required")
 	}
 
 	if config.Server.Name == "" {
-		return nil, errors.New("Server name missing")
+		errorf("Server name missing")
+	} else if !IsHostname(config.Server.Name) {
+		errorf("Server name must match the format of a hostname")
 	}
 
-	if !IsHostname(config.Server.Name) {
-		return nil, errors.New("Server name must match the format of a hostname")
+	if len(config.Server.Listen)+len(config.Server.TLSListen)+len(config.Server.I2PListen)+len(config.Server.TorListen) == 0 {
+		errorf("Server listening addresses missing")
 	}
 
-	if len(config.Server.Listen)+len(config.Server.TLSListen)+len(config.Server.I2PListen)+len(config.Server.TorListen) == 0 {
-		return nil, errors.New("Server listening addresses missing")
+	validateAddr := func(section, addr string) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			errorf("%s: invalid address %q: %s", section, addr, err)
+			return
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			errorf("%s: invalid port in address %q", section, addr)
+		}
+	}
+	validateListen := func(section, addr string) {
+		if !strings.HasPrefix(addr, "unix:") {
+			validateAddr(section, addr)
+		}
+	}
+	validateTLS := func(section, addr string, tlsconfig *TLSConfig) {
+		validateListen(section, addr)
+		if tlsconfig == nil || tlsconfig.Cert == "" || tlsconfig.Key == "" {
+			errorf("%s: %s: cert and key are required", section, addr)
+			return
+		}
+		if _, err := tls.LoadX509KeyPair(tlsconfig.Cert, tlsconfig.Key); err != nil {
+			errorf("%s: %s: %s", section, addr, err)
+		}
+	}
+	validateHostname := func(section, addr, hostname string) {
+		if hostname != "" && !IsHostname(hostname) {
+			errorf("%s: %s: hostname must match the format of a hostname", section, addr)
+		}
+	}
+	validateI2P := func(section, addr string, i2pconfig *I2PConfig) {
+		if i2pconfig == nil || i2pconfig.I2Pkeys == "" {
+			errorf("%s: %s: i2pkeys is required", section, addr)
+		}
+		if i2pconfig != nil {
+			validateHostname(section, addr, i2pconfig.Hostname)
+		}
+		if i2pconfig != nil && i2pconfig.SAMaddr != "" {
+			validateAddr(section+": "+addr+": samaddr", i2pconfig.SAMaddr)
+		}
+	}
+	validateTor := func(section, addr string, torconfig *TorConfig) {
+		if torconfig == nil || torconfig.Torkeys == "" {
+			errorf("%s: %s: torkeys is required", section, addr)
+		}
+		if torconfig != nil {
+			validateHostname(section, addr, torconfig.Hostname)
+		}
+	}
+	validatePassword := func(section, password string, required bool) {
+		if password == "" {
+			if required {
+				errorf("%s: password missing", section)
+			}
+			return
+		}
+		decoded, err := DecodePassword(password)
+		if err != nil {
+			errorf("%s: password must be base64 encoded: %s", section, err)
+			return
+		}
+		if _, err := bcrypt.Cost(decoded); err != nil {
+			errorf("%s: password is not a bcrypt hash: %s", section, err)
+		}
+	}
+	validateNets := func(section string, nets []string) {
+		for _, str := range nets {
+			if _, err := ParseNet(str); err != nil {
+				errorf("%s: %s", section, err)
+			}
+		}
 	}
 
-	return config, nil
+	for _, addr := range config.Server.Listen {
+		validateListen("server.listen", addr)
+	}
+	for addr, tlsconfig := range config.Server.TLSListen {
+		validateTLS("server.tlslisten", addr, tlsconfig)
+	}
+	for addr, i2pconfig := range config.Server.I2PListen {
+		validateI2P("server.i2plisten", addr, i2pconfig)
+	}
+	for addr, torconfig := range config.Server.TorListen {
+		validateTor("server.torlisten", addr, torconfig)
+	}
+
+	for _, addr := range config.WWW.Listen {
+		validateListen("www.listen", addr)
+	}
+	for addr, tlsconfig := range config.WWW.TLSListen {
+		validateTLS("www.tlslisten", addr, tlsconfig)
+	}
+	for addr, i2pconfig := range config.WWW.I2PListen {
+		validateI2P("www.i2plisten", addr, i2pconfig)
+	}
+	for addr, torconfig := range config.WWW.TorListen {
+		validateTor("www.torlisten", addr, torconfig)
+	}
+
+	validatePassword("server", config.Server.Password, false)
+
+	for name, opConf := range config.Operator {
+		section := fmt.Sprintf("operator %s", name)
+		if !NewName(name).IsNickname() {
+			errorf("%s: name must be a valid nickname", section)
+		}
+		if opConf == nil {
+			errorf("%s: password missing", section)
+			continue
+		}
+		validatePassword(section, opConf.Password, true)
+	}
+
+	for name, account := range config.Account {
+		section := fmt.Sprintf("account %s", name)
+		if account == nil {
+			errorf("%s: password missing", section)
+			continue
+		}
+		validatePassword(section, account.Password, true)
+	}
+
+	if !config.Metrics.Disabled {
+		validateListen("metrics.listen", config.Metrics.ListenAddr())
+		if config.Metrics.Username != "" {
+			validatePassword("metrics", config.Metrics.Password, true)
+		}
+	}
+	if config.Pprof.Enabled {
+		validateListen("pprof.listen", config.Pprof.ListenAddr())
+	}
+
+	for i, logConfig := range config.Server.Log {
+		if _, err := logConfig.level(); err != nil {
+			errorf("server.log[%d]: %s", i, err)
+		}
+		if _, err := logConfig.formatter(); err != nil {
+			errorf("server.log[%d]: %s", i, err)
+		}
+		if logConfig.File != "" {
+			dir := filepath.Dir(logConfig.File)
+			if info, err := os.Stat(dir); err != nil {
+				errorf("server.log[%d]: %s", i, err)
+			} else if !info.IsDir() {
+				errorf("server.log[%d]: %s is not a directory", i, dir)
+			}
+		}
+	}
+
+	if config.Server.Shutdown.Timeout < 0 {
+		errorf("server.shutdown: timeout must not be negative")
+	}
+
+	if config.Server.Bouncer.Replay < 0 {
+		errorf("server.bouncer: replay must not be negative")
+	}
+
+	validateHistory := func(section string, limits HistoryLimits) {
+		if limits.Length < 0 {
+			errorf("%s: length must not be negative", section)
+		}
+		if limits.Limit < 0 {
+			errorf("%s: limit must not be negative", section)
+		}
+	}
+	validateHistory("server.history", HistoryLimits{
+		Length: config.Server.History.Length,
+		Limit:  config.Server.History.Limit,
+	})
+	if config.Server.History.Playback != "" {
+		if _, err := ParsePlayback(config.Server.History.Playback); err != nil {
+			errorf("server.history: %s", err)
+		}
+	}
+	for name, limits := range config.Server.History.Channels {
+		section := fmt.Sprintf("server.history.channels: %s", name)
+		if !NewName(name).IsChannel() {
+			errorf("%s: not a channel name", section)
+		}
+		validateHistory(section, limits)
+	}
+
+	validateNets("server.limits.exempt", config.Server.Limits.Exempt)
+	for name, class := range config.Class {
+		if class != nil {
+			validateNets(fmt.Sprintf("class %s: hosts", name), class.Hosts)
+		}
+	}
+
+	if config.TemplateDir != "" {
+		files, err := ioutil.ReadDir(config.TemplateDir)
+		if err != nil {
+			errorf("templatedir: %s", err)
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			path := filepath.Join(config.TemplateDir, f.Name())
+			if _, err := ioutil.ReadFile(path); err != nil {
+				errorf("templatedir: %s", err)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
 func (config *Config) WWWAddrs() string {
@@ -0,0 +1,89 @@
+package irc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigSTSPort(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &Config{}
+	assert.Equal(0, config.STSPort())
+
+	config.Server.TLSListen = map[string]*TLSConfig{
+		":7000": {},
+		":6697": {},
+	}
+	assert.Equal(6697, config.STSPort())
+
+	config.Server.TLSListen = map[string]*TLSConfig{
+		":10000":         {},
+		"127.0.0.1:7000": {},
+	}
+	assert.Equal(7000, config.STSPort())
+
+	config.Network.STS.Port = 7000
+	assert.Equal(7000, config.STSPort())
+}
+
+func TestConfigListenerHostname(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &Config{}
+	config.Network.Name = "Test"
+	config.Server.Name = "irc.test"
+	config.Server.I2PListen = map[string]*I2PConfig{
+		"iirc": {},
+	}
+	config.Server.TorListen = map[string]*TorConfig{
+		"tirc": {Hostname: "tor.users.test"},
+	}
+
+	hostname, ok := config.ListenerHostname("iirc")
+	assert.True(ok)
+	assert.Equal(Name("i2p.users.test"), hostname)
+
+	config.Network.Name = "Test Network"
+	hostname, _ = config.ListenerHostname("iirc")
+	assert.Equal(Name("i2p.users.irc.test"), hostname)
+	assert.True(IsHostname(hostname.String()))
+
+	hostname, ok = config.ListenerHostname("tirc")
+	assert.True(ok)
+	assert.Equal(Name("tor.users.test"), hostname)
+
+	_, ok = config.ListenerHostname(":6667")
+	assert.False(ok)
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &Config{}
+	config.Network.Name = "Test"
+	config.Server.Name = "test.local"
+	config.Server.Listen = []string{":6667"}
+	config.Network.Cloak.Keys = []string{"secret"}
+	config.Account = map[string]*PassConfig{
+		"admin": {"JDJhJDA0JGtUU1JVc1JOUy9DbEh1WEdvYVlMdGVnclp6YnA3NDBOZGY1WUZhdTZtRzVmb1VKdXQ5ckZD"},
+	}
+	assert.NoError(config.Validate())
+
+	config.Server.Name = "test"
+	config.Server.Listen = []string{"6667"}
+	config.Server.TLSListen = map[string]*TLSConfig{
+		":6697": {Cert: "missing.pem", Key: "missing.key"},
+	}
+	config.Operator = map[string]*PassConfig{
+		"admin": {"password"},
+	}
+	config.Network.Cloak.Keys = []string{""}
+	config.Server.TorListen = map[string]*TorConfig{
+		"tirc": {Torkeys: "tirc", Hostname: "tor"},
+	}
+	err := config.Validate()
+	assert.IsType(ConfigErrors{}, err)
+	assert.Len(err, 6)
+}
@@ -5,17 +5,24 @@ const (
 	MAX_REPLY_LEN = 512 - len(CRLF)
 
 	// string codes
+	ACCEPT       StringCode = "ACCEPT"
 	AUTHENTICATE StringCode = "AUTHENTICATE" // SASL
 	AWAY         StringCode = "AWAY"
+	BATCH        StringCode = "BATCH"
 	CAP          StringCode = "CAP"
+	CHATHISTORY  StringCode = "CHATHISTORY"
+	CHGHOST      StringCode = "CHGHOST"
 	ERROR        StringCode = "ERROR"
+	FAIL         StringCode = "FAIL"
 	INVITE       StringCode = "INVITE"
 	ISON         StringCode = "ISON"
 	JOIN         StringCode = "JOIN"
 	KICK         StringCode = "KICK"
 	KILL         StringCode = "KILL"
 	LIST         StringCode = "LIST"
+	MARKREAD     StringCode = "MARKREAD"
 	MODE         StringCode = "MODE"
+	MONITOR      StringCode = "MONITOR"
 	MOTD         StringCode = "MOTD"
 	NAMES        StringCode = "NAMES"
 	NICK         StringCode = "NICK"
@@ -23,17 +30,22 @@ const (
 	ONICK        StringCode = "ONICK"
 	OPER         StringCode = "OPER"
 	REHASH       StringCode = "REHASH"
+	SILENCE      StringCode = "SILENCE"
 	PART         StringCode = "PART"
 	PASS         StringCode = "PASS"
 	PING         StringCode = "PING"
 	PONG         StringCode = "PONG"
 	PRIVMSG      StringCode = "PRIVMSG"
 	QUIT         StringCode = "QUIT"
+	STATS        StringCode = "STATS"
+	STARTTLS     StringCode = "STARTTLS"
 	TIME         StringCode = "TIME"
 	LUSERS       StringCode = "LUSERS"
 	TOPIC        StringCode = "TOPIC"
+	UPGRADE      StringCode = "UPGRADE"
 	USER         StringCode = "USER"
 	VERSION      StringCode = "VERSION"
+	VHOST        StringCode = "VHOST"
 	WALLOPS      StringCode = "WALLOPS"
 	WHO          StringCode = "WHO"
 	WHOIS        StringCode = "WHOIS"
@@ -44,7 +56,8 @@ const (
 	RPL_YOURHOST          NumericCode = 2
 	RPL_CREATED           NumericCode = 3
 	RPL_MYINFO            NumericCode = 4
-	RPL_BOUNCE            NumericCode = 5
+	RPL_BOUNCE            NumericCode = 5 // RFC 2812, superseded by RPL_ISUPPORT
+	RPL_ISUPPORT          NumericCode = 5
 	RPL_TRACELINK         NumericCode = 200
 	RPL_TRACECONNECTING   NumericCode = 201
 	RPL_TRACEHANDSHAKE    NumericCode = 202
@@ -58,6 +71,7 @@ const (
 	RPL_TRACERECONNECT    NumericCode = 210
 	RPL_STATSLINKINFO     NumericCode = 211
 	RPL_STATSCOMMANDS     NumericCode = 212
+	RPL_STATSYLINE        NumericCode = 218
 	RPL_ENDOFSTATS        NumericCode = 219
 	RPL_UMODEIS           NumericCode = 221
 	RPL_SERVLIST          NumericCode = 234
@@ -89,6 +103,7 @@ const (
 	RPL_WHOISIDLE         NumericCode = 317
 	RPL_ENDOFWHOIS        NumericCode = 318
 	RPL_WHOISCHANNELS     NumericCode = 319
+	RPL_WHOISSPECIAL      NumericCode = 320
 	RPL_LIST              NumericCode = 322
 	RPL_LISTEND           NumericCode = 323
 	RPL_CHANNELMODEIS     NumericCode = 324
@@ -124,6 +139,7 @@ const (
 	RPL_USERS             NumericCode = 393
 	RPL_ENDOFUSERS        NumericCode = 394
 	RPL_NOUSERS           NumericCode = 395
+	RPL_HOSTHIDDEN        NumericCode = 396
 	ERR_NOSUCHNICK        NumericCode = 401
 	ERR_NOSUCHSERVER      NumericCode = 402
 	ERR_NOSUCHCHANNEL     NumericCode = 403
@@ -162,6 +178,7 @@ const (
 	ERR_YOUREBANNEDCREEP  NumericCode = 465
 	ERR_YOUWILLBEBANNED   NumericCode = 466
 	ERR_KEYSET            NumericCode = 467
+	ERR_LINKCHANNEL       NumericCode = 470
 	ERR_CHANNELISFULL     NumericCode = 471
 	ERR_UNKNOWNMODE       NumericCode = 472
 	ERR_INVITEONLYCHAN    NumericCode = 473
@@ -170,6 +187,7 @@ const (
 	ERR_BADCHANMASK       NumericCode = 476
 	ERR_NOCHANMODES       NumericCode = 477
 	ERR_BANLISTFULL       NumericCode = 478
+	ERR_THROTTLE          NumericCode = 480
 	ERR_NOPRIVILEGES      NumericCode = 481
 	ERR_CHANOPRIVSNEEDED  NumericCode = 482
 	ERR_CANTKILLSERVER    NumericCode = 483
@@ -179,7 +197,33 @@ const (
 	ERR_CANNOTSENDTOUSER  NumericCode = 492
 	ERR_UMODEUNKNOWNFLAG  NumericCode = 501
 	ERR_USERSDONTMATCH    NumericCode = 502
+	RPL_STARTTLS          NumericCode = 670
 	RPL_WHOISSECURE       NumericCode = 671
+	ERR_STARTTLS          NumericCode = 691
+	ERR_INVALIDMODEPARAM  NumericCode = 696
+	RPL_QUIETLIST         NumericCode = 728
+	RPL_ENDOFQUIETLIST    NumericCode = 729
+
+	// SILENCE and caller ID
+	RPL_SILELIST      NumericCode = 271
+	RPL_ENDOFSILELIST NumericCode = 272
+	RPL_ACCEPTLIST    NumericCode = 281
+	RPL_ENDOFACCEPT   NumericCode = 282
+	ERR_ACCEPTFULL    NumericCode = 456
+	ERR_ACCEPTEXIST   NumericCode = 457
+	ERR_ACCEPTNOT     NumericCode = 458
+	ERR_NONONREG      NumericCode = 486
+	ERR_SILELISTFULL  NumericCode = 511
+	ERR_TARGUMODEG    NumericCode = 716
+	RPL_TARGNOTIFY    NumericCode = 717
+	RPL_UMODEGMSG     NumericCode = 718
+
+	// MONITOR
+	RPL_MONONLINE    NumericCode = 730
+	RPL_MONOFFLINE   NumericCode = 731
+	RPL_MONLIST      NumericCode = 732
+	RPL_ENDOFMONLIST NumericCode = 733
+	ERR_MONLISTFULL  NumericCode = 734
 
 	// SASL
 	RPL_LOGGEDIN    NumericCode = 900
@@ -0,0 +1,138 @@
+package irc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDNSTimeout  = 5 * time.Second
+	DefaultDNSCacheTTL = time.Hour
+	MaxDNSCacheEntries = 10000
+)
+
+// DNSConfig controls reverse DNS lookups of connecting clients.
+// NoResolve lists listeners whose clients are never looked up; I2P and
+// Tor listeners are never looked up regardless.
+type DNSConfig struct {
+	Disabled  bool
+	Timeout   time.Duration
+	CacheTTL  time.Duration
+	NoResolve []string
+}
+
+type dnsEntry struct {
+	hostname Name
+	found    bool
+	expires  time.Time
+}
+
+// Resolver performs bounded, forward-confirmed reverse DNS lookups and
+// caches the results.
+type Resolver struct {
+	sync.Mutex
+	config DNSConfig
+	cache  map[string]*dnsEntry
+	lookup func(context.Context, Name) (Name, bool)
+}
+
+func NewResolver(config DNSConfig) *Resolver {
+	r := &Resolver{
+		cache:  make(map[string]*dnsEntry),
+		lookup: LookupHostnameContext,
+	}
+	r.SetConfig(config)
+	return r
+}
+
+// SetConfig replaces the resolver's configuration and empties its cache.
+func (r *Resolver) SetConfig(config DNSConfig) {
+	r.Lock()
+	defer r.Unlock()
+
+	if config.Timeout == 0 {
+		config.Timeout = DefaultDNSTimeout
+	}
+	if config.CacheTTL == 0 {
+		config.CacheTTL = DefaultDNSCacheTTL
+	}
+	r.config = config
+	r.cache = make(map[string]*dnsEntry)
+}
+
+// Enabled returns true if clients arriving on listener should be looked up.
+func (r *Resolver) Enabled(listener string) bool {
+	r.Lock()
+	defer r.Unlock()
+	return !r.config.Disabled && !containsFold(r.config.NoResolve, listener)
+}
+
+// Lookup returns the verified hostname of ip, or false if it has none
+// or the lookup didn't complete in time.
+func (r *Resolver) Lookup(ip Name) (Name, bool) {
+	r.Lock()
+	entry, ok := r.cache[ip.String()]
+	timeout := r.config.Timeout
+	r.Unlock()
+
+	now := time.Now()
+	if ok && now.Before(entry.expires) {
+		return entry.hostname, entry.found
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	hostname, found := r.lookup(ctx, ip)
+
+	r.Lock()
+	defer r.Unlock()
+	if len(r.cache) >= MaxDNSCacheEntries {
+		for key, entry := range r.cache {
+			if now.After(entry.expires) {
+				delete(r.cache, key)
+			}
+		}
+	}
+	if len(r.cache) < MaxDNSCacheEntries {
+		r.cache[ip.String()] = &dnsEntry{
+			hostname: hostname,
+			found:    found,
+			expires:  now.Add(r.config.CacheTTL),
+		}
+	}
+	return hostname, found
+}
+
+// LookupHostnameContext looks up the PTR records of ip and returns the
+// first name that resolves back to ip. If there is none ip is returned.
+func LookupHostnameContext(ctx context.Context, ip Name) (Name, bool) {
+	addr := net.ParseIP(ip.String())
+	if addr == nil {
+		return ip, false
+	}
+
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return ip, false
+	}
+
+	for _, name := range names {
+		hostname := strings.TrimSuffix(name, ".")
+		if !IsHostname(hostname) && hostname != "localhost" {
+			continue
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, hostname)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if a.IP.Equal(addr) {
+				return Name(hostname), true
+			}
+		}
+	}
+	return ip, false
+}
@@ -0,0 +1,52 @@
+package irc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupHostnameContext(t *testing.T) {
+	assert := assert.New(t)
+
+	hostname, found := LookupHostnameContext(context.Background(), "example.b32.i2p")
+	assert.False(found)
+	assert.Equal(Name("example.b32.i2p"), hostname)
+}
+
+func TestResolver(t *testing.T) {
+	assert := assert.New(t)
+
+	r := NewResolver(DNSConfig{NoResolve: []string{":6668"}})
+	assert.True(r.Enabled(":6667"))
+	assert.False(r.Enabled(":6668"))
+
+	lookups := 0
+	r.lookup = func(ctx context.Context, ip Name) (Name, bool) {
+		lookups++
+		_, ok := ctx.Deadline()
+		assert.True(ok)
+		if ip == "10.0.0.1" {
+			return "host.example.com", true
+		}
+		return ip, false
+	}
+
+	hostname, found := r.Lookup("10.0.0.1")
+	assert.True(found)
+	assert.Equal(Name("host.example.com"), hostname)
+	hostname, found = r.Lookup("10.0.0.1")
+	assert.True(found)
+	assert.Equal(Name("host.example.com"), hostname)
+	assert.Equal(1, lookups)
+
+	hostname, found = r.Lookup("10.0.0.2")
+	assert.False(found)
+	assert.Equal(Name("10.0.0.2"), hostname)
+	assert.Len(r.cache, 2)
+
+	r.SetConfig(DNSConfig{Disabled: true})
+	assert.False(r.Enabled(":6667"))
+	assert.Len(r.cache, 0)
+}
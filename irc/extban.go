@@ -0,0 +1,104 @@
+package irc
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	ExtBanPrefix = '$'
+	ExtBanNegate = '~'
+	ExtBanTypes  = "arzjx"
+)
+
+var (
+	ErrExtBanType     = errors.New("unknown extban type")
+	ErrExtBanArgument = errors.New("invalid extban argument")
+)
+
+// ExtBan is a mask matching a property of a client other than its
+// userhost, written $<type>[:<argument>] or $~<type>[:<argument>] to
+// match clients without the property:
+//
+//	$a[:<account>]     logged in (to an account matching the glob)
+//	$r:<realname>      realname matching the glob
+//	$z                 not connected with TLS
+//	$j:<channel>       banned from another channel
+//	$x:<fingerprint>   TLS client certificate fingerprint
+type ExtBan struct {
+	Type   rune
+	Negate bool
+	Arg    string
+	expr   *regexp.Regexp
+}
+
+// IsExtBan returns true if mask is written as an extban.
+func IsExtBan(mask Name) bool {
+	return len(mask) > 1 && mask[0] == ExtBanPrefix
+}
+
+func ParseExtBan(mask Name) (*ExtBan, error) {
+	str := strings.TrimPrefix(mask.String(), string(ExtBanPrefix))
+	ban := &ExtBan{}
+	if strings.HasPrefix(str, string(ExtBanNegate)) {
+		ban.Negate = true
+		str = str[1:]
+	}
+	if str == "" || !strings.ContainsRune(ExtBanTypes, rune(str[0])) {
+		return nil, ErrExtBanType
+	}
+	ban.Type = rune(str[0])
+	if len(str) > 1 {
+		if str[1] != ':' {
+			return nil, ErrExtBanType
+		}
+		ban.Arg = str[2:]
+	}
+
+	switch ban.Type {
+	case 'a', 'r':
+		if ban.Arg != "" {
+			ban.expr = regexp.MustCompile("(?i)^" + globExpr(ban.Arg) + "$")
+		} else if ban.Type == 'r' {
+			return nil, ErrExtBanArgument
+		}
+	case 'z':
+		if ban.Arg != "" {
+			return nil, ErrExtBanArgument
+		}
+	case 'j':
+		if !NewName(ban.Arg).IsChannel() {
+			return nil, ErrExtBanArgument
+		}
+	case 'x':
+		if ban.Arg == "" {
+			return nil, ErrExtBanArgument
+		}
+	}
+	return ban, nil
+}
+
+// Match returns true if client matches the extban. Channels matched by
+// $j are not followed any further when nested.
+func (ban *ExtBan) Match(client *Client, nested bool) bool {
+	var match bool
+	switch ban.Type {
+	case 'a':
+		account := client.sasl.Id()
+		match = account != "" && (ban.expr == nil || ban.expr.MatchString(account))
+	case 'r':
+		match = ban.expr.MatchString(client.realname.String())
+	case 'z':
+		match = !client.modes.Has(SecureConn)
+	case 'j':
+		if nested {
+			return false
+		}
+		channel := client.server.channels.Get(NewName(ban.Arg))
+		match = channel != nil && channel.isBanned(client, true)
+	case 'x':
+		match = strings.EqualFold(client.CertFP(), ban.Arg)
+	}
+	return match != ban.Negate
+}
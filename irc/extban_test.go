@@ -0,0 +1,67 @@
+package irc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExtBan(t *testing.T) {
+	assert := assert.New(t)
+
+	ban, err := ParseExtBan("$~a:Bob*")
+	assert.NoError(err)
+	assert.Equal('a', ban.Type)
+	assert.True(ban.Negate)
+	assert.Equal("Bob*", ban.Arg)
+
+	for _, mask := range []Name{"$a", "$z", "$r:*bot*", "$j:#other", "$x:abcdef"} {
+		_, err := ParseExtBan(mask)
+		assert.NoError(err, mask)
+	}
+	for _, mask := range []Name{"$", "$q:x", "$aX", "$r", "$z:x", "$j:other", "$x"} {
+		_, err := ParseExtBan(mask)
+		assert.Error(err, mask)
+	}
+}
+
+func TestExtBanMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	client := &Client{
+		modes:    NewUserModeSet(),
+		realname: "Spam Bot",
+		sasl:     NewSaslState(),
+	}
+
+	match := func(mask Name) bool {
+		ban, err := ParseExtBan(mask)
+		assert.NoError(err, mask)
+		return ban.Match(client, false)
+	}
+
+	assert.False(match("$a"))
+	assert.True(match("$~a"))
+	assert.True(match("$r:*bot"))
+	assert.False(match("$r:human*"))
+	assert.True(match("$z"))
+
+	client.sasl.Login("bob")
+	client.modes.Set(SecureConn)
+	assert.True(match("$a"))
+	assert.True(match("$a:BOB"))
+	assert.False(match("$a:alice"))
+	assert.False(match("$z"))
+	assert.True(match("$~z"))
+}
+
+func TestUserMaskSet(t *testing.T) {
+	assert := assert.New(t)
+
+	set := NewUserMaskSet()
+	set.AddAll([]Name{"alice!*@*", "bob!*@*", "$a:carol", "$bad"})
+	assert.True(set.Match("alice!a@host"))
+	assert.True(set.Match("bob!b@host"))
+	assert.False(set.Match("dave!d@host"))
+	assert.Len(set.extbans, 1)
+}
@@ -0,0 +1,200 @@
+package irc
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSendQ        = 128 * 1024
+	DefaultRecvQ        = 64
+	DefaultFloodPenalty = time.Second
+	DefaultFloodBurst   = 10 * time.Second
+
+	FLUSH_TIMEOUT = 5 * time.Second // how long to flush a quitting client
+)
+
+var (
+	ErrSendQExceeded = errors.New("SendQ exceeded")
+)
+
+// FloodConfig sets the flood protection limits for a client. SendQ is
+// the maximum number of bytes queued for a client before it is
+// disconnected. RecvQ is the maximum number of lines a client may have
+// waiting to be processed before it is disconnected for excess flood.
+// Each command adds Penalty to the client's fakelag, and commands are
+// delayed once the fakelag exceeds Burst.
+type FloodConfig struct {
+	SendQ   int
+	RecvQ   int
+	Penalty time.Duration
+	Burst   time.Duration
+}
+
+// Merge returns a copy of config with unset values taken from def.
+func (config FloodConfig) Merge(def FloodConfig) FloodConfig {
+	if config.SendQ == 0 {
+		config.SendQ = def.SendQ
+	}
+	if config.RecvQ == 0 {
+		config.RecvQ = def.RecvQ
+	}
+	if config.Penalty == 0 {
+		config.Penalty = def.Penalty
+	}
+	if config.Burst == 0 {
+		config.Burst = def.Burst
+	}
+	return config
+}
+
+// WithDefaults returns a copy of config with unset values defaulted.
+func (config FloodConfig) WithDefaults() FloodConfig {
+	if config.SendQ == 0 {
+		config.SendQ = DefaultSendQ
+	}
+	if config.RecvQ == 0 {
+		config.RecvQ = DefaultRecvQ
+	}
+	if config.Penalty == 0 {
+		config.Penalty = DefaultFloodPenalty
+	}
+	if config.Burst == 0 {
+		config.Burst = DefaultFloodBurst
+	}
+	return config
+}
+
+// FakeLag tracks how far ahead of real time a client's commands are.
+type FakeLag struct {
+	sync.Mutex
+	penalty time.Duration
+	burst   time.Duration
+	until   time.Time
+}
+
+func NewFakeLag(penalty, burst time.Duration) *FakeLag {
+	return &FakeLag{penalty: penalty, burst: burst}
+}
+
+// SetLimits changes the penalty and burst, keeping the current lag.
+func (fl *FakeLag) SetLimits(penalty, burst time.Duration) {
+	fl.Lock()
+	defer fl.Unlock()
+	fl.penalty = penalty
+	fl.burst = burst
+}
+
+// Touch adds a penalty and returns how long the command should be
+// delayed before it is processed.
+func (fl *FakeLag) Touch(now time.Time) time.Duration {
+	fl.Lock()
+	defer fl.Unlock()
+
+	if fl.until.Before(now) {
+		fl.until = now
+	}
+	fl.until = fl.until.Add(fl.penalty)
+
+	ahead := fl.until.Sub(now)
+	if ahead <= fl.burst {
+		return 0
+	}
+	return ahead - fl.burst
+}
+
+// SendQueue is a bounded queue of lines waiting to be written to a client.
+type SendQueue struct {
+	sync.Mutex
+	lines    []string
+	size     int
+	max      int
+	closed   bool
+	exceeded bool
+	ready    chan bool
+}
+
+func NewSendQueue(max int) *SendQueue {
+	return &SendQueue{
+		max:   max,
+		ready: make(chan bool, 1),
+	}
+}
+
+func (q *SendQueue) signal() {
+	select {
+	case q.ready <- true:
+	default:
+	}
+}
+
+// Push queues line. If the queue would grow beyond its maximum size
+// all pending lines are discarded and ErrSendQExceeded is returned
+// once; further lines are dropped.
+func (q *SendQueue) Push(line string) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed || q.exceeded {
+		return io.EOF
+	}
+
+	if q.max > 0 && q.size+len(line) > q.max {
+		q.exceeded = true
+		q.lines = nil
+		q.size = 0
+		return ErrSendQExceeded
+	}
+
+	q.lines = append(q.lines, line)
+	q.size += len(line)
+	q.signal()
+	return nil
+}
+
+// Close closes the queue after appending any final lines, regardless
+// of the queue's size limit.
+func (q *SendQueue) Close(final ...string) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.lines = append(q.lines, final...)
+	q.signal()
+}
+
+// Ready is signalled when there are lines to write or the queue closed.
+func (q *SendQueue) Ready() <-chan bool {
+	return q.ready
+}
+
+// Drain removes and returns all pending lines and whether the queue
+// has been closed.
+func (q *SendQueue) Drain() (lines []string, closed bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	lines = q.lines
+	q.lines = nil
+	q.size = 0
+	return lines, q.closed
+}
+
+// SetMax changes the maximum size of the queue.
+func (q *SendQueue) SetMax(max int) {
+	q.Lock()
+	defer q.Unlock()
+	q.max = max
+}
+
+// Len returns the number of bytes waiting in the queue.
+func (q *SendQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.size
+}
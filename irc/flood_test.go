@@ -0,0 +1,46 @@
+package irc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeLag(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	fl := NewFakeLag(time.Second, 3*time.Second)
+	assert.Equal(time.Duration(0), fl.Touch(now))
+	assert.Equal(time.Duration(0), fl.Touch(now))
+	assert.Equal(time.Duration(0), fl.Touch(now))
+	assert.Equal(time.Second, fl.Touch(now))
+	assert.Equal(2*time.Second, fl.Touch(now))
+
+	// lag drains in real time
+	assert.Equal(time.Duration(0), fl.Touch(now.Add(time.Minute)))
+}
+
+func TestSendQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	q := NewSendQueue(10)
+	assert.Nil(q.Push("hello"))
+	assert.Nil(q.Push("world"))
+	assert.Equal(10, q.Len())
+
+	lines, closed := q.Drain()
+	assert.Equal([]string{"hello", "world"}, lines)
+	assert.False(closed)
+
+	assert.Nil(q.Push("hello"))
+	assert.Equal(ErrSendQExceeded, q.Push("world!"))
+	assert.NotNil(q.Push("more"))
+	assert.Equal(0, q.Len())
+
+	q.Close("ERROR :SendQ exceeded")
+	lines, closed = q.Drain()
+	assert.Equal([]string{"ERROR :SendQ exceeded"}, lines)
+	assert.True(closed)
+}
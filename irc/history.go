@@ -0,0 +1,686 @@
+package irc
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultHistoryLength = 1024
+	DefaultHistoryLimit  = 100
+)
+
+var (
+	ErrInvalidHistoryRef = errors.New("invalid message reference")
+)
+
+// HistoryConfig configures the history kept of channels. Length is the
+// number of events kept per channel and Limit the most a client may
+// fetch with one CHATHISTORY command; Channels overrides either for
+// individual channels. If Dir is set, history is appended to a file
+// per channel in it and survives restarts. Playback is replayed to
+// clients joining channels without a +H mode.
+type HistoryConfig struct {
+	Disabled bool
+	Length   int
+	Limit    int
+	Dir      string
+	Playback string
+	Channels map[string]HistoryLimits
+}
+
+// HistoryLimits are the history limits of a single channel.
+type HistoryLimits struct {
+	Length int
+	Limit  int
+}
+
+func (config HistoryConfig) limits(target Name) HistoryLimits {
+	limits := HistoryLimits{
+		Length: config.Length,
+		Limit:  config.Limit,
+	}
+	for name, override := range config.Channels {
+		if NewName(name).ToLower() != target.ToLower() {
+			continue
+		}
+		if override.Length != 0 {
+			limits.Length = override.Length
+		}
+		if override.Limit != 0 {
+			limits.Limit = override.Limit
+		}
+	}
+	if limits.Length == 0 {
+		limits.Length = DefaultHistoryLength
+	}
+	if limits.Limit == 0 {
+		limits.Limit = DefaultHistoryLimit
+	}
+	return limits
+}
+
+// HistoryItem is a recorded event. Line is the message as it was sent
+// to the target, without tags.
+type HistoryItem struct {
+	Time    time.Time
+	MsgID   string
+	Command StringCode
+	Line    string
+}
+
+// Tags returns the tags the event was sent with.
+func (item HistoryItem) Tags() MessageTags {
+	return MessageTags{
+		Time:  item.Time,
+		MsgID: item.MsgID,
+	}
+}
+
+// HistoryRef is a reference to a point in history given as a msgid or
+// a timestamp.
+type HistoryRef struct {
+	MsgID string
+	Time  time.Time
+}
+
+// ParseHistoryRef parses a "msgid=" or "timestamp=" reference.
+func ParseHistoryRef(str string) (ref HistoryRef, err error) {
+	switch {
+	case strings.HasPrefix(str, "msgid="):
+		ref.MsgID = strings.TrimPrefix(str, "msgid=")
+		if ref.MsgID == "" {
+			return ref, ErrInvalidHistoryRef
+		}
+	case strings.HasPrefix(str, "timestamp="):
+		ref.Time, err = ParseServerTime(strings.TrimPrefix(str, "timestamp="))
+		if err != nil {
+			return ref, ErrInvalidHistoryRef
+		}
+	default:
+		return ref, ErrInvalidHistoryRef
+	}
+	return ref, nil
+}
+
+// HistoryTarget is a target with history and the time of its latest
+// message.
+type HistoryTarget struct {
+	Name Name
+	Time time.Time
+}
+
+// HistoryBuffer is a ring buffer of the most recent events of a target.
+type HistoryBuffer struct {
+	sync.RWMutex
+	items []HistoryItem
+	start int
+	count int
+}
+
+func NewHistoryBuffer(length int) *HistoryBuffer {
+	return &HistoryBuffer{
+		items: make([]HistoryItem, length),
+	}
+}
+
+func (buffer *HistoryBuffer) Add(item HistoryItem) {
+	buffer.Lock()
+	defer buffer.Unlock()
+	buffer.add(item)
+}
+
+func (buffer *HistoryBuffer) add(item HistoryItem) {
+	if len(buffer.items) == 0 {
+		return
+	}
+	end := (buffer.start + buffer.count) % len(buffer.items)
+	buffer.items[end] = item
+	if buffer.count < len(buffer.items) {
+		buffer.count++
+	} else {
+		buffer.start = (buffer.start + 1) % len(buffer.items)
+	}
+}
+
+// Resize changes the number of events kept, dropping the oldest if
+// the buffer shrinks.
+func (buffer *HistoryBuffer) Resize(length int) {
+	buffer.Lock()
+	defer buffer.Unlock()
+	if length == len(buffer.items) {
+		return
+	}
+	items := buffer.all()
+	buffer.items = make([]HistoryItem, length)
+	buffer.start, buffer.count = 0, 0
+	for _, item := range items {
+		buffer.add(item)
+	}
+}
+
+func (buffer *HistoryBuffer) Len() int {
+	buffer.RLock()
+	defer buffer.RUnlock()
+	return buffer.count
+}
+
+// All returns every event in the buffer, oldest first.
+func (buffer *HistoryBuffer) All() HistoryItems {
+	buffer.RLock()
+	defer buffer.RUnlock()
+	return buffer.all()
+}
+
+func (buffer *HistoryBuffer) all() HistoryItems {
+	items := make(HistoryItems, buffer.count)
+	for i := range items {
+		items[i] = buffer.items[(buffer.start+i)%len(buffer.items)]
+	}
+	return items
+}
+
+// HistoryItems are events ordered oldest first.
+type HistoryItems []HistoryItem
+
+// Messages returns just the PRIVMSG and NOTICE events.
+func (items HistoryItems) Messages() HistoryItems {
+	messages := make(HistoryItems, 0, len(items))
+	for _, item := range items {
+		if item.Command == PRIVMSG || item.Command == NOTICE {
+			messages = append(messages, item)
+		}
+	}
+	return messages
+}
+
+// before returns the index of the first event not before ref.
+func (items HistoryItems) before(ref HistoryRef) (int, bool) {
+	if ref.MsgID != "" {
+		for i, item := range items {
+			if item.MsgID == ref.MsgID {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+	return sort.Search(len(items), func(i int) bool {
+		return !items[i].Time.Before(ref.Time)
+	}), true
+}
+
+// after returns the index of the first event after ref.
+func (items HistoryItems) after(ref HistoryRef) (int, bool) {
+	if ref.MsgID != "" {
+		i, ok := items.before(ref)
+		return i + 1, ok
+	}
+	return sort.Search(len(items), func(i int) bool {
+		return items[i].Time.After(ref.Time)
+	}), true
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Latest returns the limit most recent events after ref, or the limit
+// most recent events if ref is nil.
+func (items HistoryItems) Latest(ref *HistoryRef, limit int) HistoryItems {
+	start := 0
+	if ref != nil {
+		var ok bool
+		if start, ok = items.after(*ref); !ok {
+			return nil
+		}
+	}
+	return items[max(start, len(items)-limit):]
+}
+
+// Since returns the events from t on.
+func (items HistoryItems) Since(t time.Time) HistoryItems {
+	start, _ := items.before(HistoryRef{Time: t})
+	return items[start:]
+}
+
+// Before returns the limit events immediately before ref.
+func (items HistoryItems) Before(ref HistoryRef, limit int) HistoryItems {
+	end, ok := items.before(ref)
+	if !ok {
+		return nil
+	}
+	return items[max(0, end-limit):end]
+}
+
+// After returns the limit events immediately after ref.
+func (items HistoryItems) After(ref HistoryRef, limit int) HistoryItems {
+	start, ok := items.after(ref)
+	if !ok {
+		return nil
+	}
+	return items[start:min(len(items), start+limit)]
+}
+
+// Around returns limit events centred on ref.
+func (items HistoryItems) Around(ref HistoryRef, limit int) HistoryItems {
+	middle, ok := items.before(ref)
+	if !ok {
+		return nil
+	}
+	start := max(0, middle-limit/2)
+	end := min(len(items), start+limit)
+	return items[max(0, end-limit):end]
+}
+
+// Between returns up to limit events between from and to, excluding
+// both. If from is after to, the events closest to from are returned.
+func (items HistoryItems) Between(from, to HistoryRef, limit int) HistoryItems {
+	resolve := func(ref HistoryRef) (time.Time, bool) {
+		if ref.MsgID == "" {
+			return ref.Time, true
+		}
+		i, ok := items.before(ref)
+		if !ok {
+			return time.Time{}, false
+		}
+		return items[i].Time, true
+	}
+
+	fromTime, ok := resolve(from)
+	if !ok {
+		return nil
+	}
+	toTime, ok := resolve(to)
+	if !ok {
+		return nil
+	}
+
+	if fromTime.After(toTime) {
+		start, _ := items.after(to)
+		end, _ := items.before(from)
+		if start >= end {
+			return nil
+		}
+		return items[max(start, end-limit):end]
+	}
+
+	start, _ := items.after(from)
+	end, _ := items.before(to)
+	if start >= end {
+		return nil
+	}
+	return items[start:min(end, start+limit)]
+}
+
+// HistoryStore holds the history buffers of every target, by lower
+// case name, whether or not the target currently exists.
+type HistoryStore struct {
+	sync.RWMutex
+	config  HistoryConfig
+	buffers map[Name]*HistoryBuffer
+	files   map[Name]*historyFile
+}
+
+// historyFile is the file a target's history is saved to. Its lock is
+// held while writing, so that writing doesn't hold up other targets.
+type historyFile struct {
+	sync.Mutex
+	file    *os.File
+	written int
+	closed  bool
+}
+
+func NewHistoryStore(config HistoryConfig) (*HistoryStore, error) {
+	if config.Dir != "" {
+		if err := os.MkdirAll(config.Dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &HistoryStore{
+		config:  config,
+		buffers: make(map[Name]*HistoryBuffer),
+		files:   make(map[Name]*historyFile),
+	}, nil
+}
+
+// SetConfig applies a new config. Buffers are resized to their new
+// length; changing Dir only affects targets not yet loaded.
+func (store *HistoryStore) SetConfig(config HistoryConfig) {
+	store.Lock()
+	defer store.Unlock()
+	if config.Dir != "" {
+		if err := os.MkdirAll(config.Dir, 0700); err != nil {
+			log.Warnf("error creating history dir: %s", err)
+		}
+	}
+	store.config = config
+	for target, buffer := range store.buffers {
+		buffer.Resize(config.limits(target).Length)
+	}
+}
+
+func (store *HistoryStore) Enabled() bool {
+	store.RLock()
+	defer store.RUnlock()
+	return !store.config.Disabled
+}
+
+// Playback returns the default playback of channels.
+func (store *HistoryStore) Playback() Playback {
+	store.RLock()
+	defer store.RUnlock()
+	if store.config.Disabled || store.config.Playback == "" {
+		return Playback{}
+	}
+	playback, _ := ParsePlayback(store.config.Playback)
+	return playback
+}
+
+// Limit returns the most events of target a client may fetch at once.
+func (store *HistoryStore) Limit(target Name) int {
+	store.RLock()
+	defer store.RUnlock()
+	return store.config.limits(target).Limit
+}
+
+// MaxLimit returns the highest limit of any target.
+func (store *HistoryStore) MaxLimit() int {
+	store.RLock()
+	defer store.RUnlock()
+	limit := store.config.limits("").Limit
+	for name := range store.config.Channels {
+		limit = max(limit, store.config.limits(NewName(name)).Limit)
+	}
+	return limit
+}
+
+// Get returns the history of target, loading it from disk if needed,
+// or nil if it has none.
+func (store *HistoryStore) Get(target Name) *HistoryBuffer {
+	key := target.ToLower()
+
+	store.RLock()
+	if store.config.Disabled {
+		store.RUnlock()
+		return nil
+	}
+	buffer, ok := store.buffers[key]
+	dir := store.config.Dir
+	store.RUnlock()
+	if ok || dir == "" {
+		return buffer
+	}
+
+	// the history may have to be loaded from disk
+	store.Lock()
+	defer store.Unlock()
+	if store.config.Disabled {
+		return nil
+	}
+	return store.get(key, false)
+}
+
+func (store *HistoryStore) get(key Name, create bool) *HistoryBuffer {
+	if buffer, ok := store.buffers[key]; ok {
+		return buffer
+	}
+
+	buffer := NewHistoryBuffer(store.config.limits(key).Length)
+	if store.config.Dir != "" {
+		if err := store.load(key, buffer); err != nil {
+			log.Warnf("error loading history of %s: %s", key, err)
+		}
+	}
+	if buffer.Len() == 0 && !create {
+		return nil
+	}
+	store.buffers[key] = buffer
+	return buffer
+}
+
+// Add records item in the history of target. If history is saved, the
+// item is written with just the target's file locked.
+func (store *HistoryStore) Add(target Name, item HistoryItem) {
+	store.Lock()
+	if store.config.Disabled {
+		store.Unlock()
+		return
+	}
+	key := target.ToLower()
+	buffer := store.get(key, true)
+	if store.config.Dir == "" {
+		buffer.Add(item)
+		store.Unlock()
+		return
+	}
+	file, ok := store.files[key]
+	if !ok {
+		file = &historyFile{}
+		store.files[key] = file
+	}
+	path := store.path(key)
+	length := store.config.limits(key).Length
+	store.Unlock()
+
+	file.Lock()
+	if file.closed {
+		// the history was taken meanwhile, start a new one
+		file.Unlock()
+		store.Add(target, item)
+		return
+	}
+	buffer.Add(item)
+	if err := file.append(path, buffer, item, length); err != nil {
+		log.Warnf("error saving history of %s: %s", key, err)
+	}
+	file.Unlock()
+}
+
+// Targets returns the targets with history whose names start with
+// prefix.
+func (store *HistoryStore) Targets(prefix Name) []Name {
+	store.RLock()
+	defer store.RUnlock()
+	if store.config.Disabled {
+		return nil
+	}
+	prefix = prefix.ToLower()
+	seen := make(map[Name]bool)
+	for key := range store.buffers {
+		if strings.HasPrefix(key.String(), prefix.String()) {
+			seen[key] = true
+		}
+	}
+	if store.config.Dir != "" {
+		files, err := ioutil.ReadDir(store.config.Dir)
+		if err != nil {
+			log.Warnf("error listing history: %s", err)
+		}
+		for _, file := range files {
+			name := strings.TrimSuffix(file.Name(), ".jsonl")
+			key, err := url.PathUnescape(name)
+			if err != nil || name == file.Name() || !strings.HasPrefix(key, prefix.String()) {
+				continue
+			}
+			seen[Name(key)] = true
+		}
+	}
+	targets := make([]Name, 0, len(seen))
+	for key := range seen {
+		targets = append(targets, key)
+	}
+	return targets
+}
+
+// Take removes the history of target and returns its events.
+func (store *HistoryStore) Take(target Name) HistoryItems {
+	store.Lock()
+	defer store.Unlock()
+	if store.config.Disabled {
+		return nil
+	}
+	key := target.ToLower()
+	buffer := store.get(key, false)
+	if buffer == nil {
+		return nil
+	}
+	delete(store.buffers, key)
+	if file, ok := store.files[key]; ok {
+		file.close()
+		delete(store.files, key)
+	}
+	if store.config.Dir != "" {
+		if err := os.Remove(store.path(key)); err != nil && !os.IsNotExist(err) {
+			log.Warnf("error removing history of %s: %s", key, err)
+		}
+	}
+	return buffer.All()
+}
+
+// Snapshot returns every buffer's events, oldest first, if history is
+// not persisted.
+func (store *HistoryStore) Snapshot() map[Name]HistoryItems {
+	store.RLock()
+	defer store.RUnlock()
+	if store.config.Dir != "" {
+		return nil
+	}
+	snapshot := make(map[Name]HistoryItems, len(store.buffers))
+	for key, buffer := range store.buffers {
+		snapshot[key] = buffer.All()
+	}
+	return snapshot
+}
+
+// Restore adds the events of a snapshot.
+func (store *HistoryStore) Restore(snapshot map[Name]HistoryItems) {
+	for target, items := range snapshot {
+		for _, item := range items {
+			store.Add(target, item)
+		}
+	}
+}
+
+// Close closes the files history is saved to.
+func (store *HistoryStore) Close() error {
+	store.Lock()
+	defer store.Unlock()
+	var err error
+	for key, file := range store.files {
+		if e := file.close(); e != nil {
+			err = e
+		}
+		delete(store.files, key)
+	}
+	return err
+}
+
+// close closes the file, after any write in progress, for good.
+func (file *historyFile) close() error {
+	file.Lock()
+	defer file.Unlock()
+	file.closed = true
+	if file.file == nil {
+		return nil
+	}
+	return file.file.Close()
+}
+
+func (store *HistoryStore) path(key Name) string {
+	return filepath.Join(store.config.Dir, url.PathEscape(key.String())+".jsonl")
+}
+
+func (store *HistoryStore) load(key Name, buffer *HistoryBuffer) error {
+	file, err := os.Open(store.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var item HistoryItem
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			return err
+		}
+		buffer.Add(item)
+	}
+	return scanner.Err()
+}
+
+// append writes item to the file at path, rewriting the file with just
+// the buffer's events when it is first written and once it has grown
+// to twice the buffer's length. The file must be locked.
+func (file *historyFile) append(path string, buffer *HistoryBuffer, item HistoryItem, length int) error {
+	if file.file == nil || file.written >= 2*length {
+		if file.file != nil {
+			file.file.Close()
+			file.file = nil
+		}
+		return file.compact(path, buffer)
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if _, err := file.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	file.written++
+	return nil
+}
+
+func (file *historyFile) compact(path string, buffer *HistoryBuffer) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".history-")
+	if err != nil {
+		return err
+	}
+	items := buffer.All()
+	writer := bufio.NewWriter(tmp)
+	for _, item := range items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		writer.Write(append(data, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	file.file = tmp
+	file.written = len(items)
+	return nil
+}
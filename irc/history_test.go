@@ -0,0 +1,170 @@
+package irc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func msgids(items HistoryItems) (ids []string) {
+	for _, item := range items {
+		ids = append(ids, item.MsgID)
+	}
+	return
+}
+
+func TestHistoryBuffer(t *testing.T) {
+	assert := assert.New(t)
+
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	buffer := NewHistoryBuffer(5)
+	for i := 0; i < 8; i++ {
+		buffer.Add(HistoryItem{
+			Time:    epoch.Add(time.Duration(i) * time.Minute),
+			MsgID:   fmt.Sprint(i),
+			Command: PRIVMSG,
+		})
+	}
+
+	items := buffer.All()
+	assert.Equal([]string{"3", "4", "5", "6", "7"}, msgids(items))
+
+	at := func(i int) HistoryRef {
+		return HistoryRef{Time: epoch.Add(time.Duration(i) * time.Minute)}
+	}
+
+	assert.Equal([]string{"6", "7"}, msgids(items.Latest(nil, 2)))
+	assert.Equal([]string{"6", "7"}, msgids(items.Latest(&HistoryRef{MsgID: "5"}, 10)))
+	assert.Equal([]string{"4", "5"}, msgids(items.Before(at(6), 2)))
+	assert.Equal([]string{"5", "6"}, msgids(items.After(HistoryRef{MsgID: "4"}, 2)))
+	assert.Equal([]string{"4", "5", "6"}, msgids(items.Around(at(5), 3)))
+	assert.Equal([]string{"4", "5"}, msgids(items.Between(at(3), at(7), 2)))
+	assert.Equal([]string{"5", "6"}, msgids(items.Between(at(7), at(3), 2)))
+	assert.Empty(items.Before(HistoryRef{MsgID: "1"}, 2))
+
+	buffer.Resize(2)
+	assert.Equal([]string{"6", "7"}, msgids(buffer.All()))
+}
+
+func TestHistoryStore(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "eris-history")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := HistoryConfig{
+		Length: 3,
+		Dir:    dir,
+		Channels: map[string]HistoryLimits{
+			"#Big": {Length: 10, Limit: 500},
+		},
+	}
+	store, err := NewHistoryStore(config)
+	assert.NoError(err)
+
+	for i := 0; i < 10; i++ {
+		store.Add("#small", HistoryItem{MsgID: fmt.Sprint(i), Command: NOTICE})
+		store.Add("#BIG", HistoryItem{MsgID: fmt.Sprint(i), Command: NOTICE})
+	}
+	assert.Equal(DefaultHistoryLimit, store.Limit("#small"))
+	assert.Equal(500, store.Limit("#big"))
+	assert.Equal(500, store.MaxLimit())
+	assert.NoError(store.Close())
+
+	store, err = NewHistoryStore(config)
+	assert.NoError(err)
+	assert.Equal([]string{"7", "8", "9"}, msgids(store.Get("#SMALL").All()))
+	assert.Equal(10, store.Get("#big").Len())
+	assert.Nil(store.Get("#none"))
+
+	store.Add(queryKey("admin", "Bob"), HistoryItem{MsgID: "q1", Command: PRIVMSG})
+	store.Add(inboxKey("admin"), HistoryItem{MsgID: "i1", Command: PRIVMSG})
+	assert.NoError(store.Close())
+	store, err = NewHistoryStore(config)
+	assert.NoError(err)
+	assert.Equal([]Name{"~admin:bob"}, store.Targets("~Admin:"))
+	assert.Equal([]string{"i1"}, msgids(store.Take(inboxKey("admin"))))
+	assert.Nil(store.Take(inboxKey("admin")))
+	assert.Nil(store.Get(inboxKey("admin")))
+
+	store.Add(inboxKey("admin"), HistoryItem{MsgID: "i2", Command: PRIVMSG})
+	assert.NoError(store.Close())
+	store, err = NewHistoryStore(config)
+	assert.NoError(err)
+	assert.Equal([]string{"i2"}, msgids(store.Take(inboxKey("admin"))))
+}
+
+func TestReadMarkers(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "eris-markers")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	markers := NewReadMarkers(dir)
+	assert.True(markers.Get("admin", "#chan").IsZero())
+	assert.Equal(epoch, markers.Set("admin", "#Chan", epoch))
+	assert.Equal(epoch, markers.Set("admin", "#chan", epoch.Add(-time.Minute)))
+	assert.Nil(markers.Snapshot())
+
+	markers = NewReadMarkers(dir)
+	assert.True(epoch.Equal(markers.Get("admin", "#CHAN")))
+	assert.True(markers.Get("other", "#chan").IsZero())
+}
+
+func TestParsePlayback(t *testing.T) {
+	assert := assert.New(t)
+
+	for str, expected := range map[string]Playback{
+		"50":    {Lines: 50},
+		"30m":   {Duration: 30 * time.Minute},
+		"2h":    {Duration: 2 * time.Hour},
+		"1m30s": {Duration: 90 * time.Second},
+	} {
+		playback, err := ParsePlayback(str)
+		assert.NoError(err)
+		assert.Equal(expected, playback)
+		assert.Equal(str, playback.String())
+	}
+
+	for _, str := range []string{"", "-1", "-5m", "lots"} {
+		_, err := ParsePlayback(str)
+		assert.Equal(ErrInvalidPlayback, err)
+	}
+
+	nick, text := HistoryItem{
+		Command: PRIVMSG,
+		Line:    ":bob!bob@host PRIVMSG #chan :hello there",
+	}.Message()
+	assert.Equal(Name("bob"), nick)
+	assert.Equal("hello there", text)
+}
+
+func TestChatHistoryMembersOnly(t *testing.T) {
+	assert := assert.New(t)
+	server := testBouncerServer()
+
+	member, memberSession := testConnect(server, "")
+	testRegister(member, memberSession, "historian")
+	member.handleLine(memberSession, "JOIN #members")
+	member.handleLine(memberSession, "PRIVMSG #members :secret")
+
+	outsider, outsiderSession := testConnect(server, "")
+	testRegister(outsider, outsiderSession, "outsider")
+	testSent(outsiderSession)
+	outsider.handleLine(outsiderSession, "CHATHISTORY LATEST #members * 10")
+	sent := testSent(outsiderSession)
+	assert.Contains(sent, "FAIL CHATHISTORY INVALID_TARGET")
+	assert.NotContains(sent, "secret")
+
+	outsider.handleLine(outsiderSession, "JOIN #members")
+	testSent(outsiderSession)
+	outsider.handleLine(outsiderSession, "CHATHISTORY LATEST #members * 10")
+	assert.Contains(testSent(outsiderSession), "PRIVMSG #members :secret")
+}
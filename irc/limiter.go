@@ -0,0 +1,277 @@
+package irc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCIDRLenIPv4 = 24
+	DefaultCIDRLenIPv6 = 64
+)
+
+var (
+	ErrTooManyConnections = errors.New("too many connections from your host")
+	ErrThrottled          = errors.New("too many connections too quickly, try again later")
+)
+
+// ThrottleConfig limits how many connections an IP may make within
+// Duration. A zero value disables throttling.
+type ThrottleConfig struct {
+	Connections int
+	Duration    time.Duration
+}
+
+// LimitsConfig holds per-IP and per-CIDR connection limits. Zero values
+// mean unlimited. Exempt is a list of IPs or CIDRs that are never limited.
+type LimitsConfig struct {
+	MaxPerIP   int
+	MaxPerCIDR int
+	CIDRLenV4  int
+	CIDRLenV6  int
+	Throttle   ThrottleConfig
+	Exempt     []string
+}
+
+// TokenBucket is a simple token bucket refilled at a constant rate.
+type TokenBucket struct {
+	capacity float64
+	tokens   float64
+	rate     float64 // tokens per second
+	last     time.Time
+}
+
+func NewTokenBucket(capacity int, interval time.Duration, now time.Time) *TokenBucket {
+	return &TokenBucket{
+		capacity: float64(capacity),
+		tokens:   float64(capacity),
+		rate:     float64(capacity) / interval.Seconds(),
+		last:     now,
+	}
+}
+
+func (tb *TokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.capacity {
+		tb.tokens = tb.capacity
+	}
+	tb.last = now
+}
+
+// SetRate changes the capacity and refill rate of the bucket, keeping
+// the tokens it has up to the new capacity.
+func (tb *TokenBucket) SetRate(capacity int, interval time.Duration) {
+	tb.capacity = float64(capacity)
+	tb.rate = float64(capacity) / interval.Seconds()
+	if tb.tokens > tb.capacity {
+		tb.tokens = tb.capacity
+	}
+}
+
+// Take removes a token from the bucket and returns false if it was empty.
+func (tb *TokenBucket) Take(now time.Time) bool {
+	tb.refill(now)
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// Full returns true if the bucket has refilled completely.
+func (tb *TokenBucket) Full(now time.Time) bool {
+	tb.refill(now)
+	return tb.tokens >= tb.capacity
+}
+
+// ConnectionLimiter tracks concurrent connections and connection rates
+// by remote IP address. Addresses that are not IPs (I2P destinations for
+// example) are never limited.
+type ConnectionLimiter struct {
+	sync.Mutex
+
+	config    LimitsConfig
+	exempt    []*net.IPNet
+	ips       map[string]int
+	cidrs     map[string]int
+	buckets   map[string]*TokenBucket
+	lastPrune time.Time
+}
+
+func NewConnectionLimiter(config LimitsConfig) *ConnectionLimiter {
+	cl := &ConnectionLimiter{
+		ips:     make(map[string]int),
+		cidrs:   make(map[string]int),
+		buckets: make(map[string]*TokenBucket),
+	}
+	cl.SetConfig(config)
+	return cl
+}
+
+// SetConfig replaces the limits, keeping the current connection counts
+// and throttle state.
+func (cl *ConnectionLimiter) SetConfig(config LimitsConfig) {
+	cl.Lock()
+	defer cl.Unlock()
+
+	if config.CIDRLenV4 == 0 {
+		config.CIDRLenV4 = DefaultCIDRLenIPv4
+	}
+	if config.CIDRLenV6 == 0 {
+		config.CIDRLenV6 = DefaultCIDRLenIPv6
+	}
+
+	cl.config = config
+	cl.exempt = ParseNets(config.Exempt)
+
+	// throttle state is kept, so a rehash doesn't give throttled hosts a
+	// fresh allowance, except for IPs that are no longer throttled
+	throttle := config.Throttle
+	for key, bucket := range cl.buckets {
+		ip := net.ParseIP(key)
+		if throttle.Connections <= 0 || throttle.Duration <= 0 || ip == nil || matchNets(cl.exempt, ip) {
+			delete(cl.buckets, key)
+			continue
+		}
+		bucket.SetRate(throttle.Connections, throttle.Duration)
+	}
+}
+
+// ParseNets parses a list of IPs and CIDRs, skipping invalid entries.
+func ParseNets(strs []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(strs))
+	for _, str := range strs {
+		ipnet, err := ParseNet(str)
+		if err != nil {
+			continue
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
+
+// ParseNet parses an IP or CIDR, treating a bare IP as a single host.
+func ParseNet(str string) (*net.IPNet, error) {
+	if _, ipnet, err := net.ParseCIDR(str); err == nil {
+		return ipnet, nil
+	}
+	ip := net.ParseIP(str)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "IP address", Text: str}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func matchNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// LimiterKey is the IP and CIDR a connection was counted under by Add.
+// It is kept for Remove so a connection is uncounted under the same
+// keys after the limits are reconfigured.
+type LimiterKey struct {
+	ip   string
+	cidr string
+}
+
+// limited returns the IP and CIDR keys for addr, or false if addr is
+// not subject to limits.
+func (cl *ConnectionLimiter) limited(addr net.Addr) (ipKey, cidrKey string, ok bool) {
+	ip := net.ParseIP(IPString(addr).String())
+	if ip == nil || matchNets(cl.exempt, ip) {
+		return "", "", false
+	}
+
+	var mask net.IPMask
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		mask = net.CIDRMask(cl.config.CIDRLenV4, 32)
+	} else {
+		mask = net.CIDRMask(cl.config.CIDRLenV6, 128)
+	}
+	cidr := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	return ip.String(), cidr.String(), true
+}
+
+// Add records a new connection from addr and returns the key to pass
+// to Remove, which is nil if addr is exempt. It returns an error, and
+// does not record the connection, if addr is over any of the limits.
+func (cl *ConnectionLimiter) Add(addr net.Addr) (*LimiterKey, error) {
+	cl.Lock()
+	defer cl.Unlock()
+
+	ipKey, cidrKey, ok := cl.limited(addr)
+	if !ok {
+		return nil, nil
+	}
+
+	if cl.config.MaxPerIP > 0 && cl.ips[ipKey] >= cl.config.MaxPerIP {
+		return nil, ErrTooManyConnections
+	}
+	if cl.config.MaxPerCIDR > 0 && cl.cidrs[cidrKey] >= cl.config.MaxPerCIDR {
+		return nil, ErrTooManyConnections
+	}
+
+	throttle := cl.config.Throttle
+	if throttle.Connections > 0 && throttle.Duration > 0 {
+		now := time.Now()
+		cl.prune(now)
+		bucket, ok := cl.buckets[ipKey]
+		if !ok {
+			bucket = NewTokenBucket(throttle.Connections, throttle.Duration, now)
+			cl.buckets[ipKey] = bucket
+		}
+		if !bucket.Take(now) {
+			return nil, ErrThrottled
+		}
+	}
+
+	cl.ips[ipKey]++
+	cl.cidrs[cidrKey]++
+	return &LimiterKey{ip: ipKey, cidr: cidrKey}, nil
+}
+
+// Remove forgets a connection previously recorded by Add.
+func (cl *ConnectionLimiter) Remove(key *LimiterKey) {
+	if key == nil {
+		return
+	}
+
+	cl.Lock()
+	defer cl.Unlock()
+
+	if cl.ips[key.ip] <= 1 {
+		delete(cl.ips, key.ip)
+	} else {
+		cl.ips[key.ip]--
+	}
+	if cl.cidrs[key.cidr] <= 1 {
+		delete(cl.cidrs, key.cidr)
+	} else {
+		cl.cidrs[key.cidr]--
+	}
+}
+
+// prune drops buckets that have refilled so the map doesn't grow without
+// bound. It runs at most once per throttle duration.
+func (cl *ConnectionLimiter) prune(now time.Time) {
+	if now.Sub(cl.lastPrune) < cl.config.Throttle.Duration {
+		return
+	}
+	cl.lastPrune = now
+	for key, bucket := range cl.buckets {
+		if bucket.Full(now) {
+			delete(cl.buckets, key)
+		}
+	}
+}
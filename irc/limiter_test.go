@@ -0,0 +1,131 @@
+package irc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+func addConn(cl *ConnectionLimiter, ip string) error {
+	_, err := cl.Add(tcpAddr(ip))
+	return err
+}
+
+func TestConnectionLimiterMaxPerIP(t *testing.T) {
+	assert := assert.New(t)
+
+	cl := NewConnectionLimiter(LimitsConfig{MaxPerIP: 2})
+	key, err := cl.Add(tcpAddr("10.0.0.1"))
+	assert.Nil(err)
+	assert.Nil(addConn(cl, "10.0.0.1"))
+	assert.Equal(ErrTooManyConnections, addConn(cl, "10.0.0.1"))
+	assert.Nil(addConn(cl, "10.0.0.2"))
+
+	cl.Remove(key)
+	assert.Nil(addConn(cl, "10.0.0.1"))
+}
+
+func TestConnectionLimiterRemoveAfterRehash(t *testing.T) {
+	assert := assert.New(t)
+
+	config := LimitsConfig{MaxPerIP: 1, MaxPerCIDR: 2}
+	cl := NewConnectionLimiter(config)
+	key, err := cl.Add(tcpAddr("10.0.0.1"))
+	assert.Nil(err)
+
+	cl.SetConfig(LimitsConfig{
+		MaxPerIP:   1,
+		MaxPerCIDR: 2,
+		CIDRLenV4:  16,
+		Exempt:     []string{"10.0.0.1"},
+	})
+	cl.Remove(key)
+
+	// the connection was uncounted from its IP and its /24
+	cl.SetConfig(config)
+	assert.Nil(addConn(cl, "10.0.0.1"))
+	assert.Nil(addConn(cl, "10.0.0.2"))
+	assert.Equal(ErrTooManyConnections, addConn(cl, "10.0.0.3"))
+}
+
+func TestConnectionLimiterMaxPerCIDR(t *testing.T) {
+	assert := assert.New(t)
+
+	cl := NewConnectionLimiter(LimitsConfig{MaxPerCIDR: 2})
+	assert.Nil(addConn(cl, "10.0.0.1"))
+	assert.Nil(addConn(cl, "10.0.0.2"))
+	assert.Equal(ErrTooManyConnections, addConn(cl, "10.0.0.3"))
+	assert.Nil(addConn(cl, "10.0.1.1"))
+
+	assert.Nil(addConn(cl, "2001:db8::1"))
+	assert.Nil(addConn(cl, "2001:db8::2"))
+	assert.Equal(ErrTooManyConnections, addConn(cl, "2001:db8::3"))
+}
+
+func TestConnectionLimiterExempt(t *testing.T) {
+	assert := assert.New(t)
+
+	cl := NewConnectionLimiter(LimitsConfig{
+		MaxPerIP: 1,
+		Exempt:   []string{"127.0.0.1", "192.168.0.0/16"},
+	})
+	for i := 0; i < 3; i++ {
+		assert.Nil(addConn(cl, "127.0.0.1"))
+		assert.Nil(addConn(cl, "192.168.1.1"))
+	}
+}
+
+func TestConnectionLimiterThrottle(t *testing.T) {
+	assert := assert.New(t)
+
+	cl := NewConnectionLimiter(LimitsConfig{
+		Throttle: ThrottleConfig{Connections: 2, Duration: time.Minute},
+	})
+	assert.Nil(addConn(cl, "10.0.0.1"))
+	assert.Nil(addConn(cl, "10.0.0.1"))
+	assert.Equal(ErrThrottled, addConn(cl, "10.0.0.1"))
+	assert.Nil(addConn(cl, "10.0.0.2"))
+}
+
+func TestConnectionLimiterThrottleRehash(t *testing.T) {
+	assert := assert.New(t)
+
+	config := LimitsConfig{
+		Throttle: ThrottleConfig{Connections: 2, Duration: time.Minute},
+	}
+	cl := NewConnectionLimiter(config)
+	assert.Nil(addConn(cl, "10.0.0.1"))
+	assert.Nil(addConn(cl, "10.0.0.1"))
+	assert.Nil(addConn(cl, "10.0.0.2"))
+	assert.Nil(addConn(cl, "10.0.0.2"))
+
+	cl.SetConfig(config)
+	assert.Equal(ErrThrottled, addConn(cl, "10.0.0.1"))
+
+	config.Exempt = []string{"10.0.0.2"}
+	cl.SetConfig(config)
+	assert.Nil(addConn(cl, "10.0.0.2"))
+	config.Exempt = nil
+	cl.SetConfig(config)
+	assert.Nil(addConn(cl, "10.0.0.2"))
+	assert.Equal(ErrThrottled, addConn(cl, "10.0.0.1"))
+}
+
+func TestTokenBucket(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	tb := NewTokenBucket(2, time.Second, now)
+	assert.True(tb.Take(now))
+	assert.True(tb.Take(now))
+	assert.False(tb.Take(now))
+	assert.True(tb.Take(now.Add(500 * time.Millisecond)))
+	assert.False(tb.Full(now.Add(500 * time.Millisecond)))
+	assert.True(tb.Full(now.Add(2 * time.Second)))
+}
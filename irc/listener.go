@@ -0,0 +1,402 @@
+package irc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/eyedeekay/sam3"
+	"github.com/eyedeekay/sam3/i2pkeys"
+	log "github.com/sirupsen/logrus"
+)
+
+// listenerKind is the transport a listener accepts connections over.
+type listenerKind string
+
+const (
+	ListenTCP listenerKind = "tcp"
+	ListenTLS listenerKind = "tls"
+	ListenI2P listenerKind = "i2p"
+	ListenTor listenerKind = "tor"
+)
+
+// listenerKey identifies a configured IRC or WWW listener.
+type listenerKey struct {
+	www  bool
+	kind listenerKind
+	addr string
+}
+
+func (key listenerKey) String() string {
+	service := "irc"
+	if key.www {
+		service = "www"
+	}
+	return fmt.Sprintf("%s %s listener %s", service, key.kind, key.addr)
+}
+
+// serverListener is an open listener and the config it was opened
+// with. For TCP and TLS listeners socket is the TCP or unix socket
+// listener, which is handed over to the new process on UPGRADE.
+type serverListener struct {
+	net.Listener
+	config    interface{}
+	cert      *certificate
+	socket    net.Listener
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+// Close closes the listener. Closing it again does nothing.
+func (l *serverListener) Close() (err error) {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	return
+}
+
+func (l *serverListener) IsClosed() bool {
+	select {
+	case <-l.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// certificate is a TLS certificate that can be reloaded while the
+// listener using it stays open.
+type certificate struct {
+	sync.RWMutex
+	cert *tls.Certificate
+}
+
+// Load loads the certificate from tlsconfig and reports whether it
+// differs from the previously loaded one.
+func (c *certificate) Load(tlsconfig *TLSConfig) (bool, error) {
+	cert, err := tls.LoadX509KeyPair(tlsconfig.Cert, tlsconfig.Key)
+	if err != nil {
+		return false, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	changed := c.cert == nil || !bytes.Equal(c.cert.Certificate[0], cert.Certificate[0])
+	c.cert = &cert
+	return changed, nil
+}
+
+func (c *certificate) Get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
+
+// configuredListeners returns every listener config asks for with
+// the config it is opened with.
+func configuredListeners(config *Config) map[listenerKey]interface{} {
+	listeners := make(map[listenerKey]interface{})
+
+	add := func(www bool, listen []string, tlslisten map[string]*TLSConfig,
+		i2plisten map[string]*I2PConfig, torlisten map[string]*TorConfig) {
+		for _, addr := range listen {
+			listeners[listenerKey{www, ListenTCP, addr}] = nil
+		}
+		for addr, tlsconfig := range tlslisten {
+			listeners[listenerKey{www, ListenTLS, addr}] = tlsconfig
+		}
+		for addr, i2pconfig := range i2plisten {
+			listeners[listenerKey{www, ListenI2P, addr}] = i2pconfig
+		}
+		for addr, torconfig := range torlisten {
+			listeners[listenerKey{www, ListenTor, addr}] = torconfig
+		}
+	}
+	add(false, config.Server.Listen, config.Server.TLSListen,
+		config.Server.I2PListen, config.Server.TorListen)
+	add(true, config.WWW.Listen, config.WWW.TLSListen,
+		config.WWW.I2PListen, config.WWW.TorListen)
+
+	return listeners
+}
+
+// sameListenerConfig returns true if a listener opened with config old
+// can be kept open for config new. TLS listeners are always kept, their
+// certificates are reloaded instead.
+func sameListenerConfig(old, new interface{}) bool {
+	switch old := old.(type) {
+	case *I2PConfig:
+		new := new.(*I2PConfig)
+		return old.I2Pkeys == new.I2Pkeys && old.SAMaddr == new.SAMaddr
+	case *TorConfig:
+		new := new.(*TorConfig)
+		return old.Torkeys == new.Torkeys && old.ControlPort == new.ControlPort
+	}
+	return true
+}
+
+func sortedListenerKeys(listeners map[listenerKey]interface{}) []listenerKey {
+	keys := make([]listenerKey, 0, len(listeners))
+	for key := range listeners {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+	return keys
+}
+
+// updateListeners opens, closes and reloads listeners to match the
+// server's config and returns a summary of what changed. Listeners that
+// fail to open are reported in a ConfigErrors.
+func (s *Server) updateListeners() (changes []string, err error) {
+	var errs ConfigErrors
+	wanted := configuredListeners(s.Config())
+
+	for _, key := range s.listenerKeys() {
+		l := s.listeners[key]
+		if config, ok := wanted[key]; ok && sameListenerConfig(l.config, config) {
+			continue
+		}
+		l.Close()
+		delete(s.listeners, key)
+		s.logger().Infof("closed %s", key)
+		changes = append(changes, fmt.Sprintf("closed %s", key))
+	}
+
+	for _, key := range sortedListenerKeys(wanted) {
+		config := wanted[key]
+		if l, ok := s.listeners[key]; ok {
+			switch config := config.(type) {
+			case *TLSConfig:
+				changed, err := l.cert.Load(config)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %s", key, err))
+				} else if changed {
+					changes = append(changes, fmt.Sprintf("reloaded certificate of %s", key))
+				}
+			case *I2PConfig:
+				config.Base32 = l.config.(*I2PConfig).Base32
+			case *TorConfig:
+				config.Onion = l.config.(*TorConfig).Onion
+			}
+			l.config = config
+			continue
+		}
+
+		l, err := s.openListener(key, config)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", key, err))
+			continue
+		}
+		s.listeners[key] = l
+		changes = append(changes, fmt.Sprintf("opened %s", key))
+	}
+
+	if len(errs) > 0 {
+		return changes, errs
+	}
+	return changes, nil
+}
+
+func (s *Server) listenerKeys() []listenerKey {
+	keys := make([]listenerKey, 0, len(s.listeners))
+	for key := range s.listeners {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// openListener opens the listener key and starts serving IRC or WWW
+// connections on it.
+func (s *Server) openListener(key listenerKey, config interface{}) (*serverListener, error) {
+	l := &serverListener{
+		config: config,
+		closed: make(chan bool),
+	}
+
+	var err error
+	switch key.kind {
+	case ListenTCP:
+		l.socket, err = ListenAddr(key.addr)
+		l.Listener = l.socket
+	case ListenTLS:
+		l.cert = &certificate{}
+		if _, err = l.cert.Load(config.(*TLSConfig)); err == nil {
+			if l.socket, err = ListenAddr(key.addr); err == nil {
+				l.Listener = s.tlslistener(l.socket, l.cert)
+			}
+		}
+	case ListenI2P:
+		l.Listener, err = s.i2plistener(key.addr, config.(*I2PConfig))
+	case ListenTor:
+		l.Listener, err = s.torlistener(key.addr, config.(*TorConfig))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch config := config.(type) {
+	case *I2PConfig:
+		s.logger().Infof("listening on %s (%s)", key, config.Base32)
+	case *TorConfig:
+		s.logger().Infof("listening on %s (%s)", key, config.Onion)
+	default:
+		s.logger().Infof("listening on %s", key)
+	}
+
+	s.serve(key, l)
+	return l, nil
+}
+
+// serve starts serving IRC or WWW connections on the listener key.
+func (s *Server) serve(key listenerKey, l *serverListener) {
+	if key.www {
+		go http.Serve(l, s)
+	} else {
+		go s.acceptor(l, key.addr)
+	}
+}
+
+func (s *Server) tlslistener(socket net.Listener, cert *certificate) net.Listener {
+	config := tls.Config{
+		GetCertificate: cert.Get,
+		// client certificates are only used for fingerprints, not verified
+		ClientAuth: tls.RequestClientCert,
+	}
+	config.Rand = rand.Reader
+	return tls.NewListener(socket, &config)
+}
+
+func (s *Server) i2plistener(addr string, i2pconfig *I2PConfig) (net.Listener, error) {
+	log.Infof("Starting and registering I2P service, please wait a couple of minutes...")
+	sam, err := sam3.NewSAM(i2pconfig.SAMaddr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to SAM: %s", err)
+	}
+	var keys *i2pkeys.I2PKeys
+	if _, err := os.Stat(i2pconfig.I2Pkeys + ".i2p.private"); os.IsNotExist(err) {
+		f, err := os.Create(i2pconfig.I2Pkeys + ".i2p.private")
+		if err != nil {
+			return nil, fmt.Errorf("unable to open I2P keyfile for writing: %s", err)
+		}
+		defer f.Close()
+		tkeys, err := sam.NewKeys()
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate I2P Keys, %s", err)
+		}
+		keys = &tkeys
+		err = i2pkeys.StoreKeysIncompat(*keys, f)
+		if err != nil {
+			return nil, fmt.Errorf("unable to save newly generated I2P Keys, %s", err)
+		}
+	} else {
+		tkeys, err := i2pkeys.LoadKeys(i2pconfig.I2Pkeys + ".i2p.private")
+		if err != nil {
+			return nil, fmt.Errorf("unable to load I2P Keys: %s", err)
+		}
+		keys = &tkeys
+	}
+	// If the keys and the base32 are different, keys win.
+	i2pconfig.Base32 = keys.Addr().Base32()
+	stream, err := sam.NewStreamSession(addr, *keys, sam3.Options_Medium)
+	if err != nil {
+		return nil, fmt.Errorf("error creating I2P streaming connection: %s", err)
+	}
+	listener, err := stream.Listen()
+	if err != nil {
+		return nil, fmt.Errorf("error listening on I2P streaming connection: %s", err)
+	}
+
+	err = ioutil.WriteFile(i2pconfig.I2Pkeys+".i2p.public.txt", []byte(i2pconfig.Base32), 0644)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("error storing I2P base32 address in adjacent text file, %s", err)
+	}
+	return listener, nil
+}
+
+// onionListener closes the Tor process started for an onion service
+// along with the service.
+type onionListener struct {
+	*tor.OnionService
+	tor *tor.Tor
+}
+
+func (l *onionListener) Close() error {
+	err := l.OnionService.Close()
+	l.tor.Close()
+	return err
+}
+
+func (s *Server) torlistener(addr string, torconfig *TorConfig) (net.Listener, error) {
+	log.Infof("Starting and registering onion service, please wait a couple of minutes...")
+	t, err := tor.Start(nil, &tor.StartConf{ControlPort: torconfig.ControlPort})
+	if err != nil {
+		return nil, fmt.Errorf("unable to start Tor: %s", err)
+	}
+	var keys *ed25519.KeyPair
+	if _, err := os.Stat(torconfig.Torkeys + ".tor.private"); os.IsNotExist(err) {
+		tkeys, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("unable to generate onion service key, %s", err)
+		}
+		keys = &tkeys
+		f, err := os.Create(torconfig.Torkeys + ".tor.private")
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("unable to create Tor keys file for writing, %s", err)
+		}
+		defer f.Close()
+		_, err = f.Write(tkeys.PrivateKey())
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("unable to write Tor keys to disk, %s", err)
+		}
+	} else if err == nil {
+		tkeys, err := ioutil.ReadFile(torconfig.Torkeys + ".tor.private")
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("unable to read Tor keys from disk, %s", err)
+		}
+		k := ed25519.FromCryptoPrivateKey(tkeys)
+		keys = &k
+	} else {
+		t.Close()
+		return nil, fmt.Errorf("unable to set up Tor keys, %s", err)
+	}
+	listenCtx := context.Background()
+	// Create a v3 onion service to listen on any port but show as 6667
+	onion, err := t.Listen(
+		listenCtx,
+		&tor.ListenConf{
+			Version3:    true,
+			RemotePorts: []int{6667},
+			Key:         *keys,
+		},
+	)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("error setting up Tor onion address, %s", err)
+	}
+	listener := &onionListener{OnionService: onion, tor: t}
+	torconfig.Onion = onion.ID + ".onion"
+	err = ioutil.WriteFile(torconfig.Torkeys+".tor.public.txt", []byte(torconfig.Onion), 0644)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("error storing Tor onion address in adjacent text file, %s", err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,311 @@
+package irc
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultLogLevel = log.WarnLevel
+
+	// logFileTimeFormat is the suffix given to rotated log files.
+	logFileTimeFormat = "20060102-150405.000000000"
+)
+
+// LogConfig configures a log output. File is the path of the log
+// file, or stderr if empty. Format is "text" (the default) or "json".
+// Files are rotated when they grow past MaxSize megabytes or get older
+// than MaxAge, keeping the Keep most recent rotated files (all of them
+// if zero).
+type LogConfig struct {
+	File    string
+	Level   string
+	Format  string
+	MaxSize int
+	MaxAge  time.Duration
+	Keep    int
+}
+
+// LogConfigs is a list of log outputs. It may also be given as just a
+// level, as in "log: debug", which logs to stderr at that level.
+type LogConfigs []LogConfig
+
+func (configs *LogConfigs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var level string
+	if err := unmarshal(&level); err == nil {
+		*configs = LogConfigs{{Level: level}}
+		return nil
+	}
+
+	var list []LogConfig
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*configs = list
+	return nil
+}
+
+func (config LogConfig) level() (log.Level, error) {
+	if config.Level == "" {
+		return DefaultLogLevel, nil
+	}
+	return log.ParseLevel(config.Level)
+}
+
+func (config LogConfig) formatter() (log.Formatter, error) {
+	switch strings.ToLower(config.Format) {
+	case "", "text":
+		return &log.TextFormatter{
+			DisableColors: config.File != "",
+			FullTimestamp: true,
+		}, nil
+	case "json":
+		return &log.JSONFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", config.Format)
+}
+
+// logOutput is a logrus hook writing entries up to a level to a
+// writer in its own format.
+type logOutput struct {
+	sync.Mutex
+	level     log.Level
+	formatter log.Formatter
+	writer    io.Writer
+}
+
+func (output *logOutput) Levels() []log.Level {
+	return log.AllLevels[:output.level+1]
+}
+
+func (output *logOutput) Fire(entry *log.Entry) error {
+	data, err := output.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	output.Lock()
+	defer output.Unlock()
+	_, err = output.writer.Write(data)
+	return err
+}
+
+// discardFormatter skips formatting entries for the standard logger's
+// own output, which is discarded in favour of the logOutput hooks.
+type discardFormatter struct{}
+
+func (discardFormatter) Format(*log.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+var logging struct {
+	sync.Mutex
+	debug bool
+	files []*LogFile
+}
+
+// SetupLogging replaces the outputs of the standard logger with the
+// configured ones, or with stderr if there are none. If debug is set
+// every output logs at debug level.
+func SetupLogging(configs []LogConfig, debug bool) error {
+	logging.Lock()
+	logging.debug = debug
+	logging.Unlock()
+	return ReloadLogging(configs)
+}
+
+// ReloadLogging replaces the outputs of the standard logger as for
+// SetupLogging, keeping its debug setting.
+func ReloadLogging(configs []LogConfig) error {
+	logging.Lock()
+	defer logging.Unlock()
+
+	if len(configs) == 0 {
+		configs = []LogConfig{{}}
+	}
+
+	var (
+		files    []*LogFile
+		hooks    = make(log.LevelHooks)
+		minLevel = log.PanicLevel
+	)
+	for _, config := range configs {
+		level, err := config.level()
+		if err != nil {
+			closeLogFiles(files)
+			return err
+		}
+		if logging.debug {
+			level = log.DebugLevel
+		}
+		formatter, err := config.formatter()
+		if err != nil {
+			closeLogFiles(files)
+			return err
+		}
+
+		var writer io.Writer = os.Stderr
+		if config.File != "" {
+			file, err := OpenLogFile(config.File, int64(config.MaxSize)<<20, config.MaxAge, config.Keep)
+			if err != nil {
+				closeLogFiles(files)
+				return err
+			}
+			files = append(files, file)
+			writer = file
+		}
+
+		hooks.Add(&logOutput{level: level, formatter: formatter, writer: writer})
+		if level > minLevel {
+			minLevel = level
+		}
+	}
+
+	logger := log.StandardLogger()
+	logger.SetOutput(ioutil.Discard)
+	logger.SetFormatter(discardFormatter{})
+	logger.ReplaceHooks(hooks)
+	logger.SetLevel(minLevel)
+
+	closeLogFiles(logging.files)
+	logging.files = files
+	return nil
+}
+
+// ReopenLogs reopens every log file, e.g. after they were moved by an
+// external log rotation tool.
+func ReopenLogs() {
+	logging.Lock()
+	defer logging.Unlock()
+
+	for _, file := range logging.files {
+		if err := file.Reopen(); err != nil {
+			fmt.Fprintf(os.Stderr, "error reopening log file %s: %s\n", file.path, err)
+		}
+	}
+}
+
+func closeLogFiles(files []*LogFile) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// LogFile is a log file rotated when it grows past maxSize bytes or
+// gets older than maxAge. Rotated files are renamed with a timestamp
+// suffix and only the keep most recent are kept. Zero values disable
+// the corresponding limit.
+type LogFile struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func OpenLogFile(path string, maxSize int64, maxAge time.Duration, keep int) (*LogFile, error) {
+	file := &LogFile{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		keep:    keep,
+	}
+	if err := file.open(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *LogFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.size > 0 && ((f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize) ||
+		(f.maxAge > 0 && time.Since(f.opened) > f.maxAge)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *LogFile) rotate() error {
+	f.file.Close()
+	rotated := f.path + "." + time.Now().Format(logFileTimeFormat)
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.prune()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond the number to keep.
+func (f *LogFile) prune() {
+	if f.keep <= 0 {
+		return
+	}
+
+	matches, _ := filepath.Glob(f.path + ".*")
+	var rotated []string
+	for _, match := range matches {
+		suffix := strings.TrimPrefix(match, f.path+".")
+		if _, err := time.Parse(logFileTimeFormat, suffix); err == nil {
+			rotated = append(rotated, match)
+		}
+	}
+	sort.Strings(rotated)
+
+	for len(rotated) > f.keep {
+		os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+}
+
+// Reopen closes and reopens the file at its path.
+func (f *LogFile) Reopen() error {
+	f.Lock()
+	defer f.Unlock()
+	f.file.Close()
+	return f.open()
+}
+
+func (f *LogFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.file.Close()
+}
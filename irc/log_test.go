@@ -0,0 +1,73 @@
+package irc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestLogFileRotate(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "eris-log")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "eris.log")
+	file, err := OpenLogFile(path, 10, 0, 2)
+	assert.NoError(err)
+	defer file.Close()
+
+	for i := 0; i < 4; i++ {
+		_, err := file.Write([]byte("0123456789"))
+		assert.NoError(err)
+	}
+
+	matches, _ := filepath.Glob(path + ".*")
+	assert.Len(matches, 2)
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal("0123456789", string(data))
+
+	assert.NoError(os.Rename(path, path+".moved"))
+	assert.NoError(file.Reopen())
+	_, err = file.Write([]byte("x"))
+	assert.NoError(err)
+	data, err = ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal("x", string(data))
+}
+
+func TestLogConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	level, err := LogConfig{}.level()
+	assert.NoError(err)
+	assert.Equal(DefaultLogLevel, level)
+
+	_, err = LogConfig{Level: "loud"}.level()
+	assert.Error(err)
+
+	_, err = LogConfig{Format: "json"}.formatter()
+	assert.NoError(err)
+	_, err = LogConfig{Format: "xml"}.formatter()
+	assert.Error(err)
+}
+
+func TestLogConfigsUnmarshal(t *testing.T) {
+	assert := assert.New(t)
+
+	var config struct{ Log LogConfigs }
+	assert.NoError(yaml.Unmarshal([]byte("log: debug"), &config))
+	assert.Equal(LogConfigs{{Level: "debug"}}, config.Log)
+
+	assert.NoError(yaml.Unmarshal([]byte("log:\n  - file: eris.log\n  - level: error"), &config))
+	assert.Equal(LogConfigs{{File: "eris.log"}, {Level: "error"}}, config.Log)
+
+	assert.Error(yaml.Unmarshal([]byte("log:\n  file: eris.log"), &config))
+}
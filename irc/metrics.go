@@ -2,15 +2,59 @@ package irc
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"sync"
 
+	"github.com/mmcloughlin/professor"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const (
+	DefaultMetricsListen = "localhost:9314"
+	DefaultPprofListen   = "localhost:6060"
+)
+
+// MetricsConfig configures the Prometheus metrics endpoint. Listen is
+// a TCP address or "unix:" followed by the path of a unix socket. If
+// Username is set clients must authenticate with it and the password.
+type MetricsConfig struct {
+	PassConfig `yaml:",inline"`
+	Disabled   bool
+	Listen     string
+	Username   string
+}
+
+func (config MetricsConfig) ListenAddr() string {
+	if config.Listen == "" {
+		return DefaultMetricsListen
+	}
+	return config.Listen
+}
+
+// PprofConfig configures the pprof profiling endpoint. Listen is as for
+// MetricsConfig.
+type PprofConfig struct {
+	Enabled bool
+	Listen  string
+}
+
+func (config PprofConfig) ListenAddr() string {
+	if config.Listen == "" {
+		return DefaultPprofListen
+	}
+	return config.Listen
+}
+
+// ServePprof serves the pprof handlers on listener.
+func ServePprof(listener net.Listener) error {
+	log.Infof("pprof endpoint listening on %s", listener.Addr())
+	return http.Serve(listener, professor.NewServeMux())
+}
+
 // DefObjectives ...
 var DefObjectives = map[float64]float64{
 	0.50: 0.05,
@@ -24,16 +68,27 @@ type Metrics struct {
 	sync.RWMutex
 
 	namespace string
+	registry  *prometheus.Registry
 	metrics   map[string]prometheus.Metric
+	countvecs map[string]*prometheus.CounterVec
 	guagevecs map[string]*prometheus.GaugeVec
 	sumvecs   map[string]*prometheus.SummaryVec
 }
 
-// NewMetrics ...
+// NewMetrics returns metrics registered with their own registry, along
+// with the Go runtime and process metrics, so that each server exports
+// only its own.
 func NewMetrics(namespace string) *Metrics {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
 	return &Metrics{
 		namespace: namespace,
+		registry:  registry,
 		metrics:   make(map[string]prometheus.Metric),
+		countvecs: make(map[string]*prometheus.CounterVec),
 		guagevecs: make(map[string]*prometheus.GaugeVec),
 		sumvecs:   make(map[string]*prometheus.SummaryVec),
 	}
@@ -54,7 +109,7 @@ func (m *Metrics) NewCounter(subsystem, name, help string) prometheus.Counter {
 	m.Lock()
 	m.metrics[key] = counter
 	m.Unlock()
-	prometheus.MustRegister(counter)
+	m.registry.MustRegister(counter)
 
 	return counter
 }
@@ -75,11 +130,32 @@ func (m *Metrics) NewCounterFunc(subsystem, name, help string, f func() float64)
 	m.Lock()
 	m.metrics[key] = counter
 	m.Unlock()
-	prometheus.MustRegister(counter)
+	m.registry.MustRegister(counter)
 
 	return counter
 }
 
+// NewCounterVec ...
+func (m *Metrics) NewCounterVec(subsystem, name, help string, labels []string) *prometheus.CounterVec {
+	countvec := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: m.namespace,
+			Subsystem: subsystem,
+			Name:      name,
+			Help:      help,
+		},
+		labels,
+	)
+
+	key := fmt.Sprintf("%s_%s", subsystem, name)
+	m.Lock()
+	m.countvecs[key] = countvec
+	m.Unlock()
+	m.registry.MustRegister(countvec)
+
+	return countvec
+}
+
 // NewGauge ...
 func (m *Metrics) NewGauge(subsystem, name, help string) prometheus.Gauge {
 	guage := prometheus.NewGauge(
@@ -95,7 +171,7 @@ func (m *Metrics) NewGauge(subsystem, name, help string) prometheus.Gauge {
 	m.Lock()
 	m.metrics[key] = guage
 	m.Unlock()
-	prometheus.MustRegister(guage)
+	m.registry.MustRegister(guage)
 
 	return guage
 }
@@ -116,7 +192,7 @@ func (m *Metrics) NewGaugeFunc(subsystem, name, help string, f func() float64) p
 	m.Lock()
 	m.metrics[key] = guage
 	m.Unlock()
-	prometheus.MustRegister(guage)
+	m.registry.MustRegister(guage)
 
 	return guage
 }
@@ -137,7 +213,7 @@ func (m *Metrics) NewGaugeVec(subsystem, name, help string, labels []string) *pr
 	m.Lock()
 	m.guagevecs[key] = guagevec
 	m.Unlock()
-	prometheus.MustRegister(guagevec)
+	m.registry.MustRegister(guagevec)
 
 	return guagevec
 }
@@ -158,7 +234,7 @@ func (m *Metrics) NewSummary(subsystem, name, help string) prometheus.Summary {
 	m.Lock()
 	m.metrics[key] = summary
 	m.Unlock()
-	prometheus.MustRegister(summary)
+	m.registry.MustRegister(summary)
 
 	return summary
 }
@@ -180,7 +256,7 @@ func (m *Metrics) NewSummaryVec(subsystem, name, help string, labels []string) *
 	m.Lock()
 	m.sumvecs[key] = sumvec
 	m.Unlock()
-	prometheus.MustRegister(sumvec)
+	m.registry.MustRegister(sumvec)
 
 	return sumvec
 }
@@ -191,6 +267,14 @@ func (m *Metrics) Counter(subsystem, name string) prometheus.Counter {
 	return m.metrics[key].(prometheus.Counter)
 }
 
+// CounterVec ...
+func (m *Metrics) CounterVec(subsystem, name string) *prometheus.CounterVec {
+	key := fmt.Sprintf("%s_%s", subsystem, name)
+	m.RLock()
+	defer m.RUnlock()
+	return m.countvecs[key]
+}
+
 // Gauge ...
 func (m *Metrics) Gauge(subsystem, name string) prometheus.Gauge {
 	key := fmt.Sprintf("%s_%s", subsystem, name)
@@ -225,12 +309,34 @@ func (m *Metrics) SummaryVec(subsystem, name string) *prometheus.SummaryVec {
 
 // Handler ...
 func (m *Metrics) Handler() http.Handler {
-	return promhttp.Handler()
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Serve serves the metrics endpoint on listener, requiring basic auth
+// if config has a username.
+func (m *Metrics) Serve(listener net.Listener, config MetricsConfig) error {
+	mux := http.NewServeMux()
+	mux.Handle("/", m.Handler())
+
+	var handler http.Handler = mux
+	if config.Username != "" {
+		handler = basicAuth(handler, config.Username, config.PasswordBytes())
+	}
+
+	log.Infof("metrics endpoint listening on %s", listener.Addr())
+	return http.Serve(listener, handler)
 }
 
-// Run ...
-func (m *Metrics) Run(addr string) {
-	http.Handle("/", m.Handler())
-	log.Infof("metrics endpoint listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+// basicAuth wraps handler to require username and a password matching
+// the bcrypt hash.
+func basicAuth(handler http.Handler, username string, hash []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != username || ComparePassword(hash, []byte(password)) != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
 }
@@ -14,11 +14,13 @@ func TestMetrics(t *testing.T) {
 	m := NewMetrics("test")
 	m.NewCounter("foo", "counter", "help")
 	m.NewCounterFunc("foo", "counter_func", "help", func() float64 { return 1.0 })
+	m.NewCounterVec("foo", "counter_vec", "help", []string{"test"})
 	m.NewGauge("foo", "gauge", "help")
 	m.NewGaugeFunc("foo", "gauge_func", "help", func() float64 { return 1.0 })
 	m.NewGaugeVec("foo", "gauge_vec", "help", []string{"test"})
 
 	m.Counter("foo", "counter").Inc()
+	m.CounterVec("foo", "counter_vec").WithLabelValues("test").Inc()
 	m.Gauge("foo", "gauge").Add(1)
 	m.GaugeVec("foo", "gauge_vec").WithLabelValues("test").Add(1)
 
@@ -36,6 +38,9 @@ test_foo_counter 1
 # HELP test_foo_counter_func help
 # TYPE test_foo_counter_func counter
 test_foo_counter_func 1
+# HELP test_foo_counter_vec help
+# TYPE test_foo_counter_vec counter
+test_foo_counter_vec{test="test"} 1
 # HELP test_foo_gauge help
 # TYPE test_foo_gauge gauge
 test_foo_gauge 1
@@ -49,3 +54,45 @@ test_foo_gauge_vec{test="test"} 1
 		w.Body.String(),
 	)
 }
+
+func TestMetricsRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	// each Metrics has its own registry, so servers don't clash
+	a := NewMetrics("test")
+	b := NewMetrics("test")
+	a.NewCounter("foo", "counter", "help").Inc()
+	b.NewCounter("foo", "counter", "help")
+
+	w := httptest.NewRecorder()
+	b.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Contains(w.Body.String(), "\ntest_foo_counter 0\n")
+	assert.Contains(w.Body.String(), "go_goroutines")
+}
+
+func TestMetricsBasicAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	hash, err := DecodePassword("JDJhJDA0JGtUU1JVc1JOUy9DbEh1WEdvYVlMdGVnclp6YnA3NDBOZGY1WUZhdTZtRzVmb1VKdXQ5ckZD")
+	assert.NoError(err)
+
+	handler := basicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), "prometheus", hash)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("prometheus", "wrong")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("prometheus", "admin")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+}
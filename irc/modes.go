@@ -1,6 +1,7 @@
 package irc
 
 import (
+	"sort"
 	"strings"
 )
 
@@ -38,6 +39,46 @@ func (modes ChannelModes) String() string {
 	return strings.Join(strs, "")
 }
 
+// ChannelModeType is how a channel mode takes an argument, in the order
+// the types are listed in the CHANMODES ISUPPORT token.
+type ChannelModeType int
+
+const (
+	ListModeType   ChannelModeType = iota // a list, always with an argument
+	ArgModeType                           // always with an argument
+	SetArgModeType                        // with an argument when set
+	FlagModeType                          // never with an argument
+)
+
+// Type returns how the mode takes an argument. Member modes aren't
+// advertised in CHANMODES and are reported as always taking one.
+func (mode ChannelMode) Type() ChannelModeType {
+	switch mode {
+	case BanMask, ExceptMask, InviteMask, QuietMask:
+		return ListModeType
+	case Key, ChannelOwner, ChannelAdmin, ChannelOperator, HalfOp, Voice:
+		return ArgModeType
+	case FloodLimitMode, Forward, JoinThrottleMode, PlaybackMode, UserLimit:
+		return SetArgModeType
+	}
+	return FlagModeType
+}
+
+// ChanModes returns the value of the CHANMODES ISUPPORT token: the
+// modes grouped by type, each group sorted.
+func (modes ChannelModes) ChanModes() string {
+	groups := make([][]string, FlagModeType+1)
+	for _, mode := range modes {
+		groups[mode.Type()] = append(groups[mode.Type()], mode.String())
+	}
+	strs := make([]string, len(groups))
+	for index, group := range groups {
+		sort.Strings(group)
+		strs[index] = strings.Join(group, "")
+	}
+	return strings.Join(strs, ",")
+}
+
 type ModeOp rune
 
 func (op ModeOp) String() string {
@@ -51,19 +92,21 @@ const (
 )
 
 const (
-	Away       UserMode = 'a' // not a real user mode (flag)
-	Invisible  UserMode = 'i'
-	Operator   UserMode = 'o'
-	WallOps    UserMode = 'w'
-	Registered UserMode = 'r' // not a real user mode (flag)
-	SecureConn UserMode = 'z'
-	SecureOnly UserMode = 'Z'
-	HostMask   UserMode = 'x'
+	Away           UserMode = 'a' // not a real user mode (flag)
+	Invisible      UserMode = 'i'
+	Operator       UserMode = 'o'
+	WallOps        UserMode = 'w'
+	Registered     UserMode = 'r' // not a real user mode (flag)
+	SecureConn     UserMode = 'z'
+	SecureOnly     UserMode = 'Z'
+	HostMask       UserMode = 'x'
+	CallerID       UserMode = 'g'
+	RegisteredOnly UserMode = 'R'
 )
 
 var (
 	SupportedUserModes = UserModes{
-		Invisible, Operator, HostMask,
+		Invisible, Operator, HostMask, CallerID, RegisteredOnly,
 	}
 	DefaultChannelModes = ChannelModes{
 		NoOutside, OpOnlyTopic,
@@ -71,27 +114,54 @@ var (
 )
 
 const (
-	BanMask         ChannelMode = 'b' // arg
-	ChannelCreator  ChannelMode = 'O' // flag
-	ChannelOperator ChannelMode = 'o' // arg
-	ExceptMask      ChannelMode = 'e' // arg
-	InviteMask      ChannelMode = 'I' // arg
-	InviteOnly      ChannelMode = 'i' // flag
-	Key             ChannelMode = 'k' // flag arg
-	Moderated       ChannelMode = 'm' // flag
-	NoOutside       ChannelMode = 'n' // flag
-	OpOnlyTopic     ChannelMode = 't' // flag
-	Private         ChannelMode = 'p' // flag
-	Secret          ChannelMode = 's' // flag, deprecated
-	UserLimit       ChannelMode = 'l' // flag arg
-	Voice           ChannelMode = 'v' // arg
-	SecureChan      ChannelMode = 'Z' // arg
+	BanMask          ChannelMode = 'b' // arg
+	ChannelAdmin     ChannelMode = 'a' // arg
+	ChannelCreator   ChannelMode = 'O' // flag
+	ChannelOperator  ChannelMode = 'o' // arg
+	ChannelOwner     ChannelMode = 'Y' // arg
+	ExceptMask       ChannelMode = 'e' // arg
+	FloodLimitMode   ChannelMode = 'f' // flag arg
+	Forward          ChannelMode = 'F' // flag arg
+	HalfOp           ChannelMode = 'h' // arg
+	InviteMask       ChannelMode = 'I' // arg
+	InviteOnly       ChannelMode = 'i' // flag
+	JoinThrottleMode ChannelMode = 'j' // flag arg
+	Key              ChannelMode = 'k' // flag arg
+	Moderated        ChannelMode = 'm' // flag
+	NoColor          ChannelMode = 'c' // flag
+	NoCTCP           ChannelMode = 'C' // flag
+	NoNotice         ChannelMode = 'T' // flag
+	NoOutside        ChannelMode = 'n' // flag
+	OpOnlyTopic      ChannelMode = 't' // flag
+	PlaybackMode     ChannelMode = 'H' // flag arg
+	Private          ChannelMode = 'p' // flag
+	QuietMask        ChannelMode = 'q' // arg
+	Secret           ChannelMode = 's' // flag, deprecated
+	UserLimit        ChannelMode = 'l' // flag arg
+	Voice            ChannelMode = 'v' // arg
+	SecureChan       ChannelMode = 'Z' // arg
+	StripFormatting  ChannelMode = 'S' // flag
 )
 
 var (
 	SupportedChannelModes = ChannelModes{
-		BanMask, ExceptMask, InviteMask, InviteOnly, Key, NoOutside,
-		OpOnlyTopic, Private, UserLimit, Secret, SecureChan,
+		BanMask, ExceptMask, FloodLimitMode, Forward, InviteMask, InviteOnly,
+		JoinThrottleMode, Key, Moderated, NoColor, NoCTCP, NoNotice, NoOutside,
+		OpOnlyTopic, PlaybackMode, Private, QuietMask, UserLimit, Secret,
+		SecureChan, StripFormatting,
+	}
+
+	// MemberModes are the modes given to channel members, from the most
+	// to the least privileged.
+	MemberModes = ChannelModes{
+		ChannelOwner, ChannelAdmin, ChannelOperator, HalfOp, Voice,
+	}
+	MemberPrefixes = map[ChannelMode]string{
+		ChannelOwner:    "~",
+		ChannelAdmin:    "&",
+		ChannelOperator: "@",
+		HalfOp:          "%",
+		Voice:           "+",
 	}
 )
 
@@ -117,7 +187,7 @@ func (m *ModeCommand) HandleServer(s *Server) {
 
 	for _, change := range m.changes {
 		switch change.mode {
-		case Invisible, HostMask, WallOps, SecureOnly:
+		case Invisible, HostMask, WallOps, SecureOnly, CallerID, RegisteredOnly:
 			switch change.op {
 			case Add:
 				if target.modes.Has(change.mode) {
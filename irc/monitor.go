@@ -0,0 +1,204 @@
+package irc
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultMaxMonitor = 100
+)
+
+var (
+	ErrMonitorListFull = errors.New("monitor list is full")
+)
+
+// MonitorSet is the nicks clients MONITOR, indexed by the watched nick
+// so that a nick going on or offline is told to its watchers without
+// looking at every client.
+type MonitorSet struct {
+	sync.RWMutex
+	watching map[*Client]map[Name]Name
+	watchers map[Name]map[*Client]bool
+}
+
+func NewMonitorSet() *MonitorSet {
+	return &MonitorSet{
+		watching: make(map[*Client]map[Name]Name),
+		watchers: make(map[Name]map[*Client]bool),
+	}
+}
+
+// Add adds nick to the nicks client watches, unless it already
+// watches max nicks.
+func (set *MonitorSet) Add(client *Client, nick Name, max int) error {
+	set.Lock()
+	defer set.Unlock()
+	key := nick.ToLower()
+	if _, ok := set.watching[client][key]; ok {
+		return nil
+	}
+	if len(set.watching[client]) >= max {
+		return ErrMonitorListFull
+	}
+	if set.watching[client] == nil {
+		set.watching[client] = make(map[Name]Name)
+	}
+	set.watching[client][key] = nick
+	if set.watchers[key] == nil {
+		set.watchers[key] = make(map[*Client]bool)
+	}
+	set.watchers[key][client] = true
+	return nil
+}
+
+func (set *MonitorSet) Remove(client *Client, nick Name) {
+	set.Lock()
+	defer set.Unlock()
+	set.remove(client, nick.ToLower())
+}
+
+// RemoveAll clears the nicks client watches.
+func (set *MonitorSet) RemoveAll(client *Client) {
+	set.Lock()
+	defer set.Unlock()
+	for key := range set.watching[client] {
+		set.remove(client, key)
+	}
+}
+
+func (set *MonitorSet) remove(client *Client, key Name) {
+	delete(set.watching[client], key)
+	if len(set.watching[client]) == 0 {
+		delete(set.watching, client)
+	}
+	delete(set.watchers[key], client)
+	if len(set.watchers[key]) == 0 {
+		delete(set.watchers, key)
+	}
+}
+
+// List returns the nicks client watches.
+func (set *MonitorSet) List(client *Client) []Name {
+	set.RLock()
+	defer set.RUnlock()
+	nicks := make([]Name, 0, len(set.watching[client]))
+	for _, nick := range set.watching[client] {
+		nicks = append(nicks, nick)
+	}
+	return nicks
+}
+
+// Watchers returns the clients watching nick.
+func (set *MonitorSet) Watchers(nick Name) []*Client {
+	set.RLock()
+	defer set.RUnlock()
+	watchers := make([]*Client, 0, len(set.watchers[nick.ToLower()]))
+	for client := range set.watchers[nick.ToLower()] {
+		watchers = append(watchers, client)
+	}
+	return watchers
+}
+
+// monitorOnline tells the clients watching client's nick that it is
+// online.
+func (server *Server) monitorOnline(client *Client) {
+	for _, watcher := range server.monitors.Watchers(client.nick) {
+		watcher.RplMonOnline([]string{client.Id().String()})
+	}
+}
+
+// monitorOffline tells the clients watching nick that it is offline.
+func (server *Server) monitorOffline(nick Name) {
+	for _, watcher := range server.monitors.Watchers(nick) {
+		watcher.RplMonOffline([]string{nick.String()})
+	}
+}
+
+// monitorReplies returns code replies to target listing items,
+// separated by commas and split to fit in a line.
+func monitorReplies(target *Client, code NumericCode, items []string) []string {
+	baseLen := len(NewNumericReply(target, code, ":"))
+	var replies []string
+	var line []string
+	lineLen := baseLen
+	for _, item := range items {
+		if len(line) > 0 && lineLen+1+len(item) > MAX_REPLY_LEN {
+			replies = append(replies, NewNumericReply(target, code, ":%s", strings.Join(line, ",")))
+			line, lineLen = nil, baseLen
+		}
+		if len(line) > 0 {
+			lineLen++
+		}
+		line = append(line, item)
+		lineLen += len(item)
+	}
+	if len(line) > 0 {
+		replies = append(replies, NewNumericReply(target, code, ":%s", strings.Join(line, ",")))
+	}
+	return replies
+}
+
+// monitorStatus sends client which of nicks are online and offline.
+func (server *Server) monitorStatus(client *Client, nicks []Name) {
+	var online, offline []string
+	for _, nick := range nicks {
+		if target := server.clients.Get(nick); target != nil && target.registered {
+			online = append(online, target.Id().String())
+		} else {
+			offline = append(offline, nick.String())
+		}
+	}
+	for _, reply := range monitorReplies(client, RPL_MONONLINE, online) {
+		client.Respond(reply)
+	}
+	for _, reply := range monitorReplies(client, RPL_MONOFFLINE, offline) {
+		client.Respond(reply)
+	}
+}
+
+func (msg *MonitorCommand) HandleServer(server *Server) {
+	client := msg.Client()
+
+	switch msg.subCommand {
+	case "+":
+		max := client.class.MaxMonitor()
+		var added []Name
+		for i, nick := range msg.targets {
+			if !nick.IsNickname() {
+				continue
+			}
+			if err := server.monitors.Add(client, nick, max); err != nil {
+				client.ErrMonListFull(max, msg.targets[i:])
+				break
+			}
+			added = append(added, nick)
+		}
+		server.monitorStatus(client, added)
+
+	case "-":
+		for _, nick := range msg.targets {
+			server.monitors.Remove(client, nick)
+		}
+
+	case "C":
+		server.monitors.RemoveAll(client)
+
+	case "L":
+		var nicks []string
+		for _, nick := range server.monitors.List(client) {
+			nicks = append(nicks, nick.String())
+		}
+		for _, reply := range monitorReplies(client, RPL_MONLIST, nicks) {
+			client.Respond(reply)
+		}
+		client.RplEndOfMonList()
+
+	case "S":
+		server.monitorStatus(client, server.monitors.List(client))
+
+	default:
+		client.ErrUnknownCommand(MONITOR)
+	}
+}
@@ -0,0 +1,32 @@
+package irc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonitorSet(t *testing.T) {
+	assert := assert.New(t)
+
+	set := NewMonitorSet()
+	alice, bob := &Client{}, &Client{}
+
+	assert.NoError(set.Add(alice, "Carol", 2))
+	assert.NoError(set.Add(alice, "carol", 2))
+	assert.NoError(set.Add(alice, "dave", 2))
+	assert.Equal(ErrMonitorListFull, set.Add(alice, "erin", 2))
+	assert.NoError(set.Add(bob, "CAROL", 2))
+
+	assert.ElementsMatch([]Name{"Carol", "dave"}, set.List(alice))
+	assert.ElementsMatch([]*Client{alice, bob}, set.Watchers("carol"))
+
+	set.Remove(alice, "CAROL")
+	assert.Equal([]*Client{bob}, set.Watchers("carol"))
+
+	set.RemoveAll(alice)
+	assert.Empty(set.List(alice))
+	assert.Empty(set.Watchers("dave"))
+	assert.Len(set.watching, 1)
+	assert.Len(set.watchers, 1)
+}
@@ -1,7 +1,9 @@
 package irc
 
 import (
+	"context"
 	"net"
+	"os"
 	"strings"
 )
 
@@ -14,18 +16,30 @@ func IPString(addr net.Addr) Name {
 	return Name(ipaddr)
 }
 
+// ListenAddr listens on addr, a TCP address or "unix:" followed by the
+// path of a unix socket. A stale socket file is removed first.
+func ListenAddr(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
 func AddrLookupHostname(addr net.Addr) Name {
 	return LookupHostname(IPString(addr))
 }
 
+// LookupHostname returns the forward-confirmed hostname of addr, or
+// addr itself if it has none or the lookup times out.
 func LookupHostname(addr Name) Name {
-	names, err := net.LookupAddr(addr.String())
-	if err != nil {
-		return Name(addr)
-	}
-
-	hostname := strings.TrimSuffix(names[0], ".")
-	return Name(hostname)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultDNSTimeout)
+	defer cancel()
+	hostname, _ := LookupHostnameContext(ctx, addr)
+	return hostname
 }
 
 var allowedHostnameChars = "abcdefghijklmnopqrstuvwxyz1234567890-."
@@ -18,13 +18,20 @@ func (m *NickCommand) HandleRegServer(s *Server) {
 		return
 	}
 
-	if s.clients.Get(m.nickname) != nil {
-		client.ErrNickNameInUse(m.nickname)
+	if !m.nickname.IsNickname() {
+		client.ErrErroneusNickname(m.nickname)
 		return
 	}
 
-	if !m.nickname.IsNickname() {
-		client.ErrErroneusNickname(m.nickname)
+	if holder := s.clients.Get(m.nickname); holder != nil {
+		if !s.isBouncerIdentity(holder) || client.nick != "" {
+			client.ErrNickNameInUse(m.nickname)
+			return
+		}
+		// the client may be attaching to the holder, which is checked
+		// once it registers.
+		client.nick = m.nickname
+		s.tryRegister(client)
 		return
 	}
 
@@ -0,0 +1,117 @@
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidPlayback = errors.New("playback must be a number of lines or a duration")
+)
+
+// Playback is how much of a channel's history is replayed to clients
+// joining it: the last Lines messages, or those sent in the last
+// Duration, up to the channel's history limit.
+type Playback struct {
+	Lines    int
+	Duration time.Duration
+}
+
+// ParsePlayback parses a number of lines, such as "50", or a duration,
+// such as "30m".
+func ParsePlayback(str string) (Playback, error) {
+	if lines, err := strconv.Atoi(str); err == nil {
+		if lines < 0 {
+			return Playback{}, ErrInvalidPlayback
+		}
+		return Playback{Lines: lines}, nil
+	}
+	duration, err := time.ParseDuration(str)
+	if err != nil || duration <= 0 {
+		return Playback{}, ErrInvalidPlayback
+	}
+	return Playback{Duration: duration}, nil
+}
+
+func (playback Playback) IsZero() bool {
+	return playback.Lines == 0 && playback.Duration == 0
+}
+
+func (playback Playback) String() string {
+	switch {
+	case playback.Duration == 0:
+		return strconv.Itoa(playback.Lines)
+	case playback.Duration%time.Hour == 0:
+		return fmt.Sprintf("%dh", playback.Duration/time.Hour)
+	case playback.Duration%time.Minute == 0:
+		return fmt.Sprintf("%dm", playback.Duration/time.Minute)
+	}
+	return playback.Duration.String()
+}
+
+// Playback replays the channel's recent messages to client, which has
+// just joined, except to sessions that fetch history themselves with
+// CHATHISTORY.
+// Clients that support batches and server-time get the messages as
+// they were sent, others get them as NOTICEs from the server.
+func (channel *Channel) Playback(client *Client) {
+	playback := channel.server.history.Playback()
+	if channel.playback != nil {
+		playback = *channel.playback
+	}
+	if playback.IsZero() {
+		return
+	}
+
+	buffer := channel.server.history.Get(channel.name)
+	if buffer == nil {
+		return
+	}
+	limit := channel.server.history.Limit(channel.name)
+	items := buffer.All().Messages()
+	if playback.Duration > 0 {
+		items = items.Since(time.Now().Add(-playback.Duration)).Latest(nil, limit)
+	} else {
+		items = items.Latest(nil, min(playback.Lines, limit))
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	for _, session := range client.replySessions() {
+		switch {
+		case session.capabilities[ChatHistory]:
+		case session.capabilities[Batch] && session.capabilities[ServerTime]:
+			session.RplChatHistory(channel.name, items)
+		default:
+			for _, item := range items {
+				session.Reply(RplPlayback(channel, item))
+			}
+		}
+	}
+}
+
+// Source returns the prefix the event was sent with.
+func (item HistoryItem) Source() string {
+	if !strings.HasPrefix(item.Line, ":") {
+		return ""
+	}
+	source, _ := splitArg(item.Line[1:])
+	return source
+}
+
+// Message returns the nick and text of a PRIVMSG or NOTICE event.
+func (item HistoryItem) Message() (Name, string) {
+	source := item.Source()
+	if i := strings.Index(source, "!"); i >= 0 {
+		source = source[:i]
+	}
+	_, args := ParseLine(item.Line)
+	if len(args) < 2 {
+		return NewName(source), ""
+	}
+	return NewName(source), args[1]
+}
@@ -0,0 +1,227 @@
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidJoinThrottle = errors.New("join throttle must be joins:seconds")
+	ErrInvalidFloodLimit   = errors.New("flood limit must be lines:seconds[:quiet|kick|moderate]")
+)
+
+// JoinThrottle is how many clients may join a channel within Period.
+type JoinThrottle struct {
+	Joins  int
+	Period time.Duration
+}
+
+// ParseJoinThrottle parses joins:seconds, such as "5:10".
+func ParseJoinThrottle(str string) (JoinThrottle, error) {
+	count, period, err := parseRate(str)
+	if err != nil {
+		return JoinThrottle{}, ErrInvalidJoinThrottle
+	}
+	return JoinThrottle{Joins: count, Period: period}, nil
+}
+
+func (throttle JoinThrottle) String() string {
+	return fmt.Sprintf("%d:%d", throttle.Joins, throttle.Period/time.Second)
+}
+
+// FloodAction is what is done to a member that exceeds a channel's
+// flood limit.
+type FloodAction string
+
+const (
+	FloodKick     FloodAction = "kick"
+	FloodModerate FloodAction = "moderate"
+	FloodQuiet    FloodAction = "quiet"
+)
+
+// FloodLimit is how many lines a member may send to a channel within
+// Period before Action is taken.
+type FloodLimit struct {
+	Lines  int
+	Period time.Duration
+	Action FloodAction
+}
+
+// ParseFloodLimit parses lines:seconds with an optional action, such
+// as "5:10" or "5:10:quiet". The action defaults to kick.
+func ParseFloodLimit(str string) (FloodLimit, error) {
+	limit := FloodLimit{Action: FloodKick}
+	if parts := strings.SplitN(str, ":", 3); len(parts) == 3 {
+		limit.Action = FloodAction(strings.ToLower(parts[2]))
+		str = parts[0] + ":" + parts[1]
+	}
+	switch limit.Action {
+	case FloodKick, FloodModerate, FloodQuiet:
+	default:
+		return FloodLimit{}, ErrInvalidFloodLimit
+	}
+	count, period, err := parseRate(str)
+	if err != nil {
+		return FloodLimit{}, ErrInvalidFloodLimit
+	}
+	limit.Lines, limit.Period = count, period
+	return limit, nil
+}
+
+func (limit FloodLimit) String() string {
+	return fmt.Sprintf("%d:%d:%s", limit.Lines, limit.Period/time.Second, limit.Action)
+}
+
+// parseRate parses count:seconds with both positive.
+func parseRate(str string) (int, time.Duration, error) {
+	parts := strings.SplitN(str, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, ErrInvalidJoinThrottle
+	}
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count <= 0 {
+		return 0, 0, ErrInvalidJoinThrottle
+	}
+	seconds, err := strconv.Atoi(parts[1])
+	if err != nil || seconds <= 0 {
+		return 0, 0, ErrInvalidJoinThrottle
+	}
+	return count, time.Duration(seconds) * time.Second, nil
+}
+
+// channelFlood counts the joins to a channel and the lines sent by its
+// members against its join throttle and flood limit.
+type channelFlood struct {
+	sync.Mutex
+	joins *TokenBucket
+	lines map[*Client]*TokenBucket
+}
+
+func newChannelFlood() *channelFlood {
+	return &channelFlood{
+		lines: make(map[*Client]*TokenBucket),
+	}
+}
+
+// reset forgets the counts, after a limit has changed.
+func (flood *channelFlood) reset() {
+	flood.Lock()
+	defer flood.Unlock()
+	flood.joins = nil
+	flood.lines = make(map[*Client]*TokenBucket)
+}
+
+func (flood *channelFlood) remove(client *Client) {
+	flood.Lock()
+	defer flood.Unlock()
+	delete(flood.lines, client)
+}
+
+// allowJoin returns false if the channel's join throttle is exceeded,
+// and otherwise counts a join.
+func (channel *Channel) allowJoin() bool {
+	throttle := channel.joinThrottle
+	if throttle == nil {
+		return true
+	}
+	flood := channel.flood
+	flood.Lock()
+	defer flood.Unlock()
+	now := time.Now()
+	if flood.joins == nil {
+		flood.joins = NewTokenBucket(throttle.Joins, throttle.Period, now)
+	}
+	return flood.joins.Take(now)
+}
+
+// checkFlood counts a line sent by client and returns false, after
+// taking the channel's flood action, if client exceeds the flood limit.
+// Half-operators and above are exempt.
+func (channel *Channel) checkFlood(client *Client) bool {
+	limit := channel.floodLimit
+	if limit == nil || channel.ClientIsHalfOp(client) {
+		return true
+	}
+
+	flood := channel.flood
+	flood.Lock()
+	now := time.Now()
+	bucket := flood.lines[client]
+	if bucket == nil {
+		bucket = NewTokenBucket(limit.Lines, limit.Period, now)
+		flood.lines[client] = bucket
+	}
+	ok := bucket.Take(now)
+	if !ok {
+		delete(flood.lines, client)
+	}
+	flood.Unlock()
+	if ok {
+		return true
+	}
+
+	client.logger().Infof("flooding %s, action: %s", channel, limit.Action)
+	switch limit.Action {
+	case FloodKick:
+		channel.serverKick(client, NewText(fmt.Sprintf(
+			"Flooding (limit is %d lines in %d seconds)", limit.Lines, limit.Period/time.Second)))
+
+	case FloodModerate:
+		if !channel.flags.Has(Moderated) {
+			channel.flags.Set(Moderated)
+			channel.serverMode(ChannelModeChanges{
+				&ChannelModeChange{mode: Moderated, op: Add},
+			})
+		}
+
+	case FloodQuiet:
+		mask := NewName(fmt.Sprintf("*!*@%s", client.hostmask))
+		if channel.lists[QuietMask].Add(mask) {
+			channel.serverMode(ChannelModeChanges{
+				&ChannelModeChange{mode: QuietMask, op: Add, arg: mask.String()},
+			})
+		}
+	}
+	return false
+}
+
+// serverMode tells the members of mode changes made by the server.
+func (channel *Channel) serverMode(changes ChannelModeChanges) {
+	reply := NewStringReply(channel.server, MODE, "%s %s", channel, changes)
+	channel.members.Range(func(member *Client, _ *ChannelModeSet) bool {
+		member.Reply(reply)
+		return true
+	})
+}
+
+// serverKick removes target from the channel on behalf of the server.
+func (channel *Channel) serverKick(target *Client, comment Text) {
+	reply := NewStringReply(channel.server, KICK, "%s %s :%s",
+		channel, target.Nick(), comment)
+	tags := channel.record(KICK, reply)
+	channel.members.Range(func(member *Client, _ *ChannelModeSet) bool {
+		member.TaggedReply(tags, reply)
+		return true
+	})
+	channel.Quit(target)
+}
+
+// forwardJoin joins client to the channel's forward channel, if it has
+// one, after it failed to join the channel. Forwards aren't followed
+// any further, nor taken by clients at their class's channel limit.
+func (channel *Channel) forwardJoin(client *Client, forwarded bool) bool {
+	if forwarded || channel.forward == "" || client.TooManyChannels() {
+		return false
+	}
+	target := channel.server.channels.Get(channel.forward)
+	if target == nil || target == channel {
+		return false
+	}
+	client.ErrLinkChannel(channel, target)
+	target.join(client, "", true)
+	return true
+}
@@ -0,0 +1,65 @@
+package irc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJoinThrottle(t *testing.T) {
+	assert := assert.New(t)
+
+	throttle, err := ParseJoinThrottle("5:10")
+	assert.NoError(err)
+	assert.Equal(JoinThrottle{Joins: 5, Period: 10 * time.Second}, throttle)
+	assert.Equal("5:10", throttle.String())
+
+	for _, str := range []string{"", "5", "0:10", "5:0", "x:10", "5:10:kick"} {
+		_, err := ParseJoinThrottle(str)
+		assert.Equal(ErrInvalidJoinThrottle, err, str)
+	}
+}
+
+func TestParseFloodLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	limit, err := ParseFloodLimit("5:10")
+	assert.NoError(err)
+	assert.Equal(FloodLimit{Lines: 5, Period: 10 * time.Second, Action: FloodKick}, limit)
+	assert.Equal("5:10:kick", limit.String())
+
+	limit, err = ParseFloodLimit("3:2:Quiet")
+	assert.NoError(err)
+	assert.Equal(FloodQuiet, limit.Action)
+
+	for _, str := range []string{"", "5", "0:10", "5:10:ban", "5:-1:moderate"} {
+		_, err := ParseFloodLimit(str)
+		assert.Equal(ErrInvalidFloodLimit, err, str)
+	}
+}
+
+func TestForwardJoinMaxChannels(t *testing.T) {
+	assert := assert.New(t)
+	server := testBouncerServer()
+
+	client, session := testConnect(server, "")
+	testRegister(client, session, "forwarded")
+	client.handleLine(session, "JOIN #fwdfirst")
+	client.SetClass(NewClass("one", ClassConfig{MaxChannels: 1}, FloodConfig{}))
+	testSent(session)
+
+	channel := NewChannel(server, "#fwdlimit", false)
+	channel.flags.Set(InviteOnly)
+	channel.forward = "#fwdtarget"
+	target := NewChannel(server, "#fwdtarget", false)
+
+	channel.Join(client, "")
+	assert.Contains(testSent(session), " 473 forwarded #fwdlimit ")
+	assert.False(target.members.Has(client))
+
+	client.SetClass(NewClass("two", ClassConfig{MaxChannels: 2}, FloodConfig{}))
+	channel.Join(client, "")
+	assert.Contains(testSent(session), " 470 forwarded #fwdlimit #fwdtarget ")
+	assert.True(target.members.Has(client))
+}
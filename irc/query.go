@@ -0,0 +1,146 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Direct messages of clients logged in to an account are kept in the
+// history of the account's query with the other party, and messages
+// sent to an account that isn't connected are also kept in its inbox
+// until it logs in. Queries are kept under the other party's account
+// if it has one, so they follow it across nick changes, and under its
+// nick otherwise.
+
+// queryKey returns the history name of account's query with peer, an
+// account or the nick of a client that isn't logged in.
+func queryKey(account string, peer Name) Name {
+	return NewName(fmt.Sprintf("~%s:%s", account, peer))
+}
+
+// inboxKey returns the history name of account's inbox.
+func inboxKey(account string) Name {
+	return NewName("~" + account)
+}
+
+// queryPeer returns the name queries with name are kept under: the
+// account of the client using the nick name, if it's logged in to one,
+// and otherwise name itself.
+func (server *Server) queryPeer(name Name) Name {
+	if target := server.clients.Get(name); target != nil {
+		if account := target.sasl.Id(); account != "" {
+			return NewName(account)
+		}
+	}
+	return name
+}
+
+// queryTargets returns the accounts and nicks account has query
+// history with.
+func (server *Server) queryTargets(account string) []Name {
+	prefix := queryKey(account, "").ToLower()
+	var peers []Name
+	for _, key := range server.history.Targets(prefix) {
+		peers = append(peers, NewName(strings.TrimPrefix(key.String(), prefix.String())))
+	}
+	return peers
+}
+
+// recordQuery adds a direct message from client to target, logged in
+// to targetAccount if it isn't empty, to the query history of each
+// party logged in to an account and returns the tags it is sent with.
+func (server *Server) recordQuery(client *Client, target Name, targetAccount string,
+	command StringCode, reply string) MessageTags {
+	tags := NewMessageTags()
+	item := HistoryItem{
+		Time:    tags.Time,
+		MsgID:   tags.MsgID,
+		Command: command,
+		Line:    reply,
+	}
+	account := client.sasl.Id()
+	if account != "" {
+		peer := target
+		if targetAccount != "" {
+			peer = NewName(targetAccount)
+		}
+		server.history.Add(queryKey(account, peer), item)
+	}
+	if targetAccount != "" {
+		peer := client.nick
+		if account != "" {
+			peer = NewName(account)
+		}
+		server.history.Add(queryKey(targetAccount, peer), item)
+	}
+	return tags
+}
+
+// accountClient returns the registered client logged in to account,
+// or nil if there is none.
+func (server *Server) accountClient(account string) *Client {
+	var found *Client
+	server.clients.Range(func(_ Name, client *Client) bool {
+		if client.registered && client.sasl.Id() == account {
+			found = client
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// sendOffline sends a message from client to the account name, which
+// no client is using as its nick. If the account is connected under
+// another nick the message is delivered to it, otherwise it's kept for
+// delivery when the account logs in. The recipient's modes and ignore
+// lists aren't known while it's away, so only clients logged in to an
+// account may leave messages. client is sent the same reply whether or
+// not name is an account, so accounts can't be discovered this way. It
+// returns false if client isn't logged in or history is disabled.
+func (server *Server) sendOffline(client *Client, name Name, message Text) bool {
+	account := name.String()
+	if client.sasl.Id() == "" || !server.history.Enabled() {
+		return false
+	}
+
+	reply := NewStringReply(client, PRIVMSG, "%s :%s", name, message)
+	var tags MessageTags
+	if target := server.accountClient(account); target != nil {
+		tags = server.recordQuery(client, name, account, PRIVMSG, reply)
+		if client.CanSpeak(target) && target.AcceptsFrom(client) {
+			server.metrics.Counter("client", "messages").Inc()
+			target.TaggedReply(tags, RplPrivMsg(client, target, message))
+		}
+	} else if _, ok := server.accountStore().Get(account); ok {
+		tags = server.recordQuery(client, name, account, PRIVMSG, reply)
+		server.history.Add(inboxKey(account), HistoryItem{
+			Time:    tags.Time,
+			MsgID:   tags.MsgID,
+			Command: PRIVMSG,
+			Line:    reply,
+		})
+	} else {
+		tags = server.recordQuery(client, name, "", PRIVMSG, reply)
+	}
+	client.Echo(tags, reply)
+	client.Respond(RplNotice(server, client, NewText(fmt.Sprintf(
+		"No one is using the nick %s; if it's an account, your message will be delivered to it", name))))
+	return true
+}
+
+// deliverInbox sends a client that has just registered the messages
+// kept for its account while it wasn't connected.
+func (server *Server) deliverInbox(client *Client) {
+	account := client.sasl.Id()
+	if account == "" {
+		return
+	}
+	// the messages were sent to the account name, so they're rebuilt
+	// as sent to the client's nick
+	for _, item := range server.history.Take(inboxKey(account)) {
+		_, text := item.Message()
+		client.TaggedReply(item.Tags(), fmt.Sprintf(":%s %s %s :%s",
+			item.Source(), item.Command, client.nick, text))
+	}
+}
@@ -0,0 +1,58 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrivMsgOffline(t *testing.T) {
+	assert := assert.New(t)
+	server := testBouncerServer()
+
+	recipient, recipientSession := testConnect(server, "away")
+	testRegister(recipient, recipientSession, "elsewhere")
+	testSent(recipientSession)
+
+	anon, anonSession := testConnect(server, "")
+	testRegister(anon, anonSession, "anon")
+	testSent(anonSession)
+	anon.handleLine(anonSession, "PRIVMSG away :hello")
+	assert.Contains(testSent(anonSession), " 401 anon away ")
+
+	// the account is online under another nick, which isn't revealed
+	sender, senderSession := testConnect(server, "sender")
+	testRegister(sender, senderSession, "sender")
+	testSent(senderSession)
+	sender.handleLine(senderSession, "PRIVMSG away :hello")
+	online := testSent(senderSession)
+	assert.NotContains(online, "elsewhere")
+	assert.Contains(testSent(recipientSession), " PRIVMSG elsewhere :hello")
+	assert.Equal(1, server.history.Get(queryKey("away", "sender")).Len())
+	assert.Equal(1, server.history.Get(queryKey("sender", "away")).Len())
+
+	// accounts can't be told apart from other names by the reply
+	sender.handleLine(senderSession, "PRIVMSG offline :hi PRIVMSG offline :there")
+	offline := testSent(senderSession)
+	sender.handleLine(senderSession, "PRIVMSG nobody :hi PRIVMSG nobody :there")
+	nobody := testSent(senderSession)
+	assert.NotEmpty(notice(nobody, "nobody"))
+	assert.Equal(notice(offline, "offline"), notice(nobody, "nobody"))
+	assert.Equal(notice(online, "away"), notice(nobody, "nobody"))
+
+	later, laterSession := testConnect(server, "offline")
+	testRegister(later, laterSession, "later")
+	assert.Contains(testSent(laterSession), " PRIVMSG later :hi PRIVMSG offline :there")
+	assert.Nil(server.history.Get(inboxKey("nobody")))
+}
+
+// notice returns the notice in lines with name replaced.
+func notice(lines string, name string) string {
+	for _, line := range strings.Split(lines, "\n") {
+		if strings.Contains(line, " NOTICE ") {
+			return strings.Replace(line, name, "*", -1)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,145 @@
+package irc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// READ_MARKERS_FILE is the file read markers are saved to in the
+	// history dir.
+	READ_MARKERS_FILE = "readmarkers.json"
+)
+
+// ReadMarkers are the times up to which accounts have read their
+// channels and queries, shared by all of an account's clients.
+type ReadMarkers struct {
+	sync.RWMutex
+	path    string
+	markers map[string]map[Name]time.Time
+}
+
+// NewReadMarkers returns read markers saved to dir, or kept in memory
+// if dir is empty.
+func NewReadMarkers(dir string) *ReadMarkers {
+	markers := &ReadMarkers{
+		markers: make(map[string]map[Name]time.Time),
+	}
+	if dir == "" {
+		return markers
+	}
+	markers.path = filepath.Join(dir, READ_MARKERS_FILE)
+	data, err := ioutil.ReadFile(markers.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("error loading read markers: %s", err)
+		}
+		return markers
+	}
+	if err := json.Unmarshal(data, &markers.markers); err != nil {
+		log.Warnf("error loading read markers: %s", err)
+	}
+	return markers
+}
+
+// Get returns the read marker of account's target, or the zero time
+// if it has none.
+func (markers *ReadMarkers) Get(account string, target Name) time.Time {
+	markers.RLock()
+	defer markers.RUnlock()
+	return markers.markers[account][target.ToLower()]
+}
+
+// Set moves the read marker of account's target forward to t and
+// returns the marker, which is unchanged if t is before it.
+func (markers *ReadMarkers) Set(account string, target Name, t time.Time) time.Time {
+	markers.Lock()
+	defer markers.Unlock()
+	key := target.ToLower()
+	if !t.After(markers.markers[account][key]) {
+		return markers.markers[account][key]
+	}
+	if markers.markers[account] == nil {
+		markers.markers[account] = make(map[Name]time.Time)
+	}
+	markers.markers[account][key] = t
+	if markers.path != "" {
+		if err := markers.save(); err != nil {
+			log.Warnf("error saving read markers: %s", err)
+		}
+	}
+	return t
+}
+
+// Snapshot returns the read markers if they are not saved.
+func (markers *ReadMarkers) Snapshot() map[string]map[Name]time.Time {
+	markers.RLock()
+	defer markers.RUnlock()
+	if markers.path != "" {
+		return nil
+	}
+	snapshot := make(map[string]map[Name]time.Time, len(markers.markers))
+	for account, targets := range markers.markers {
+		snapshot[account] = make(map[Name]time.Time, len(targets))
+		for target, t := range targets {
+			snapshot[account][target] = t
+		}
+	}
+	return snapshot
+}
+
+// Restore sets the read markers of a snapshot.
+func (markers *ReadMarkers) Restore(snapshot map[string]map[Name]time.Time) {
+	for account, targets := range snapshot {
+		for target, t := range targets {
+			markers.Set(account, target, t)
+		}
+	}
+}
+
+func (markers *ReadMarkers) save() error {
+	data, err := json.Marshal(markers.markers)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(markers.path), ".readmarkers-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), markers.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// RplMarkRead sends the client's read marker of target to the sessions
+// responses are sent to that have the read-marker capability.
+func (target *Client) RplMarkRead(name Name) {
+	account := target.sasl.Id()
+	if account == "" {
+		return
+	}
+	timestamp := "*"
+	if t := target.server.markers.Get(account, name); !t.IsZero() {
+		timestamp = "timestamp=" + FormatServerTime(t)
+	}
+	reply := NewStringReply(target.server, MARKREAD, "%s %s", name, timestamp)
+	for _, session := range target.replySessions() {
+		if session.capabilities[ReadMarker] {
+			session.Reply(reply)
+		}
+	}
+}
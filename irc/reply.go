@@ -53,7 +53,7 @@ func NewNumericReply(target *Client, code NumericCode,
 
 func (target *Client) NumericReply(code NumericCode,
 	format string, args ...interface{}) {
-	target.Reply(NewNumericReply(target, code, format, args...))
+	target.Respond(NewNumericReply(target, code, format, args...))
 }
 
 //
@@ -107,10 +107,38 @@ func RplNotice(source Identifiable, target Identifiable, message Text) string {
 	return NewStringReply(source, NOTICE, "%s :%s", target.Nick(), message)
 }
 
+// RplPlayback formats a message replayed to a client joining channel
+// as a notice from the server.
+func RplPlayback(channel *Channel, item HistoryItem) string {
+	format := "15:04:05"
+	if time.Since(item.Time) > 24*time.Hour {
+		format = "2006-01-02 15:04:05"
+	}
+	nick, text := item.Message()
+	switch {
+	case strings.HasPrefix(text, "\x01ACTION ") && strings.HasSuffix(text, "\x01"):
+		text = fmt.Sprintf("* %s %s", nick, text[len("\x01ACTION "):len(text)-1])
+	case item.Command == NOTICE:
+		text = fmt.Sprintf("-%s- %s", nick, text)
+	default:
+		text = fmt.Sprintf("<%s> %s", nick, text)
+	}
+	return RplNotice(channel.server, channel, NewText(fmt.Sprintf("[%s] %s",
+		item.Time.UTC().Format(format), text)))
+}
+
 func RplNick(source Identifiable, newNick Name) string {
 	return NewStringReply(source, NICK, newNick.String())
 }
 
+func RplChgHost(client *Client, hostname Name) string {
+	username := "*"
+	if client.username != "" {
+		username = client.username.String()
+	}
+	return NewStringReply(client, CHGHOST, "%s %s", username, hostname)
+}
+
 func RplJoin(client *Client, channel *Channel) string {
 	return NewStringReply(client, JOIN, channel.name.String())
 }
@@ -153,6 +181,11 @@ func RplInviteMsg(inviter *Client, invitee *Client, channel Name) string {
 	return NewStringReply(inviter, INVITE, "%s :%s", invitee.Nick(), channel)
 }
 
+// RplSilence confirms a change to client's silence list.
+func RplSilence(client *Client, op ModeOp, mask Name) string {
+	return NewStringReply(client, SILENCE, "%s%s", op, mask)
+}
+
 func RplKick(channel *Channel, client *Client, target *Client, comment Text) string {
 	return NewStringReply(client, KICK, "%s %s :%s",
 		channel, target.Nick(), comment)
@@ -170,6 +203,70 @@ func RplCap(client *Client, subCommand CapSubCommand, arg interface{}) string {
 	return NewStringReply(client.server, CAP, "%s %s :%s", client.Nick(), subCommand, arg)
 }
 
+func RplFail(server *Server, command StringCode, code string, context string,
+	description string) string {
+	return NewStringReply(server, FAIL, "%s %s %s :%s",
+		command, code, context, description)
+}
+
+func RplBatchStart(server *Server, ref string, kind string, params ...string) string {
+	return NewStringReply(server, BATCH, "+%s %s",
+		ref, strings.Join(append([]string{kind}, params...), " "))
+}
+
+func RplBatchEnd(server *Server, ref string) string {
+	return NewStringReply(server, BATCH, "-%s", ref)
+}
+
+func RplStartTLS(client *Client) string {
+	return NewNumericReply(client, RPL_STARTTLS,
+		":STARTTLS successful, proceed with TLS handshake")
+}
+
+// batches
+
+// RplChatHistory sends the events of name's history in a chathistory
+// batch, if the client supports batches.
+func (target *Client) RplChatHistory(name Name, items HistoryItems) {
+	for _, session := range target.replySessions() {
+		session.RplChatHistory(name, items)
+	}
+}
+
+func (session *Session) RplChatHistory(name Name, items HistoryItems) {
+	server := session.client.server
+	ref := NewBatchID()
+	if session.capabilities[Batch] {
+		session.Reply(RplBatchStart(server, ref, "chathistory", name.String()))
+	}
+	for _, item := range items {
+		tags := item.Tags()
+		tags.Batch = ref
+		session.TaggedReply(tags, item.Line)
+	}
+	if session.capabilities[Batch] {
+		session.Reply(RplBatchEnd(server, ref))
+	}
+}
+
+// RplChatHistoryTargets sends the targets in a chathistory-targets
+// batch with the time of their latest message.
+func (target *Client) RplChatHistoryTargets(targets []HistoryTarget) {
+	session := target.session()
+	ref := NewBatchID()
+	if session.capabilities[Batch] {
+		session.Reply(RplBatchStart(target.server, ref, "draft/chathistory-targets"))
+	}
+	tags := MessageTags{Batch: ref}
+	for _, t := range targets {
+		session.TaggedReply(tags, NewStringReply(target.server, CHATHISTORY,
+			"TARGETS %s %s", t.Name, FormatServerTime(t.Time)))
+	}
+	if session.capabilities[Batch] {
+		session.Reply(RplBatchEnd(target.server, ref))
+	}
+}
+
 // numeric replies
 
 func (target *Client) RplWelcome() {
@@ -185,7 +282,7 @@ func (target *Client) RplYourHost() {
 	target.NumericReply(
 		RPL_YOURHOST,
 		":Your host is %s, running %s",
-		target.server.name,
+		target.server.Id(),
 		FullVersion(),
 	)
 }
@@ -199,13 +296,26 @@ func (target *Client) RplMyInfo() {
 	target.NumericReply(
 		RPL_MYINFO,
 		"%s %s %s %s",
-		target.server.name,
+		target.server.Id(),
 		FullVersion(),
 		SupportedUserModes,
 		SupportedChannelModes,
 	)
 }
 
+// RplISupport sends the server's ISUPPORT tokens, as many per line as
+// clients are required to accept.
+func (target *Client) RplISupport() {
+	tokens := append(target.server.ISupport(),
+		fmt.Sprintf("MONITOR=%d", target.class.MaxMonitor()))
+	for len(tokens) > 0 {
+		n := min(len(tokens), 13)
+		target.NumericReply(RPL_ISUPPORT,
+			"%s :are supported by this server", strings.Join(tokens[:n], " "))
+		tokens = tokens[n:]
+	}
+}
+
 func (target *Client) RplUModeIs(client *Client) {
 	target.NumericReply(RPL_UMODEIS, client.ModeString())
 }
@@ -238,12 +348,18 @@ func (target *Client) RplYoureOper() {
 		":You are now an IRC operator")
 }
 
+// <hostname> :is now your displayed host
+func (target *Client) RplHostHidden(hostname Name) {
+	target.NumericReply(RPL_HOSTHIDDEN,
+		"%s :is now your displayed host", hostname)
+}
+
 // <config file> :Rehashing
 func (target *Client) RplRehashing() {
 	target.NumericReply(
 		RPL_REHASHING,
 		"%s :Rehashing",
-		target.server.config.Name(),
+		target.server.Config().Name(),
 	)
 }
 
@@ -260,6 +376,9 @@ func (target *Client) RplWhois(client *Client) {
 	}
 	target.RplWhoisServer(client)
 	target.RplWhoisLoggedIn(client)
+	if target.modes.Has(Operator) {
+		target.RplWhoisClass(client)
+	}
 	target.RplEndOfWhois(client)
 }
 
@@ -314,6 +433,15 @@ func (target *Client) RplWhoisLoggedIn(client *Client) {
 	)
 }
 
+func (target *Client) RplWhoisClass(client *Client) {
+	target.NumericReply(
+		RPL_WHOISSPECIAL,
+		"%s :is connected in class %s",
+		client.Nick(),
+		client.class,
+	)
+}
+
 func (target *Client) RplWhoisServer(client *Client) {
 	target.NumericReply(
 		RPL_WHOISSERVER,
@@ -362,20 +490,7 @@ func (target *Client) RplWhoReply(channel *Channel, client *Client) {
 
 	if channel != nil {
 		channelName = channel.name.String()
-		if target.capabilities[MultiPrefix] {
-			if channel.members.Get(client).Has(ChannelOperator) {
-				flags += "@"
-			}
-			if channel.members.Get(client).Has(Voice) {
-				flags += "+"
-			}
-		} else {
-			if channel.members.Get(client).Has(ChannelOperator) {
-				flags += "@"
-			} else if channel.members.Get(client).Has(Voice) {
-				flags += "+"
-			}
-		}
+		flags += channel.Prefixes(client, target.HasCapability(MultiPrefix))
 	}
 	target.NumericReply(
 		RPL_WHOREPLY,
@@ -383,7 +498,7 @@ func (target *Client) RplWhoReply(channel *Channel, client *Client) {
 		channelName,
 		client.username,
 		clientHost,
-		client.server.name,
+		client.server.Id(),
 		client.Nick(),
 		flags,
 		client.hops,
@@ -407,6 +522,9 @@ func (target *Client) RplMaskList(mode ChannelMode, channel *Channel, mask Name)
 
 	case InviteMask:
 		target.RplInviteList(channel, mask)
+
+	case QuietMask:
+		target.RplQuietList(channel, mask)
 	}
 }
 
@@ -420,6 +538,9 @@ func (target *Client) RplEndOfMaskList(mode ChannelMode, channel *Channel) {
 
 	case InviteMask:
 		target.RplEndOfInviteList(channel)
+
+	case QuietMask:
+		target.RplEndOfQuietList(channel)
 	}
 }
 
@@ -433,6 +554,16 @@ func (target *Client) RplEndOfBanList(channel *Channel) {
 		"%s :End of channel ban list", channel)
 }
 
+func (target *Client) RplQuietList(channel *Channel, mask Name) {
+	target.NumericReply(RPL_QUIETLIST,
+		"%s %s %s", channel, QuietMask, mask)
+}
+
+func (target *Client) RplEndOfQuietList(channel *Channel) {
+	target.NumericReply(RPL_ENDOFQUIETLIST,
+		"%s %s :End of channel quiet list", channel, QuietMask)
+}
+
 func (target *Client) RplExceptList(channel *Channel, mask Name) {
 	target.NumericReply(RPL_EXCEPTLIST,
 		"%s %s", channel, mask)
@@ -473,9 +604,63 @@ func (target *Client) RplIsOn(nicks []string) {
 		":%s", strings.Join(nicks, " "))
 }
 
+// RplMonOnline tells target that the clients identified by ids, which
+// it monitors, are online.
+func (target *Client) RplMonOnline(ids []string) {
+	for _, reply := range monitorReplies(target, RPL_MONONLINE, ids) {
+		target.Reply(reply)
+	}
+}
+
+// RplMonOffline tells target that nicks, which it monitors, are
+// offline.
+func (target *Client) RplMonOffline(nicks []string) {
+	for _, reply := range monitorReplies(target, RPL_MONOFFLINE, nicks) {
+		target.Reply(reply)
+	}
+}
+
+func (target *Client) RplEndOfMonList() {
+	target.NumericReply(RPL_ENDOFMONLIST,
+		":End of MONITOR list")
+}
+
+func (target *Client) RplAcceptList(nick Name) {
+	target.NumericReply(RPL_ACCEPTLIST,
+		":%s", nick)
+}
+
+func (target *Client) RplEndOfAccept() {
+	target.NumericReply(RPL_ENDOFACCEPT,
+		":End of /ACCEPT list")
+}
+
+func (target *Client) RplSileList(mask Name) {
+	target.NumericReply(RPL_SILELIST,
+		"%s %s", target.Nick(), mask)
+}
+
+func (target *Client) RplEndOfSileList() {
+	target.NumericReply(RPL_ENDOFSILELIST,
+		":End of Silence List")
+}
+
+func (target *Client) RplTargNotify(client *Client) {
+	target.NumericReply(RPL_TARGNOTIFY,
+		"%s :has been informed that you messaged them.", client.Nick())
+}
+
+// RplUModeGMsg tells target, which is +g, that client is trying to
+// message it.
+func (target *Client) RplUModeGMsg(client *Client) {
+	target.Reply(NewNumericReply(target, RPL_UMODEGMSG,
+		"%s %s@%s :is messaging you, and you have umode +g.",
+		client.Nick(), client.username, client.hostmask))
+}
+
 func (target *Client) RplMOTDStart() {
 	target.NumericReply(RPL_MOTDSTART,
-		":- %s Message of the day - ", target.server.name)
+		":- %s Message of the day - ", target.server.Id())
 }
 
 func (target *Client) RplMOTD(line string) {
@@ -522,7 +707,7 @@ func (target *Client) RplVersion() {
 		RPL_VERSION,
 		"%s %s",
 		FullVersion(),
-		target.server.name,
+		target.server.Id(),
 	)
 }
 
@@ -533,7 +718,7 @@ func (target *Client) RplInviting(invitee *Client, channel Name) {
 
 func (target *Client) RplTime() {
 	target.NumericReply(RPL_TIME,
-		"%s :%s", target.server.name, time.Now().Format(time.RFC1123))
+		"%s :%s", target.server.Id(), time.Now().Format(time.RFC1123))
 }
 
 func (target *Client) RplLUserClient() {
@@ -607,6 +792,38 @@ func (target *Client) RplLUserMe() {
 	)
 }
 
+// Y <class> <ping frequency> <connect frequency> <max clients> <sendq>
+// :<clients>
+func (target *Client) RplStatsYLine(class *Class) {
+	target.NumericReply(
+		RPL_STATSYLINE,
+		"Y %s %d 0 %d %d :%d",
+		class,
+		int64(class.PingFrequency().Seconds()),
+		class.MaxClients(),
+		class.Flood().SendQ,
+		class.Clients(),
+	)
+}
+
+func (target *Client) RplStatsUptime() {
+	uptime := time.Since(target.server.ctime)
+	seconds := int64(uptime.Seconds())
+	target.NumericReply(
+		RPL_STATSUPTIME,
+		":Server Up %d days %d:%02d:%02d",
+		seconds/86400,
+		(seconds%86400)/3600,
+		(seconds%3600)/60,
+		seconds%60,
+	)
+}
+
+func (target *Client) RplEndOfStats(query string) {
+	target.NumericReply(RPL_ENDOFSTATS,
+		"%s :End of STATS report", query)
+}
+
 func (target *Client) RplWhoWasUser(whoWas *WhoWas) {
 	var whoWasHost Name
 
@@ -721,6 +938,11 @@ func (target *Client) ErrCannotSendToChan(channel *Channel) {
 		"%s :Cannot send to channel", channel)
 }
 
+func (target *Client) ErrCannotSendToChanReason(channel *Channel, reason string) {
+	target.NumericReply(ERR_CANNOTSENDTOCHAN,
+		"%s :Cannot send to channel (%s)", channel, reason)
+}
+
 func (target *Client) ErrCannotSendToUser(nick Name, reason string) {
 	target.NumericReply(
 		ERR_CANNOTSENDTOUSER,
@@ -754,6 +976,12 @@ func (target *Client) ErrUnknownMode(mode ChannelMode, channel *Channel) {
 		"%s :is unknown mode char to me for %s", mode, channel)
 }
 
+func (target *Client) ErrInvalidModeParam(channel *Channel, mode ChannelMode,
+	param Name, err error) {
+	target.NumericReply(ERR_INVALIDMODEPARAM,
+		"%s %s %s :%s", channel, mode, param, err)
+}
+
 func (target *Client) ErrConfiguredMode(mode ChannelMode) {
 	target.NumericReply(ERR_UNKNOWNMODE,
 		"%s :can only change this mode in daemon configuration", mode)
@@ -774,6 +1002,26 @@ func (target *Client) ErrInvalidCapCmd(subCommand CapSubCommand) {
 		"%s :Invalid CAP subcommand", subCommand)
 }
 
+func (target *Client) ErrTooManyChannels(channel Name) {
+	target.NumericReply(ERR_TOOMANYCHANNELS,
+		"%s :You have joined too many channels", channel)
+}
+
+func (target *Client) ErrStartTLS(reason string) {
+	target.NumericReply(ERR_STARTTLS,
+		":STARTTLS failed (%s)", reason)
+}
+
+func (target *Client) ErrThrottle(channel *Channel) {
+	target.NumericReply(ERR_THROTTLE,
+		"%s :Cannot join channel (+j), try again later", channel)
+}
+
+func (target *Client) ErrLinkChannel(channel *Channel, forward *Channel) {
+	target.NumericReply(ERR_LINKCHANNEL,
+		"%s %s :Forwarding to another channel", channel, forward)
+}
+
 func (target *Client) ErrBannedFromChan(channel *Channel) {
 	target.NumericReply(ERR_BANNEDFROMCHAN,
 		"%s :Cannot join channel (+b)", channel)
@@ -824,6 +1072,45 @@ func (target *Client) RplSaslSuccess() {
 	)
 }
 
+func (target *Client) ErrMonListFull(limit int, nicks []Name) {
+	names := make([]string, len(nicks))
+	for i, nick := range nicks {
+		names[i] = nick.String()
+	}
+	target.NumericReply(ERR_MONLISTFULL,
+		"%d %s :Monitor list is full", limit, strings.Join(names, ","))
+}
+
+func (target *Client) ErrAcceptFull() {
+	target.NumericReply(ERR_ACCEPTFULL,
+		":Accept list is full")
+}
+
+func (target *Client) ErrAcceptExist(nick Name) {
+	target.NumericReply(ERR_ACCEPTEXIST,
+		"%s :is already on your accept list", nick)
+}
+
+func (target *Client) ErrAcceptNot(nick Name) {
+	target.NumericReply(ERR_ACCEPTNOT,
+		"%s :is not on your accept list", nick)
+}
+
+func (target *Client) ErrSileListFull(mask Name) {
+	target.NumericReply(ERR_SILELISTFULL,
+		"%s :Your silence list is full", mask)
+}
+
+func (target *Client) ErrNoNonReg(client *Client) {
+	target.NumericReply(ERR_NONONREG,
+		"%s :You must log in with services to message this user", client.Nick())
+}
+
+func (target *Client) ErrTargUModeG(client *Client) {
+	target.NumericReply(ERR_TARGUMODEG,
+		"%s :is in +g mode (server-side ignore.)", client.Nick())
+}
+
 func (target *Client) ErrSaslFail(message string) {
 	target.NumericReply(
 		ERR_SASLFAIL,
@@ -3,25 +3,21 @@ package irc
 import (
 	"bufio"
 	"bytes"
-	"context"
-	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"net"
-	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/cretz/bine/tor"
-	"github.com/cretz/bine/torutil/ed25519"
-	"github.com/eyedeekay/sam3"
-	"github.com/eyedeekay/sam3/i2pkeys"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -40,26 +36,50 @@ type Server struct {
 	metrics     *Metrics
 	channels    *ChannelNameMap
 	connections *Counter
+	limiter     *ConnectionLimiter
+	resolver    *Resolver
+	cloaker     *Cloaker
+	vhosts      *VhostStore
+	history     *HistoryStore
+	markers     *ReadMarkers
 	clients     *ClientLookupSet
+	connected   *ClientSet
+	monitors    *MonitorSet
+	classes     *ClassSet
 	ctime       time.Time
-	idle        chan *Client
+	idle        chan *Session
 	motdFile    string
 	name        Name
 	network     Name
 	description string
-	newConns    chan net.Conn
+	newConns    chan *incomingConn
 	operators   map[Name][]byte
 	accounts    PasswordStore
 	password    []byte
 	signals     chan os.Signal
+	stops       chan os.Signal
+	upgrades    chan *Client
 	done        chan bool
 	whoWas      *WhoWasList
 	ids         map[string]*Identity
 	templates   map[string]string
+	tlsConfig   *tls.Config
+	listeners   map[listenerKey]*serverListener
+	rehashMutex sync.Mutex
+	shutdown    bool // set by Shutdown under rehashMutex
+	configMutex sync.RWMutex
+
+	metricsListener net.Listener
+	pprofListener   net.Listener
 }
 
 var (
 	SERVER_SIGNALS = []os.Signal{
+		syscall.SIGHUP,
+		syscall.SIGUSR1,
+		syscall.SIGUSR2,
+	}
+	SHUTDOWN_SIGNALS = []os.Signal{
 		syscall.SIGINT,
 		syscall.SIGTERM,
 	}
@@ -71,22 +91,43 @@ func NewServer(config *Config) *Server {
 		metrics:     NewMetrics("eris"),
 		channels:    NewChannelNameMap(),
 		connections: &Counter{},
+		limiter:     NewConnectionLimiter(config.Server.Limits),
+		resolver:    NewResolver(config.Server.DNS),
+		cloaker:     NewCloaker(config.Network.Cloak),
 		clients:     NewClientLookupSet(),
+		connected:   NewClientSet(),
+		monitors:    NewMonitorSet(),
+		classes:     NewClassSet(config),
 		ctime:       time.Now(),
-		idle:        make(chan *Client),
+		idle:        make(chan *Session),
 		motdFile:    config.Server.MOTD,
 		name:        NewName(config.Server.Name),
 		network:     NewName(config.Network.Name),
 		description: config.Server.Description,
-		newConns:    make(chan net.Conn),
+		newConns:    make(chan *incomingConn),
 		operators:   config.Operators(),
 		accounts:    NewMemoryPasswordStore(config.Accounts(), PasswordStoreOpts{}),
 		signals:     make(chan os.Signal, len(SERVER_SIGNALS)),
+		stops:       make(chan os.Signal, len(SHUTDOWN_SIGNALS)),
+		upgrades:    make(chan *Client, 1),
 		done:        make(chan bool),
 		whoWas:      NewWhoWasList(100),
 		ids:         make(map[string]*Identity),
-		templates:   map[string]string{},
+		listeners:   make(map[listenerKey]*serverListener),
+	}
+
+	vhosts, err := NewVhostStore(config.Server.Vhosts)
+	if err != nil {
+		log.Fatalf("error loading vhosts: %s", err)
+	}
+	server.vhosts = vhosts
+
+	history, err := NewHistoryStore(config.Server.History)
+	if err != nil {
+		log.Fatalf("error loading history: %s", err)
 	}
+	server.history = history
+	server.markers = NewReadMarkers(config.Server.History.Dir)
 
 	log.Debugf("accounts: %v", config.Accounts())
 
@@ -97,80 +138,31 @@ func NewServer(config *Config) *Server {
 		server.password = config.Server.PasswordBytes()
 	}
 
-	for _, addr := range config.Server.Listen {
-		server.listen(addr)
-	}
-
-	for addr, tlsconfig := range config.Server.TLSListen {
-		server.listentls(addr, tlsconfig)
-	}
+	server.tlsConfig = starttlsConfig(config)
 
-	for addr, i2pconfig := range config.Server.I2PListen {
-		server.listeni2p(addr, i2pconfig)
+	templates, err := loadTemplates(config.TemplateDir)
+	if err != nil {
+		log.Fatalf("Template load error, %s", err)
 	}
+	server.templates = templates
 
-	for addr, torconfig := range config.Server.TorListen {
-		server.listentor(addr, torconfig)
+	upgrade, err := loadUpgradeState()
+	if err != nil {
+		log.Fatalf("upgrade error: %s", err)
 	}
-
-	server.templates["en"] = default_template
-	if len(config.WWW.Listen)+len(config.WWW.TLSListen)+len(config.WWW.I2PListen)+len(config.WWW.TorListen) >= 0 {
-		if config.TemplateDir != "" {
-			files, err := ioutil.ReadDir(config.TemplateDir)
-			if err != nil {
-				log.Fatalf("Template directory read error, %s", err)
-			}
-			if len(files) == 0 {
-				server.templates["en"] = default_template
-			} else {
-				for _, f := range files {
-					path := strings.Replace(f.Name(), ".template", "", -1)
-					bytes, err := ioutil.ReadFile(filepath.Join(config.TemplateDir, f.Name()))
-					if err != nil {
-						log.Fatalf("Template file load error, %s", err)
-					}
-					server.templates[path] = string(bytes)
-				}
-			}
-		} else {
-			server.templates["en"] = default_template
-		}
-		if _, ok := server.templates["en"]; !ok {
-			server.templates["en"] = default_template
-		}
-		for _, addr := range config.WWW.Listen {
-			listener, err := net.Listen("tcp", addr)
-			if err != nil {
-				log.Fatal("listen error: ", err)
-			}
-			go http.Serve(listener, server)
-		}
-
-		for addr, tlsconfig := range config.WWW.TLSListen {
-			tlslisten, err := server.tlslistener(addr, tlsconfig)
-			if err != nil {
-				log.Fatalf("HTTPS WWW site generation error, %s", err)
-			}
-			go http.Serve(tlslisten, server)
-		}
-
-		for addr, i2pconfig := range config.WWW.I2PListen {
-			i2plisten, err := server.i2plistener(addr, i2pconfig)
-			if err != nil {
-				log.Fatalf("I2P WWW site generation error, %s", err)
-			}
-			go http.Serve(i2plisten, server)
+	if upgrade != nil {
+		server.ctime = upgrade.Created
+		for _, l := range upgrade.Listeners {
+			server.resumeListener(listenerKey{l.WWW, l.Kind, l.Addr}, l.FD)
 		}
+	}
 
-		for addr, torconfig := range config.WWW.TorListen {
-			torlisten, err := server.torlistener(addr, torconfig)
-			if err != nil {
-				log.Fatalf("Tor WWW site generation error, %s", err)
-			}
-			go http.Serve(torlisten, server)
-		}
+	if _, err := server.updateListeners(); err != nil {
+		log.Fatalf("listen error: %s", err)
 	}
+
 	signal.Notify(server.signals, SERVER_SIGNALS...)
+	signal.Notify(server.stops, SHUTDOWN_SIGNALS...)
 
 	// server uptime counter
 	server.metrics.NewCounterFunc(
@@ -202,6 +194,13 @@ func NewServer(config *Config) *Server {
 		},
 	)
 
+	// server rejected connections counter (by reason)
+	server.metrics.NewCounterVec(
+		"server", "rejected_connections",
+		"Number of connections rejected by connection limits (by reason)",
+		[]string{"reason"},
+	)
+
 	// server registered (clients) gauge
 	server.metrics.NewGaugeFunc(
 		"server", "registered",
@@ -240,7 +239,27 @@ func NewServer(config *Config) *Server {
 		"Client ping latency in seconds",
 	)
 
-	go server.metrics.Run(":9314")
+	if !config.Metrics.Disabled {
+		listener, err := ListenAddr(config.Metrics.ListenAddr())
+		if err != nil {
+			log.Fatalf("metrics listen error: %s", err)
+		}
+		server.metricsListener = listener
+		go server.metrics.Serve(listener, config.Metrics)
+	}
+
+	if config.Pprof.Enabled {
+		listener, err := ListenAddr(config.Pprof.ListenAddr())
+		if err != nil {
+			log.Fatalf("pprof listen error: %s", err)
+		}
+		server.pprofListener = listener
+		go ServePprof(listener)
+	}
+
+	if upgrade != nil {
+		server.resume(upgrade)
+	}
 
 	return server
 }
@@ -250,7 +269,7 @@ func (server *Server) Wallops(message string) {
 	server.clients.Range(func(_ Name, client *Client) bool {
 		if client.modes.Has(WallOps) {
 			server.metrics.Counter("client", "messages").Inc()
-			client.replies <- RplNotice(server, client, text)
+			client.Reply(RplNotice(server, client, text))
 		}
 		return true
 	})
@@ -264,7 +283,7 @@ func (server *Server) Global(message string) {
 	text := NewText(message)
 	server.clients.Range(func(_ Name, client *Client) bool {
 		server.metrics.Counter("client", "messages").Inc()
-		client.replies <- RplNotice(server.ids["global"], client, text)
+		client.Reply(RplNotice(server.ids["global"], client, text))
 		return true
 	})
 }
@@ -273,44 +292,71 @@ func (server *Server) Globalf(format string, args ...interface{}) {
 	server.Global(fmt.Sprintf(format, args...))
 }
 
-func (server *Server) Shutdown() {
-	server.Global("shutting down...")
-}
-
 func (server *Server) Stop() {
 	server.done <- true
 }
 
-func (server *Server) Run() {
+// Run handles new connections and signals until the server is stopped
+// or shut down by SIGINT or SIGTERM, returning any error from Shutdown.
+func (server *Server) Run() error {
 	for {
 		select {
 		case <-server.done:
-			return
-		case <-server.signals:
-			server.Shutdown()
-			// Give at least 1s for clients to see the shutdown
-			go func() {
-				time.Sleep(1 * time.Second)
-				server.Stop()
-			}()
-
-		case conn := <-server.newConns:
-			go NewClient(server, conn)
-
-		case client := <-server.idle:
-			client.Idle()
+			return nil
+		case sig := <-server.signals:
+			switch sig {
+			case syscall.SIGHUP:
+				// Opening I2P and Tor listeners can take minutes.
+				go server.rehash("SIGHUP")
+			case syscall.SIGUSR1:
+				ReopenLogs()
+			case syscall.SIGUSR2:
+				server.upgrade(nil)
+			}
+
+		case <-server.stops:
+			return server.Shutdown()
+
+		case client := <-server.upgrades:
+			server.upgrade(client)
+
+		case incoming := <-server.newConns:
+			go NewClient(server, incoming.conn, incoming.listener, incoming.limit)
+
+		case session := <-server.idle:
+			session.Idle()
 		}
 	}
 }
 
-func (s *Server) acceptor(listener net.Listener) {
+// incomingConn is a connection accepted on the listener configured
+// as listener.
+type incomingConn struct {
+	conn     net.Conn
+	listener string
+	limit    *LimiterKey
+}
+
+func (s *Server) acceptor(listener *serverListener, addr string) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Errorf("%s accept error: %s", s, err)
+			if listener.IsClosed() {
+				return
+			}
+			s.logger().WithField("listener", addr).Errorf("accept error: %s", err)
+			continue
+		}
+		s.logger().WithFields(log.Fields{
+			"listener": addr,
+			"remote":   conn.RemoteAddr().String(),
+		}).Debug("accept")
+
+		limit, err := s.limiter.Add(conn.RemoteAddr())
+		if err != nil {
+			go s.reject(conn, err)
 			continue
 		}
-		log.Debugf("%s accept: %s", s, conn.RemoteAddr())
 
 		if _, ok := conn.(*tls.Conn); ok {
 			s.metrics.GaugeVec("server", "clients").WithLabelValues("secure").Inc()
@@ -319,190 +365,78 @@ func (s *Server) acceptor(listener net.Listener) {
 		}
 
 		s.connections.Inc()
-		s.newConns <- conn
+		s.newConns <- &incomingConn{conn: conn, listener: addr, limit: limit}
 	}
 }
 
-//
-// listen goroutine
-//
+// reject sends an ERROR to a connection refused by the connection
+// limiter and closes it without allocating a Client.
+func (s *Server) reject(conn net.Conn, err error) {
+	s.logger().WithField("remote", conn.RemoteAddr().String()).Debugf("reject: %s", err)
 
-func (s *Server) listen(addr string) {
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Fatal(s, "listen error: ", err)
+	reason := "limit"
+	if err == ErrThrottled {
+		reason = "throttle"
 	}
+	s.metrics.CounterVec("server", "rejected_connections").WithLabelValues(reason).Inc()
 
-	log.Infof("%s listening on %s", s, addr)
-
-	go s.acceptor(listener)
-}
-
-func (s *Server) tlslistener(addr string, tlsconfig *TLSConfig) (net.Listener, error) {
-	cert, err := tls.LoadX509KeyPair(tlsconfig.Cert, tlsconfig.Key)
-	if err != nil {
-		log.Fatalf("error loading tls cert/key pair: %s", err)
-	}
-	config := tls.Config{Certificates: []tls.Certificate{cert}}
-	config.Rand = rand.Reader
-	return tls.Listen("tcp", addr, &config)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(RplError(err.Error()) + CRLF))
+	conn.Close()
 }
 
 //
-// listen tls goroutine
-//
-
-func (s *Server) listentls(addr string, tlsconfig *TLSConfig) {
-	listener, err := s.tlslistener(addr, tlsconfig)
-	if err != nil {
-		log.Fatalf("error binding to %s: %s", addr, err)
-	}
-
-	log.Infof("%s listening on %s (TLS)", s, addr)
-
-	go s.acceptor(listener)
-}
-
-//
-// listen i2p goroutine
+// server functionality
 //
 
-func (s *Server) i2plistener(addr string, i2pconfig *I2PConfig) (net.Listener, error) {
-	log.Infof("Starting and registering I2P service, please wait a couple of minutes...")
-	sam, err := sam3.NewSAM(i2pconfig.SAMaddr)
-	if err != nil {
-		log.Fatalf("error connecting to SAM to %s: %s", addr, err)
-	}
-	var keys *i2pkeys.I2PKeys
-	if _, err := os.Stat(i2pconfig.I2Pkeys + ".i2p.private"); os.IsNotExist(err) {
-		f, err := os.Create(i2pconfig.I2Pkeys + ".i2p.private")
-		if err != nil {
-			log.Fatalf("unable to open I2P keyfile for writing: %s", err)
-		}
-		defer f.Close()
-		tkeys, err := sam.NewKeys()
-		if err != nil {
-			log.Fatalf("unable to generate I2P Keys, %s", err)
-		}
-		keys = &tkeys
-		err = i2pkeys.StoreKeysIncompat(*keys, f)
-		if err != nil {
-			log.Fatalf("unable to save newly generated I2P Keys, %s", err)
-		}
-		i2pconfig.Base32 = keys.Addr().Base32()
-	} else {
-		tkeys, err := i2pkeys.LoadKeys(i2pconfig.I2Pkeys + ".i2p.private")
-		if err != nil {
-			log.Fatalf("unable to load I2P Keys: %e", err)
-		}
-		keys = &tkeys
-	}
-	// If the keys and the base32 are different, keys win.
-	i2pconfig.Base32 = keys.Addr().Base32()
-	stream, err := sam.NewStreamSession(addr, *keys, sam3.Options_Medium)
-	if err != nil {
-		log.Fatalf("error creating I2P streaming connection %s: %s, %s.", addr, err, *keys)
-	}
-	listener, err := stream.Listen()
-
-	err = ioutil.WriteFile(i2pconfig.I2Pkeys+".i2p.public.txt", []byte(i2pconfig.Base32), 0644)
-	if err != nil {
-		log.Fatalf("error storing I2P base32 address in adjacent text file, %s", err)
-
-	}
-	return listener, err
-}
-
-func (s *Server) listeni2p(addr string, i2pconfig *I2PConfig) {
-	listener, err := s.i2plistener(addr, i2pconfig)
-	if err != nil {
-		log.Fatalf("error binding to %s: %s", listener.Addr().(i2pkeys.I2PAddr).Base32(), err)
+func (s *Server) tryRegister(c *Client) {
+	if c.registered || !c.HasNick() || !c.HasUsername() ||
+		(c.session().capState == CapNegotiating) {
+		return
 	}
-	log.Infof("Listening on I2P address, %s", listener.Addr().(i2pkeys.I2PAddr).Base32())
-	go s.acceptor(listener)
-}
 
-func (s *Server) torlistener(addr string, torconfig *TorConfig) (net.Listener, error) {
-	log.Infof("Starting and registering onion service, please wait a couple of minutes...")
-	t, err := tor.Start(nil, &tor.StartConf{ControlPort: torconfig.ControlPort})
-	if err != nil {
-		log.Fatalf("Unable to start Tor: %v", err)
-	}
-	var keys *ed25519.KeyPair
-	if _, err := os.Stat(torconfig.Torkeys + ".tor.private"); os.IsNotExist(err) {
-		tkeys, err := ed25519.GenerateKey(nil)
-		if err != nil {
-			log.Fatalf("Unable to generate onion service key, %s", err)
-		}
-		keys = &tkeys
-		f, err := os.Create(torconfig.Torkeys + ".tor.private")
-		if err != nil {
-			log.Fatalf("Unable to create Tor keys file for writing, %s", err)
-		}
-		defer f.Close()
-		_, err = f.Write(tkeys.PrivateKey())
-		if err != nil {
-			log.Fatalf("Unable to write Tor keys to disk, %s", err)
-		}
-	} else if err == nil {
-		tkeys, err := ioutil.ReadFile(torconfig.Torkeys + ".tor.private")
-		if err != nil {
-			log.Fatalf("Unable to read Tor keys from disk")
+	if identity := s.bouncerIdentity(c); identity != nil {
+		if identity.modes.Has(SecureConn) && !c.session().IsSecure() {
+			c.Quit("Secure connection required to attach")
+			return
 		}
-		k := ed25519.FromCryptoPrivateKey(tkeys)
-		keys = &k
-	} else {
-		log.Fatalf("Unable to set up Tor keys, %s", err)
-	}
-	listenCtx := context.Background()
-	// Create a v3 onion service to listen on any port but show as 6667
-	listener, err := t.Listen(
-		listenCtx,
-		&tor.ListenConf{
-			Version3:    true,
-			RemotePorts: []int{6667},
-			Key:         *keys,
-		},
-	)
-	if err != nil {
-		log.Fatalf("error setting up Tor onion address, %s", err)
+		identity.attach(c)
+		return
 	}
-	torconfig.Onion = listener.ID + ".onion"
-	err = ioutil.WriteFile(torconfig.Torkeys+".tor.public.txt", []byte(listener.ID+".onion"), 0644)
-	if err != nil {
-		log.Fatalf("error storing Tor onion address in adjacent text file, %s", err)
+	if s.clients.Get(c.nick) != c {
+		// the nick is held by a bouncer client of another account
+		nick := c.nick
+		c.nick = ""
+		c.ErrNickNameInUse(nick)
+		return
 	}
-	return listener, err
-}
-
-//
-// listen tor goroutine
-//
 
-func (s *Server) listentor(addr string, torconfig *TorConfig) {
-	listener, err := s.torlistener(addr, torconfig)
-	if err != nil {
-		log.Fatalf("Unable to create onion service: %v", err)
+	c.waitHostname()
+	if vhost, ok := s.vhosts.Get(c.sasl.Id()); ok {
+		c.hostmask = vhost
 	}
-	log.Infof("Listening on Onion address, %s", torconfig.Onion)
-	go s.acceptor(listener)
-}
-
-//
-// server functionality
-//
 
-func (s *Server) tryRegister(c *Client) {
-	if c.registered || !c.HasNick() || !c.HasUsername() ||
-		(c.capState == CapNegotiating) {
+	class := s.classes.Match(c)
+	if class.IsFull() {
+		c.Quit(NewText(fmt.Sprintf("Too many clients in class %s", class)))
 		return
 	}
+	c.SetClass(class)
 
 	c.Register()
+	s.welcome(c)
+	s.deliverInbox(c)
+	s.monitorOnline(c)
+}
+
+// welcome sends a newly registered or attached client the
+// registration numerics, the LUSERS and the MOTD.
+func (s *Server) welcome(c *Client) {
 	c.RplWelcome()
 	c.RplYourHost()
 	c.RplCreated()
 	c.RplMyInfo()
+	c.RplISupport()
 
 	lusers := LUsersCommand{}
 	lusers.SetClient(c)
@@ -511,13 +445,55 @@ func (s *Server) tryRegister(c *Client) {
 	s.MOTD(c)
 }
 
+// bouncerIdentity returns the registered client of the account c
+// authenticated to, which c attaches to instead of registering, or
+// nil if there is none or the bouncer is disabled.
+func (s *Server) bouncerIdentity(c *Client) *Client {
+	account := c.sasl.Id()
+	if !s.Config().Server.Bouncer.Enabled || account == "" {
+		return nil
+	}
+	return s.accountClient(account)
+}
+
+// isBouncerIdentity returns true if client, which holds nick, may
+// have connections of its account attach to it.
+func (s *Server) isBouncerIdentity(client *Client) bool {
+	return s.Config().Server.Bouncer.Enabled && client.registered && client.sasl.Id() != ""
+}
+
+// ISupport returns the RPL_ISUPPORT tokens advertised to clients.
+func (server *Server) ISupport() []string {
+	var prefixes string
+	for _, mode := range MemberModes {
+		prefixes += MemberPrefixes[mode]
+	}
+	tokens := []string{
+		fmt.Sprintf("CHANMODES=%s", SupportedChannelModes.ChanModes()),
+		"CHANTYPES=#&!+",
+		"CALLERID=g",
+		fmt.Sprintf("EXTBAN=%c,%s", ExtBanPrefix, ExtBanTypes),
+		fmt.Sprintf("NETWORK=%s", server.Network()),
+		fmt.Sprintf("PREFIX=(%s)%s", MemberModes, prefixes),
+		fmt.Sprintf("SILENCE=%d", MaxSilenceList),
+	}
+	if server.history.Enabled() {
+		tokens = append(tokens,
+			fmt.Sprintf("CHATHISTORY=%d", server.history.MaxLimit()),
+			"MSGREFTYPES=msgid,timestamp",
+		)
+	}
+	return tokens
+}
+
 func (server *Server) MOTD(client *Client) {
-	if server.motdFile == "" {
+	motdFile := server.motd()
+	if motdFile == "" {
 		client.ErrNoMOTD()
 		return
 	}
 
-	file, err := os.Open(server.motdFile)
+	file, err := os.Open(motdFile)
 	if err != nil {
 		client.ErrNoMOTD()
 		return
@@ -538,31 +514,255 @@ func (server *Server) MOTD(client *Client) {
 	client.RplMOTDEnd()
 }
 
-func (s *Server) Rehash() error {
-	err := s.config.Reload()
+// Rehash reloads the config and applies it, opening and closing
+// listeners as needed, and returns a summary of what changed. If the
+// new config is invalid nothing is changed; if it was applied but some
+// listeners failed to open, both the summary and the errors are
+// returned. The new config replaces the current one entirely, so
+// removed listeners, operators and accounts are dropped.
+func (s *Server) Rehash() ([]string, error) {
+	s.rehashMutex.Lock()
+	defer s.rehashMutex.Unlock()
+	if s.shutdown {
+		return nil, ErrShuttingDown
+	}
+
+	var changes []string
+	changef := func(format string, args ...interface{}) {
+		changes = append(changes, fmt.Sprintf(format, args...))
+	}
+
+	old := s.Config()
+	config, err := LoadConfig(old.Name())
+	if err != nil {
+		return nil, err
+	}
+	templates, err := loadTemplates(config.TemplateDir)
+	if err != nil {
+		return nil, ConfigErrors{err}
+	}
+	if err := ReloadLogging(config.Server.Log); err != nil {
+		return nil, ConfigErrors{err}
+	}
+	var password []byte
+	if config.Server.Password != "" {
+		password = config.Server.PasswordBytes()
+	}
+	tlsConfig := starttlsConfig(config)
+	changes = []string{}
+
+	s.configMutex.Lock()
+	s.config = config
+	s.motdFile = config.Server.MOTD
+	s.name = NewName(config.Server.Name)
+	s.network = NewName(config.Network.Name)
+	s.description = config.Server.Description
+	s.operators = config.Operators()
+	s.accounts = NewMemoryPasswordStore(config.Accounts(), PasswordStoreOpts{})
+	s.password = password
+	s.templates = templates
+	s.tlsConfig = tlsConfig
+	s.configMutex.Unlock()
+
+	s.limiter.SetConfig(config.Server.Limits)
+	s.resolver.SetConfig(config.Server.DNS)
+	s.cloaker.SetConfig(config.Network.Cloak)
+	s.history.SetConfig(config.Server.History)
+	s.classes.SetConfig(config)
+	s.clients.Range(func(_ Name, client *Client) bool {
+		// the rehash may be handling a command of one of the clients
+		go client.updateClass()
+		return true
+	})
+
+	if config.Server.Name != old.Server.Name {
+		changef("server name changed from %s to %s", old.Server.Name, config.Server.Name)
+	}
+	if config.Network.Name != old.Network.Name {
+		changef("network name changed from %s to %s", old.Network.Name, config.Network.Name)
+	}
+	if config.Server.Description != old.Server.Description {
+		changef("server description changed")
+	}
+	if config.Server.MOTD != old.Server.MOTD {
+		changef("motd changed from %q to %q", old.Server.MOTD, config.Server.MOTD)
+	}
+	changes = append(changes, diffPasswords("operator", passwords(old.Operator), passwords(config.Operator))...)
+	changes = append(changes, diffPasswords("account", passwords(old.Account), passwords(config.Account))...)
+
+	var detached []*Client
+	s.clients.Range(func(_ Name, client *Client) bool {
+		if len(client.Sessions()) == 0 && !client.AlwaysOn() {
+			detached = append(detached, client)
+		}
+		return true
+	})
+	for _, client := range detached {
+		// detached clients aren't handling commands, so none of them
+		// is the operator rehashing
+		client.serverQuit("Bouncer disabled")
+	}
+	if len(detached) > 0 {
+		changef("quit %d detached clients", len(detached))
+	}
+
+	if config.TemplateDir != "" {
+		changef("reloaded %d templates", len(templates))
+	}
+
+	listenerChanges, err := s.updateListeners()
+	changes = append(changes, listenerChanges...)
+
+	return changes, err
+}
+
+// rehash rehashes the server on behalf of by and tells operators
+// what changed or why it failed.
+func (s *Server) rehash(by string) ([]string, error) {
+	s.Wallopsf("Rehashing server config (%s)", by)
+
+	changes, err := s.Rehash()
+	for _, change := range changes {
+		s.logger().Infof("rehash: %s", change)
+	}
 	if err != nil {
-		return err
+		s.logger().Errorf("rehash failed: %s", err)
+		s.Wallopsf("ERROR: Rehashing config failed (%s)", err)
+	} else {
+		s.Wallopsf("Rehashed server config (%d changes)", len(changes))
+	}
+
+	return changes, err
+}
+
+func passwords(confs map[string]*PassConfig) map[string]string {
+	passwords := make(map[string]string, len(confs))
+	for name, conf := range confs {
+		passwords[name] = conf.Password
+	}
+	return passwords
+}
+
+// diffPasswords describes the names added, removed or given a new
+// password between old and new.
+func diffPasswords(what string, old, new map[string]string) (changes []string) {
+	names := make([]string, 0, len(old)+len(new))
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range new {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		oldPassword, inOld := old[name]
+		newPassword, inNew := new[name]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("added %s %s", what, name))
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("removed %s %s", what, name))
+		case oldPassword != newPassword:
+			changes = append(changes, fmt.Sprintf("changed password of %s %s", what, name))
+		}
 	}
+	return
+}
 
-	s.motdFile = s.config.Server.MOTD
-	s.name = NewName(s.config.Server.Name)
-	s.network = NewName(s.config.Network.Name)
-	s.description = s.config.Server.Description
-	s.operators = s.config.Operators()
+// loadTemplates loads the WWW templates from dir. The default template
+// is used for "en" unless the directory has one.
+func loadTemplates(dir string) (map[string]string, error) {
+	templates := map[string]string{"en": default_template}
+	if dir != "" {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			path := strings.Replace(f.Name(), ".template", "", -1)
+			bytes, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+			if err != nil {
+				return nil, err
+			}
+			templates[path] = string(bytes)
+		}
+	}
+	return templates, nil
+}
 
-	return nil
+// Config returns the server's config. A rehash replaces the config
+// rather than modifying it, so it may be read without locking.
+func (s *Server) Config() *Config {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.config
 }
 
 func (s *Server) Id() Name {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
 	return s.name
 }
 
 func (s *Server) Network() Name {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
 	return s.network
 }
 
+func (s *Server) Description() string {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.description
+}
+
 func (s *Server) String() string {
-	return s.name.String()
+	return s.Id().String()
+}
+
+func (s *Server) motd() string {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.motdFile
+}
+
+// serverPassword returns the hashed connection password, or nil if
+// the server has none.
+func (s *Server) serverPassword() []byte {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.password
+}
+
+func (s *Server) operatorPassword(name Name) []byte {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.operators[name]
+}
+
+func (s *Server) accountStore() PasswordStore {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.accounts
+}
+
+func (s *Server) starttls() *tls.Config {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.tlsConfig
+}
+
+func (s *Server) template(lang string) string {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.templates[lang]
+}
+
+func (s *Server) logger() *log.Entry {
+	return log.WithField("server", s.String())
 }
 
 func (s *Server) Nick() Name {
@@ -635,7 +835,7 @@ func (msg *AuthenticateCommand) HandleRegServer(server *Server) {
 	if !client.sasl.Started() {
 		if msg.arg == "PLAIN" {
 			client.sasl.Start()
-			client.Reply(RplAuthenticate(client, "+"))
+			client.Respond(RplAuthenticate(client, "+"))
 		} else {
 			client.RplSaslMechs("PLAIN")
 			client.ErrSaslFail("Unknown authentication mechanism")
@@ -689,7 +889,7 @@ func (msg *AuthenticateCommand) HandleRegServer(server *Server) {
 		return
 	}
 
-	err = server.accounts.Verify(authcid, password)
+	err = server.accountStore().Verify(authcid, password)
 	if err != nil {
 		client.ErrSaslFail("invalid authentication")
 		return
@@ -734,12 +934,12 @@ func (m *PassCommand) HandleServer(s *Server) {
 
 func (m *PingCommand) HandleServer(s *Server) {
 	client := m.Client()
-	client.Reply(RplPong(client, m.server.Text()))
+	client.Respond(RplPong(client, m.server.Text()))
 }
 
 func (m *PongCommand) HandleServer(s *Server) {
 	v := s.metrics.Summary("client", "ping_latency_seconds")
-	v.Observe(time.Now().Sub(m.Client().pingTime).Seconds())
+	v.Observe(time.Now().Sub(m.Session().pingTime).Seconds())
 }
 
 func (m *UserCommand) HandleServer(s *Server) {
@@ -747,7 +947,7 @@ func (m *UserCommand) HandleServer(s *Server) {
 }
 
 func (msg *QuitCommand) HandleServer(server *Server) {
-	msg.Client().Quit(msg.message)
+	msg.Session().Quit(msg.message)
 }
 
 func (m *JoinCommand) HandleServer(s *Server) {
@@ -767,6 +967,11 @@ func (m *JoinCommand) HandleServer(s *Server) {
 			continue
 		}
 
+		if client.TooManyChannels() {
+			client.ErrTooManyChannels(name)
+			continue
+		}
+
 		channel := s.channels.Get(name)
 		if channel == nil {
 			channel = NewChannel(s, name, true)
@@ -819,21 +1024,30 @@ func (msg *PrivMsgCommand) HandleServer(server *Server) {
 
 	target := server.clients.Get(msg.target)
 	if target == nil {
-		client.ErrNoSuchNick(msg.target)
+		if !server.sendOffline(client, msg.target, msg.message) {
+			client.ErrNoSuchNick(msg.target)
+		}
 		return
 	}
 	if !client.CanSpeak(target) {
 		client.ErrCannotSendToUser(target.nick, "secure connection required")
 		return
 	}
+	if !target.AcceptsFrom(client) {
+		return
+	}
 	server.metrics.Counter("client", "messages").Inc()
-	target.Reply(RplPrivMsg(client, target, msg.message))
+	reply := RplPrivMsg(client, target, msg.message)
+	tags := server.recordQuery(client, target.nick, target.sasl.Id(), PRIVMSG, reply)
+	client.Echo(tags, reply)
+	target.TaggedReply(tags, reply)
 	if target.modes.Has(Away) {
 		client.RplAway(target)
 	}
 }
 
 func (client *Client) WhoisChannelsNames(target *Client) []string {
+	isMultiPrefix := target.HasCapability(MultiPrefix)
 	chstrs := make([]string, client.channels.Count())
 	index := 0
 	client.channels.Range(func(channel *Channel) bool {
@@ -841,16 +1055,7 @@ func (client *Client) WhoisChannelsNames(target *Client) []string {
 			return true
 		}
 
-		switch {
-		case channel.members.Get(client).Has(ChannelOperator):
-			chstrs[index] = "@" + channel.name.String()
-
-		case channel.members.Get(client).Has(Voice):
-			chstrs[index] = "+" + channel.name.String()
-
-		default:
-			chstrs[index] = channel.name.String()
-		}
+		chstrs[index] = channel.Prefixes(client, isMultiPrefix) + channel.name.String()
 		index++
 		return true
 	})
@@ -933,6 +1138,21 @@ func (msg *OperCommand) HandleServer(server *Server) {
 	)
 }
 
+func (msg *UpgradeCommand) HandleServer(server *Server) {
+	client := msg.Client()
+	if !client.modes.Has(Operator) {
+		client.ErrNoPrivileges()
+		return
+	}
+
+	// the upgrade may have to quit this client, so don't wait for it
+	select {
+	case server.upgrades <- client:
+	default:
+		client.Respond(RplNotice(server, client, "UPGRADE: an upgrade is already pending"))
+	}
+}
+
 func (msg *RehashCommand) HandleServer(server *Server) {
 	client := msg.Client()
 	if !client.modes.Has(Operator) {
@@ -940,21 +1160,27 @@ func (msg *RehashCommand) HandleServer(server *Server) {
 		return
 	}
 
-	server.Wallopsf(
-		"Rehashing server config (%s)",
-		client.Nick(),
-	)
+	changes, err := server.rehash(client.Nick().String())
 
-	err := server.Rehash()
+	var errs ConfigErrors
 	if err != nil {
-		server.Wallopsf(
-			"ERROR: Rehashing config failed (%s)",
-			err,
-		)
-		return
+		var ok bool
+		if errs, ok = err.(ConfigErrors); !ok {
+			errs = ConfigErrors{err}
+		}
 	}
 
-	client.RplRehashing()
+	if changes != nil {
+		client.RplRehashing()
+	}
+	for _, change := range changes {
+		client.Respond(RplNotice(server, client,
+			NewText(fmt.Sprintf("REHASH: %s", change))))
+	}
+	for _, err := range errs {
+		client.Respond(RplNotice(server, client,
+			NewText(fmt.Sprintf("REHASH: ERROR: %s", err))))
+	}
 }
 
 func (msg *AwayCommand) HandleServer(server *Server) {
@@ -1013,8 +1239,14 @@ func (msg *NoticeCommand) HandleServer(server *Server) {
 		client.ErrCannotSendToUser(target.nick, "secure connection required")
 		return
 	}
+	if !target.AcceptsFrom(client) {
+		return
+	}
 	server.metrics.Counter("client", "messages").Inc()
-	target.Reply(RplNotice(client, target, msg.message))
+	reply := RplNotice(client, target, msg.message)
+	tags := server.recordQuery(client, target.nick, target.sasl.Id(), NOTICE, reply)
+	client.Echo(tags, reply)
+	target.TaggedReply(tags, reply)
 }
 
 func (msg *KickCommand) HandleServer(server *Server) {
@@ -1088,7 +1320,7 @@ func (msg *NamesCommand) HandleServer(server *Server) {
 
 func (msg *VersionCommand) HandleServer(server *Server) {
 	client := msg.Client()
-	if (msg.target != "") && (msg.target != server.name) {
+	if (msg.target != "") && (msg.target != server.Id()) {
 		client.ErrNoSuchServer(msg.target)
 		return
 	}
@@ -1105,6 +1337,10 @@ func (msg *InviteCommand) HandleServer(server *Server) {
 		return
 	}
 
+	if !target.AcceptsFrom(client) {
+		return
+	}
+
 	channel := server.channels.Get(msg.channel)
 	if channel == nil {
 		client.RplInviting(target, msg.channel)
@@ -1117,7 +1353,7 @@ func (msg *InviteCommand) HandleServer(server *Server) {
 
 func (msg *TimeCommand) HandleServer(server *Server) {
 	client := msg.Client()
-	if (msg.target != "") && (msg.target != server.name) {
+	if (msg.target != "") && (msg.target != server.Id()) {
 		client.ErrNoSuchServer(msg.target)
 		return
 	}
@@ -1161,6 +1397,158 @@ func (msg *KillCommand) HandleServer(server *Server) {
 	target.Quit(NewText(quitMsg))
 }
 
+func (msg *ChgHostCommand) HandleServer(server *Server) {
+	client := msg.Client()
+	if !client.modes.Has(Operator) {
+		client.ErrNoPrivileges()
+		return
+	}
+
+	target := server.clients.Get(msg.nickname)
+	if target == nil {
+		client.ErrNoSuchNick(msg.nickname)
+		return
+	}
+
+	if !IsVhost(msg.hostname) {
+		client.Respond(RplNotice(server, client,
+			NewText(fmt.Sprintf("%s is not a valid hostname", msg.hostname))))
+		return
+	}
+
+	target.ChangeHost(msg.hostname)
+	server.Wallopsf("%s changed the host of %s to %s",
+		client.Nick(), target.Nick(), msg.hostname)
+}
+
+// applyVhost changes the host of clients logged in to account to its
+// vhost, or back to their cloaked host if it has none.
+func (server *Server) applyVhost(account string) {
+	vhost, ok := server.vhosts.Get(account)
+	server.clients.Range(func(_ Name, client *Client) bool {
+		if client.sasl.Id() != account {
+			return true
+		}
+		if ok {
+			client.ChangeHost(vhost)
+		} else {
+			client.ChangeHost(client.cloakedHost())
+		}
+		return true
+	})
+}
+
+func (msg *VhostCommand) HandleServer(server *Server) {
+	client := msg.Client()
+	notice := func(format string, args ...interface{}) {
+		client.Respond(RplNotice(server, client, NewText(fmt.Sprintf(format, args...))))
+	}
+
+	if msg.subCommand == "REQUEST" {
+		account := client.sasl.Id()
+		if account == "" {
+			notice("You must be logged in to request a vhost")
+			return
+		}
+		if len(msg.args) < 1 {
+			client.ErrNeedMoreParams(msg.Code())
+			return
+		}
+		vhost := NewName(msg.args[0])
+		if err := server.vhosts.Request(account, vhost); err != nil {
+			notice("Couldn't request vhost %s: %s", vhost, err)
+			return
+		}
+		notice("Requested vhost %s, waiting for an operator to approve it", vhost)
+		server.Wallopsf("%s (account %s) requested vhost %s",
+			client.Nick(), account, vhost)
+		return
+	}
+
+	if !client.modes.Has(Operator) {
+		client.ErrNoPrivileges()
+		return
+	}
+
+	if msg.subCommand == "LIST" {
+		accounts, vhosts := server.vhosts.Requests()
+		for i, account := range accounts {
+			notice("%s requested %s", account, vhosts[i])
+		}
+		notice("End of vhost requests")
+		return
+	}
+
+	nargs := 1
+	if msg.subCommand == "SET" {
+		nargs = 2
+	}
+	if len(msg.args) < nargs {
+		client.ErrNeedMoreParams(msg.Code())
+		return
+	}
+	account := msg.args[0]
+
+	var (
+		vhost Name
+		err   error
+	)
+	switch msg.subCommand {
+	case "SET":
+		vhost = NewName(msg.args[1])
+		err = server.vhosts.Set(account, vhost)
+	case "DEL":
+		err = server.vhosts.Delete(account)
+	case "APPROVE":
+		vhost, err = server.vhosts.Approve(account)
+	case "REJECT":
+		vhost, err = server.vhosts.Reject(account)
+	default:
+		notice("Unknown VHOST subcommand %s", msg.subCommand)
+		return
+	}
+	if err != nil {
+		notice("VHOST %s %s failed: %s", msg.subCommand, account, err)
+		return
+	}
+
+	switch msg.subCommand {
+	case "SET", "APPROVE":
+		notice("Vhost of %s set to %s", account, vhost)
+	case "DEL":
+		notice("Vhost of %s removed", account)
+	case "REJECT":
+		notice("Vhost %s requested by %s rejected", vhost, account)
+		return
+	}
+	server.applyVhost(account)
+}
+
+func (msg *StatsCommand) HandleServer(server *Server) {
+	client := msg.Client()
+	if (msg.target != "") && (msg.target != server.Id()) {
+		client.ErrNoSuchServer(msg.target)
+		return
+	}
+
+	switch msg.query {
+	case "y", "Y":
+		if !client.modes.Has(Operator) {
+			client.ErrNoPrivileges()
+			return
+		}
+		server.classes.Range(func(class *Class) bool {
+			client.RplStatsYLine(class)
+			return true
+		})
+
+	case "u", "U":
+		client.RplStatsUptime()
+	}
+
+	client.RplEndOfStats(msg.query)
+}
+
 func (msg *WhoWasCommand) HandleServer(server *Server) {
 	client := msg.Client()
 	for _, nickname := range msg.nicknames {
@@ -1175,3 +1563,179 @@ func (msg *WhoWasCommand) HandleServer(server *Server) {
 		client.RplEndOfWhoWas(nickname)
 	}
 }
+
+func (msg *ChatHistoryCommand) HandleServer(server *Server) {
+	client := msg.Client()
+	fail := func(code string, context string, description string) {
+		client.Respond(RplFail(server, CHATHISTORY, code, context, description))
+	}
+
+	if !server.history.Enabled() {
+		fail("MESSAGE_ERROR", msg.subCommand, "History is disabled")
+		return
+	}
+
+	params := map[string]int{
+		"LATEST":  3,
+		"BEFORE":  3,
+		"AFTER":   3,
+		"AROUND":  3,
+		"BETWEEN": 4,
+		"TARGETS": 3,
+	}
+	n, ok := params[msg.subCommand]
+	if !ok {
+		fail("INVALID_PARAMS", msg.subCommand, "Unknown subcommand")
+		return
+	}
+	if len(msg.args) < n {
+		fail("NEED_MORE_PARAMS", msg.subCommand, "Missing parameters")
+		return
+	}
+
+	limit, err := strconv.Atoi(msg.args[n-1])
+	if err != nil || limit < 0 {
+		fail("INVALID_PARAMS", msg.subCommand, "Invalid limit")
+		return
+	}
+
+	args := msg.args[:n-1]
+	var name Name
+	if msg.subCommand != "TARGETS" {
+		name, args = NewName(args[0]), args[1:]
+	}
+
+	refs := make([]HistoryRef, 0, 2)
+	for _, arg := range args {
+		if msg.subCommand == "LATEST" && arg == "*" {
+			continue
+		}
+		ref, err := ParseHistoryRef(arg)
+		if err != nil || (msg.subCommand == "TARGETS" && ref.MsgID != "") {
+			fail("INVALID_PARAMS", msg.subCommand, "Invalid message reference")
+			return
+		}
+		refs = append(refs, ref)
+	}
+
+	if msg.subCommand == "TARGETS" {
+		server.chatHistoryTargets(client, refs[0].Time, refs[1].Time, limit)
+		return
+	}
+
+	key := name
+	// like other servers, only members may read a channel's history
+	if channel := server.channels.Get(name); channel != nil && channel.members.Has(client) {
+		key, name = channel.name, channel.name
+	} else if account := client.sasl.Id(); account != "" && name.IsNickname() {
+		key = queryKey(account, server.queryPeer(name))
+	} else {
+		fail("INVALID_TARGET", fmt.Sprintf("%s %s", msg.subCommand, name),
+			"Messages could not be retrieved")
+		return
+	}
+	if max := server.history.Limit(key); limit == 0 || limit > max {
+		limit = max
+	}
+
+	var items HistoryItems
+	if buffer := server.history.Get(key); buffer != nil {
+		items = buffer.All()
+	}
+	if !msg.Session().capabilities[EventPlayback] {
+		items = items.Messages()
+	}
+
+	switch msg.subCommand {
+	case "LATEST":
+		if len(refs) == 0 {
+			items = items.Latest(nil, limit)
+		} else {
+			items = items.Latest(&refs[0], limit)
+		}
+	case "BEFORE":
+		items = items.Before(refs[0], limit)
+	case "AFTER":
+		items = items.After(refs[0], limit)
+	case "AROUND":
+		items = items.Around(refs[0], limit)
+	case "BETWEEN":
+		items = items.Between(refs[0], refs[1], limit)
+	}
+	client.RplChatHistory(name, items)
+}
+
+// chatHistoryTargets sends the client the channels it is in and the
+// accounts and nicks of its account's queries with messages between
+// from and to, in order of their latest message.
+func (server *Server) chatHistoryTargets(client *Client, from, to time.Time, limit int) {
+	if from.After(to) {
+		from, to = to, from
+	}
+	if max := server.history.MaxLimit(); limit == 0 || limit > max {
+		limit = max
+	}
+
+	var targets []HistoryTarget
+	add := func(name Name, key Name) {
+		buffer := server.history.Get(key)
+		if buffer == nil {
+			return
+		}
+		items := buffer.All().Messages().Since(from)
+		for i := len(items) - 1; i >= 0; i-- {
+			if !items[i].Time.After(to) {
+				targets = append(targets, HistoryTarget{name, items[i].Time})
+				break
+			}
+		}
+	}
+	client.channels.Range(func(channel *Channel) bool {
+		add(channel.name, channel.name)
+		return true
+	})
+	if account := client.sasl.Id(); account != "" {
+		for _, peer := range server.queryTargets(account) {
+			add(peer, queryKey(account, peer))
+		}
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Time.Before(targets[j].Time)
+	})
+	if len(targets) > limit {
+		targets = targets[:limit]
+	}
+	client.RplChatHistoryTargets(targets)
+}
+
+func (msg *MarkReadCommand) HandleServer(server *Server) {
+	client := msg.Client()
+	fail := func(code string, description string) {
+		client.Respond(RplFail(server, MARKREAD, code, msg.target.String(), description))
+	}
+
+	if msg.target == "" {
+		client.Respond(RplFail(server, MARKREAD, "NEED_MORE_PARAMS", "*", "Missing parameters"))
+		return
+	}
+	account := client.sasl.Id()
+	if account == "" {
+		fail("ACCOUNT_REQUIRED", "You must be logged in to use read markers")
+		return
+	}
+	if msg.timestamp == "" {
+		client.RplMarkRead(msg.target)
+		return
+	}
+
+	ref, err := ParseHistoryRef(msg.timestamp)
+	if err != nil || ref.MsgID != "" {
+		fail("INVALID_PARAMS", "Invalid timestamp")
+		return
+	}
+	server.markers.Set(account, msg.target, ref.Time)
+	client.RespondAll(func() {
+		client.RplMarkRead(msg.target)
+	})
+}
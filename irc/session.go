@@ -0,0 +1,300 @@
+package irc
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Session is a connection of a client. A client has a single session
+// until it registers; once registered, clients of accounts using the
+// bouncer may have several, or none while they are always-on.
+type Session struct {
+	capabilities CapabilitySet
+	capState     CapState
+	client       *Client
+	closed       *SyncBool
+	ctime        time.Time
+	fakelag      *FakeLag
+	flushed      chan bool
+	idleTimer    *time.Timer
+	limit        *LimiterKey
+	listener     string
+	loops        sync.WaitGroup
+	pingTime     time.Time
+	quitTimer    *time.Timer
+	recvq        chan string
+	sendq        *SendQueue
+	socket       *Socket
+	unhandled    []string
+	upgrading    *SyncBool
+}
+
+func newSession(client *Client, conn net.Conn, listener string) *Session {
+	flood := client.class.Flood()
+	return &Session{
+		capabilities: make(CapabilitySet),
+		capState:     CapNone,
+		client:       client,
+		closed:       NewSyncBool(false),
+		ctime:        time.Now(),
+		fakelag:      NewFakeLag(flood.Penalty, flood.Burst),
+		flushed:      make(chan bool),
+		listener:     listener,
+		recvq:        make(chan string, flood.RecvQ),
+		sendq:        NewSendQueue(flood.SendQ),
+		socket:       NewSocket(conn),
+		upgrading:    NewSyncBool(false),
+	}
+}
+
+// start starts the session's goroutines. Sessions of registered
+// clients, resumed after an UPGRADE, go straight to processing
+// commands.
+func (s *Session) start() {
+	s.Touch()
+	s.loops.Add(1)
+	go s.writeloop()
+	if s.client.registered {
+		s.loops.Add(1)
+		go s.processloop()
+	}
+	go s.readloop()
+}
+
+func (s *Session) writeloop() {
+	defer s.loops.Done()
+	for range s.sendq.Ready() {
+		lines, closed := s.sendq.Drain()
+		for _, line := range lines {
+			s.socket.Write(line)
+		}
+		if closed {
+			s.socket.Close()
+			close(s.flushed)
+			return
+		}
+		if s.upgrading.Get() {
+			return
+		}
+	}
+}
+
+// readloop reads lines from the session. Until its client registers
+// each line is handled before the next is read, so that commands like
+// STARTTLS can take over the connection, and the session's fakelag
+// delays reading further lines. Afterwards lines are queued for
+// processloop, and a session that fills its queue is closed.
+func (s *Session) readloop() {
+	for {
+		line, err := s.socket.Read()
+		if err != nil {
+			break
+		}
+
+		if !s.client.registered {
+			s.throttle()
+			if s.closed.Get() {
+				return
+			}
+			s.client.handleLine(s, line)
+			if s.closed.Get() {
+				return
+			}
+			if s.client.registered {
+				s.loops.Add(1)
+				go s.processloop()
+			}
+			continue
+		}
+
+		select {
+		case s.recvq <- line:
+		default:
+			s.client.processCommand(s, NewQuitCommand("Excess Flood"))
+			close(s.recvq)
+			return
+		}
+	}
+
+	if s.client.registered {
+		close(s.recvq)
+		return
+	}
+	s.client.processCommand(s, NewQuitCommand("connection closed"))
+}
+
+// processloop handles commands queued by readloop once the client has
+// registered, delaying them according to the session's fakelag. While
+// the session is being frozen for an UPGRADE, queued commands are kept
+// for the new process instead.
+func (s *Session) processloop() {
+	defer s.loops.Done()
+	for line := range s.recvq {
+		if s.closed.Get() {
+			return
+		}
+		if s.upgrading.Get() {
+			s.unhandled = append(s.unhandled, line)
+			continue
+		}
+		s.throttle()
+		s.client.handleLine(s, line)
+	}
+	if s.upgrading.Get() {
+		return
+	}
+	s.client.processCommand(s, NewQuitCommand("connection closed"))
+}
+
+// throttle adds a command to the session's fakelag and waits for as
+// long as it is delayed. IRC operators aren't delayed.
+func (s *Session) throttle() {
+	if delay := s.fakelag.Touch(time.Now()); delay > 0 && !s.client.modes.Has(Operator) {
+		time.Sleep(delay)
+	}
+}
+
+// Reply queues reply to be sent on the session. A session that
+// exceeds its send queue is closed.
+func (s *Session) Reply(reply string) {
+	if s.closed.Get() {
+		return
+	}
+	if err := s.sendq.Push(reply); err == ErrSendQExceeded {
+		// Reply is often called while ranging over channel members or
+		// handling a command of the same client, so the session can't
+		// be torn down synchronously here.
+		client := s.client
+		go client.processCommand(s, NewQuitCommand(NewText(err.Error())))
+	}
+}
+
+// TaggedReply sends reply with the tags the session has enabled.
+func (s *Session) TaggedReply(tags MessageTags, reply string) {
+	s.Reply(tags.For(s) + reply)
+}
+
+// Quit closes the session. The client quits with its last session
+// unless it is always-on, in which case it stays, detached. It must be
+// called while handling one of the client's commands; other goroutines
+// post a QuitCommand with processCommand instead.
+func (s *Session) Quit(message Text) {
+	if s.closed.Get() {
+		return
+	}
+	if s.client.detach(s) {
+		s.close(message)
+		return
+	}
+	s.client.Quit(message)
+}
+
+// serverQuit closes the session on behalf of the server, taking the
+// client's command lock that Quit must be called with. It must not be
+// called while handling one of the client's commands.
+func (s *Session) serverQuit(message Text) {
+	s.client.commands.Lock()
+	defer s.client.commands.Unlock()
+	s.Quit(message)
+}
+
+// close sends the session an ERROR and closes it once the send queue
+// is flushed.
+func (s *Session) close(message Text) {
+	if s.closed.Get() {
+		return
+	}
+	s.closed.Set(true)
+	s.sendq.Close(RplError(message.String()))
+
+	server := s.client.server
+	if s.IsSecure() {
+		server.metrics.GaugeVec("server", "clients").WithLabelValues("secure").Dec()
+	} else {
+		server.metrics.GaugeVec("server", "clients").WithLabelValues("insecure").Dec()
+	}
+	server.connections.Dec()
+	server.limiter.Remove(s.limit)
+
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	if s.quitTimer != nil {
+		s.quitTimer.Stop()
+	}
+
+	// the writeloop closes the socket once the send queue is flushed,
+	// but don't wait forever on a session that isn't reading.
+	time.AfterFunc(FLUSH_TIMEOUT, s.socket.Close)
+
+	s.logger().Debug("closed")
+}
+
+// SetFlood applies the flood limits of the session's class. It must
+// be called before the session starts processing commands.
+func (s *Session) SetFlood(flood FloodConfig) {
+	s.fakelag = NewFakeLag(flood.Penalty, flood.Burst)
+	s.recvq = make(chan string, flood.RecvQ)
+	s.sendq.SetMax(flood.SendQ)
+}
+
+// updateFlood applies changed flood limits to a session that has
+// started. Its receive queue keeps its size.
+func (s *Session) updateFlood(flood FloodConfig) {
+	s.fakelag.SetLimits(flood.Penalty, flood.Burst)
+	s.sendq.SetMax(flood.SendQ)
+}
+
+func (s *Session) IsSecure() bool {
+	_, ok := s.socket.Conn().(*tls.Conn)
+	return ok
+}
+
+func (s *Session) Touch() {
+	if s.quitTimer != nil {
+		s.quitTimer.Stop()
+	}
+
+	if s.idleTimer == nil {
+		s.idleTimer = time.AfterFunc(s.client.class.PingFrequency(), s.connectionIdle)
+	} else {
+		s.idleTimer.Reset(s.client.class.PingFrequency())
+	}
+}
+
+func (s *Session) Idle() {
+	s.pingTime = time.Now()
+	s.Reply(RplPing(s.client.server))
+
+	if s.quitTimer == nil {
+		s.quitTimer = time.AfterFunc(s.client.class.PingTimeout(), s.connectionTimeout)
+	} else {
+		s.quitTimer.Reset(s.client.class.PingTimeout())
+	}
+}
+
+// quit timer goroutine
+
+func (s *Session) connectionTimeout() {
+	s.client.processCommand(s, NewQuitCommand("connection timeout"))
+}
+
+//
+// idle timer goroutine
+//
+
+func (s *Session) connectionIdle() {
+	s.client.server.idle <- s
+}
+
+func (s *Session) String() string {
+	return s.socket.String()
+}
+
+func (s *Session) logger() *log.Entry {
+	return s.socket.logger().WithField("client", s.client.Id().String())
+}
@@ -0,0 +1,132 @@
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	ErrShuttingDown = errors.New("server is shutting down")
+)
+
+const (
+	DefaultShutdownMessage = "Server shutting down"
+	DefaultShutdownTimeout = FLUSH_TIMEOUT
+)
+
+// ShutdownConfig configures how the server shuts down on SIGINT or
+// SIGTERM. Message is sent to every client as its quit message, and
+// Timeout bounds how long the server waits for clients' send queues
+// to flush before closing their connections.
+type ShutdownConfig struct {
+	Message string
+	Timeout time.Duration
+}
+
+func (config ShutdownConfig) message() Text {
+	if config.Message == "" {
+		return NewText(DefaultShutdownMessage)
+	}
+	return NewText(config.Message)
+}
+
+func (config ShutdownConfig) timeout() time.Duration {
+	if config.Timeout == 0 {
+		return DefaultShutdownTimeout
+	}
+	return config.Timeout
+}
+
+// Shutdown stops accepting connections, quits every client with the
+// configured message and waits for their send queues to flush before
+// closing the remaining endpoints and persisting state. A second
+// SIGINT or SIGTERM skips the wait.
+func (server *Server) Shutdown() error {
+	var errs []string
+
+	server.logger().Info("shutting down")
+
+	// closing the I2P and Tor listeners closes their sessions too, and
+	// a rehash from now on would reopen them
+	server.rehashMutex.Lock()
+	server.shutdown = true
+	for key, listener := range server.listeners {
+		if err := listener.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", key, err))
+		}
+		delete(server.listeners, key)
+	}
+	server.rehashMutex.Unlock()
+
+	var clients []*Client
+	server.connected.Range(func(client *Client) bool {
+		clients = append(clients, client)
+		return true
+	})
+	server.disconnect(clients, server.Config().Server.Shutdown.message())
+
+	for name, listener := range map[string]net.Listener{
+		"metrics": server.metricsListener,
+		"pprof":   server.pprofListener,
+	} {
+		if listener == nil {
+			continue
+		}
+		if err := listener.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+
+	if err := server.vhosts.Save(); err != nil {
+		errs = append(errs, fmt.Sprintf("vhosts: %s", err))
+	}
+	if err := server.history.Close(); err != nil {
+		errs = append(errs, fmt.Sprintf("history: %s", err))
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	server.logger().Info("shutdown complete")
+	return nil
+}
+
+// disconnect quits clients with message and waits for their send
+// queues to flush, until the shutdown timeout or a SIGINT or SIGTERM,
+// before closing the connections of any that didn't. Other signals are
+// left queued meanwhile.
+func (server *Server) disconnect(clients []*Client, message Text) {
+	var sessions []*Session
+	for _, client := range clients {
+		sessions = append(sessions, client.Sessions()...)
+		client.serverQuit(message)
+	}
+
+	deadline := time.NewTimer(server.Config().Server.Shutdown.timeout())
+	defer deadline.Stop()
+
+	pending := len(sessions)
+wait:
+	for _, session := range sessions {
+		for flushed := false; !flushed; {
+			select {
+			case <-session.flushed:
+				flushed = true
+				pending--
+			case <-deadline.C:
+				break wait
+			case <-server.stops:
+				break wait
+			}
+		}
+	}
+	if pending > 0 {
+		server.logger().Warnf("closing %d connections that did not flush", pending)
+		for _, session := range sessions {
+			session.socket.Close()
+		}
+	}
+}
@@ -2,9 +2,12 @@ package irc
 
 import (
 	"bufio"
+	"crypto/tls"
 	"io"
 	"net"
+	"strings"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -12,26 +15,44 @@ import (
 const (
 	R = '→'
 	W = '←'
+
+	TLS_HANDSHAKE_TIMEOUT = 30 * time.Second
+
+	MAX_LINE_LENGTH = bufio.MaxScanTokenSize
 )
 
 type Socket struct {
 	closed      bool
 	closedMutex sync.RWMutex
+	writeMutex  sync.Mutex
+	connMutex   sync.RWMutex
 	conn        net.Conn
-	scanner     *bufio.Scanner
+	reader      *bufio.Reader
+	partial     []byte
 	writer      *bufio.Writer
 }
 
 func NewSocket(conn net.Conn) *Socket {
 	return &Socket{
-		conn:    conn,
-		scanner: bufio.NewScanner(conn),
-		writer:  bufio.NewWriter(conn),
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
 	}
 }
 
+// Conn returns the underlying connection, which StartTLS replaces.
+func (socket *Socket) Conn() net.Conn {
+	socket.connMutex.RLock()
+	defer socket.connMutex.RUnlock()
+	return socket.conn
+}
+
 func (socket *Socket) String() string {
-	return socket.conn.RemoteAddr().String()
+	return socket.Conn().RemoteAddr().String()
+}
+
+func (socket *Socket) logger() *log.Entry {
+	return log.WithField("remote", socket.String())
 }
 
 func (socket *Socket) Close() {
@@ -42,43 +63,69 @@ func (socket *Socket) Close() {
 		return
 	}
 	socket.closed = true
-	socket.conn.Close()
-	log.Debugf("%s closed", socket)
+	socket.Conn().Close()
+	socket.logger().Debug("closed")
 }
 
-func (socket *Socket) Read() (line string, err error) {
+func (socket *Socket) IsClosed() bool {
 	socket.closedMutex.RLock()
 	defer socket.closedMutex.RUnlock()
-	if socket.closed {
+	return socket.closed
+}
+
+// Read returns the next non-empty line. The socket isn't locked while
+// blocked reading so that it may be closed from another goroutine.
+// Part of a line read before an error is kept for the next Read, so
+// reading can be interrupted with a deadline and resumed.
+func (socket *Socket) Read() (line string, err error) {
+	if socket.IsClosed() {
 		err = io.EOF
 		return
 	}
 
-	for socket.scanner.Scan() {
-		line = socket.scanner.Text()
+	for {
+		var data []byte
+		data, err = socket.reader.ReadSlice('\n')
+		socket.partial = append(socket.partial, data...)
+		if err == bufio.ErrBufferFull && len(socket.partial) <= MAX_LINE_LENGTH {
+			continue
+		}
+		if err == bufio.ErrBufferFull {
+			err = bufio.ErrTooLong
+		}
+		if err != nil && (err != io.EOF || len(socket.partial) == 0) {
+			break
+		}
+
+		line = strings.TrimSuffix(string(socket.partial), "\n")
+		line = strings.TrimSuffix(line, "\r")
+		socket.partial = socket.partial[:0]
 		if len(line) == 0 {
 			continue
 		}
-		log.Debugf("%s → %s", socket, line)
-		return
+		socket.logger().Debugf("%c %s", R, line)
+		return line, nil
 	}
 
-	err = socket.scanner.Err()
 	socket.isError(err, R)
-	if err == nil {
-		err = io.EOF
-	}
 	return
 }
 
+// Unread returns the input received but not yet returned by Read.
+func (socket *Socket) Unread() string {
+	buffered, _ := socket.reader.Peek(socket.reader.Buffered())
+	return string(socket.partial) + string(buffered)
+}
+
 func (socket *Socket) Write(line string) (err error) {
-	socket.closedMutex.RLock()
-	defer socket.closedMutex.RUnlock()
-	if socket.closed {
+	if socket.IsClosed() {
 		err = io.EOF
 		return
 	}
 
+	socket.writeMutex.Lock()
+	defer socket.writeMutex.Unlock()
+
 	if _, err = socket.writer.WriteString(line); socket.isError(err, W) {
 		return
 	}
@@ -91,14 +138,50 @@ func (socket *Socket) Write(line string) (err error) {
 		return
 	}
 
-	log.Debugf("%s ← %s", socket, line)
+	socket.logger().Debugf("%c %s", W, line)
+	return
+}
+
+// StartTLS writes reply in the clear and then upgrades the underlying
+// connection to TLS in place, performing the server side handshake.
+func (socket *Socket) StartTLS(config *tls.Config, reply string) (err error) {
+	socket.closedMutex.Lock()
+	defer socket.closedMutex.Unlock()
+	if socket.closed {
+		return io.EOF
+	}
+
+	socket.writeMutex.Lock()
+	defer socket.writeMutex.Unlock()
+
+	if _, err = socket.writer.WriteString(reply + CRLF); socket.isError(err, W) {
+		return
+	}
+	if err = socket.writer.Flush(); socket.isError(err, W) {
+		return
+	}
+	socket.logger().Debugf("%c %s", W, reply)
+
+	conn := tls.Server(socket.Conn(), config)
+	conn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+	if err = conn.Handshake(); err != nil {
+		socket.logger().Debugf("tls handshake error: %s", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	socket.connMutex.Lock()
+	socket.conn = conn
+	socket.connMutex.Unlock()
+	socket.reader = bufio.NewReader(conn)
+	socket.writer = bufio.NewWriter(conn)
 	return
 }
 
 func (socket *Socket) isError(err error, dir rune) bool {
 	if err != nil {
 		if err != io.EOF {
-			log.Debugf("%s %c error: %s", socket, dir, err)
+			socket.logger().Debugf("%c error: %s", dir, err)
 		}
 		return true
 	}
@@ -0,0 +1,99 @@
+package irc
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSocketReadDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	socket := NewSocket(server)
+
+	go client.Write([]byte("PING :one\r\n\r\nPRIVMSG #x :hel"))
+
+	line, err := socket.Read()
+	assert.Nil(err)
+	assert.Equal("PING :one", line)
+
+	// an interrupted read keeps the partial line
+	time.Sleep(10 * time.Millisecond)
+	server.SetReadDeadline(time.Now())
+	_, err = socket.Read()
+	assert.NotNil(err)
+	assert.Equal("PRIVMSG #x :hel", socket.Unread())
+
+	server.SetReadDeadline(time.Time{})
+	go client.Write([]byte("lo\nQUIT"))
+	line, err = socket.Read()
+	assert.Nil(err)
+	assert.Equal("PRIVMSG #x :hello", line)
+
+	client.Close()
+	line, err = socket.Read()
+	assert.Nil(err)
+	assert.Equal("QUIT", line)
+}
+
+// testTLSConfig returns a server config with a self-signed certificate.
+func testTLSConfig() *tls.Config {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func TestSocketStartTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	socket := NewSocket(server)
+
+	// the connection is read concurrently, as by WHOIS
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_ = socket.String()
+				socket.Conn()
+			}
+		}
+	}()
+	defer close(done)
+
+	go func() {
+		reader := bufio.NewReader(client)
+		reader.ReadString('\n')
+		conn := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+		conn.Write([]byte("PING :secure\r\n"))
+	}()
+
+	assert.Nil(socket.StartTLS(testTLSConfig(), ":server 670 nick :STARTTLS successful"))
+	_, ok := socket.Conn().(*tls.Conn)
+	assert.True(ok)
+
+	line, err := socket.Read()
+	assert.Nil(err)
+	assert.Equal("PING :secure", line)
+}
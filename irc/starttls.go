@@ -0,0 +1,65 @@
+package irc
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// starttlsConfig returns the TLS configuration used to upgrade plaintext
+// connections with STARTTLS. It uses the first configured TLS listener's
+// certificate and returns nil if there is none.
+func starttlsConfig(c *Config) *tls.Config {
+	addrs := make([]string, 0, len(c.Server.TLSListen))
+	for addr := range c.Server.TLSListen {
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+	sort.Strings(addrs)
+
+	tlsconfig := c.Server.TLSListen[addrs[0]]
+	cert, err := tls.LoadX509KeyPair(tlsconfig.Cert, tlsconfig.Key)
+	if err != nil {
+		log.Errorf("error loading tls cert/key pair for STARTTLS: %s", err)
+		return nil
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequestClientCert,
+	}
+	config.Rand = rand.Reader
+	return config
+}
+
+func (msg *StartTLSCommand) HandleRegServer(server *Server) {
+	client := msg.Client()
+
+	if client.modes.Has(SecureConn) {
+		client.ErrStartTLS("already using TLS")
+		return
+	}
+
+	tlsConfig := server.starttls()
+	if tlsConfig == nil {
+		client.ErrStartTLS("STARTTLS is not available")
+		return
+	}
+
+	err := msg.Session().socket.StartTLS(tlsConfig, RplStartTLS(client))
+	if err != nil {
+		client.Quit("STARTTLS failed")
+		return
+	}
+
+	client.modes.Set(SecureConn)
+	server.metrics.GaugeVec("server", "clients").WithLabelValues("insecure").Dec()
+	server.metrics.GaugeVec("server", "clients").WithLabelValues("secure").Inc()
+}
+
+func (msg *StartTLSCommand) HandleServer(server *Server) {
+	msg.Client().ErrStartTLS("already registered")
+}
@@ -1,6 +1,7 @@
 package irc
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
 
@@ -88,6 +89,56 @@ func (text Text) String() string {
 	return string(text)
 }
 
+// formatting codes
+const (
+	FormatBold      = '\x02'
+	FormatColor     = '\x03'
+	FormatHexColor  = '\x04'
+	FormatReset     = '\x0f'
+	FormatMonospace = '\x11'
+	FormatReverse   = '\x16'
+	FormatItalic    = '\x1d'
+	FormatStrike    = '\x1e'
+	FormatUnderline = '\x1f'
+
+	CTCPDelim = '\x01'
+)
+
+var (
+	formatExpr = regexp.MustCompile(fmt.Sprintf(
+		"%c(?:[0-9]{1,2}(?:,[0-9]{1,2})?)?"+
+			"|%c(?:[0-9a-fA-F]{6}(?:,[0-9a-fA-F]{6})?)?"+
+			"|[%c%c%c%c%c%c%c]",
+		FormatColor, FormatHexColor,
+		FormatBold, FormatReset, FormatMonospace, FormatReverse,
+		FormatItalic, FormatStrike, FormatUnderline))
+)
+
+// HasColor returns true if the text contains colour codes.
+func (text Text) HasColor() bool {
+	return strings.ContainsAny(text.String(), string([]rune{FormatColor, FormatHexColor}))
+}
+
+// StripFormatting returns the text without formatting codes and colour
+// parameters.
+func (text Text) StripFormatting() Text {
+	return Text(formatExpr.ReplaceAllString(text.String(), ""))
+}
+
+// CTCP returns the command of a CTCP message, such as ACTION or
+// VERSION, and false if the text isn't one.
+func (text Text) CTCP() (string, bool) {
+	str := text.String()
+	if len(str) == 0 || str[0] != CTCPDelim {
+		return "", false
+	}
+	str = strings.TrimSuffix(str[1:], string(CTCPDelim))
+	if i := strings.IndexByte(str, ' '); i >= 0 {
+		str = str[:i]
+	}
+	return strings.ToUpper(str), true
+}
+
 // CTCPText is text suitably escaped for CTCP.
 type CTCPText string
 
@@ -0,0 +1,48 @@
+package irc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextFormatting(t *testing.T) {
+	assert := assert.New(t)
+
+	plain := Text("hello, world 42")
+	assert.False(plain.HasColor())
+	assert.Equal(plain, plain.StripFormatting())
+
+	colored := Text("\x0304,12red\x03 \x02bold\x02 \x0312,5x\x03 \x04FF0000hex\x0f 1")
+	assert.True(colored.HasColor())
+	assert.Equal(Text("red bold x hex 1"), colored.StripFormatting())
+
+	bold := Text("\x1ditalic\x1d \x1funderline\x1f")
+	assert.False(bold.HasColor())
+	assert.Equal(Text("italic underline"), bold.StripFormatting())
+	assert.Equal(Text("mono reverse strike"),
+		Text("\x11mono\x11 \x16reverse\x16 \x1estrike\x1e").StripFormatting())
+
+	// a colour code followed by digits keeps those after the second
+	assert.Equal(Text("123"), Text("\x0312123").StripFormatting())
+}
+
+func TestTextCTCP(t *testing.T) {
+	assert := assert.New(t)
+
+	for text, command := range map[Text]string{
+		"\x01ACTION waves\x01": "ACTION",
+		"\x01version\x01":      "VERSION",
+		"\x01PING 123":         "PING",
+		"\x01\x01":             "",
+	} {
+		ctcp, ok := text.CTCP()
+		assert.True(ok, text)
+		assert.Equal(command, ctcp)
+	}
+
+	_, ok := Text("hello \x01ACTION\x01").CTCP()
+	assert.False(ok)
+	_, ok = Text("").CTCP()
+	assert.False(ok)
+}
@@ -0,0 +1,80 @@
+package irc
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+	"time"
+)
+
+const (
+	// SERVER_TIME_FORMAT is the format of server-time tags and
+	// CHATHISTORY timestamps.
+	SERVER_TIME_FORMAT = "2006-01-02T15:04:05.000Z"
+)
+
+var (
+	idEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").
+		WithPadding(base32.NoPadding)
+)
+
+// NewMsgID returns a new unique message id.
+func NewMsgID() string {
+	id := make([]byte, 15)
+	rand.Read(id)
+	return idEncoding.EncodeToString(id)
+}
+
+// NewBatchID returns a new batch reference tag.
+func NewBatchID() string {
+	id := make([]byte, 5)
+	rand.Read(id)
+	return idEncoding.EncodeToString(id)
+}
+
+// FormatServerTime formats t as a server-time tag value.
+func FormatServerTime(t time.Time) string {
+	return t.UTC().Format(SERVER_TIME_FORMAT)
+}
+
+// ParseServerTime parses a server-time tag value.
+func ParseServerTime(value string) (time.Time, error) {
+	return time.Parse(SERVER_TIME_FORMAT, value)
+}
+
+// MessageTags are the IRCv3 tags a message is sent with. Clients are
+// only sent the tags of the capabilities they have enabled.
+type MessageTags struct {
+	Time  time.Time
+	MsgID string
+	Batch string
+}
+
+// NewMessageTags returns the tags of a new message sent now.
+func NewMessageTags() MessageTags {
+	return MessageTags{
+		Time:  time.Now(),
+		MsgID: NewMsgID(),
+	}
+}
+
+// For returns the tags prefix of a message sent to session, or an
+// empty string if it gets no tags.
+func (tags MessageTags) For(session *Session) string {
+	var values []string
+	if tags.Batch != "" && session.capabilities[Batch] {
+		values = append(values, "batch="+tags.Batch)
+	}
+	if !tags.Time.IsZero() && session.capabilities[ServerTime] {
+		values = append(values, "time="+FormatServerTime(tags.Time))
+	}
+	// there's no TAGMSG or client tags, so message-tags isn't offered;
+	// msgids go to clients that may refer to them with CHATHISTORY
+	if tags.MsgID != "" && (session.capabilities[ServerTime] || session.capabilities[Batch]) {
+		values = append(values, "msgid="+tags.MsgID)
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	return "@" + strings.Join(values, ";") + " "
+}
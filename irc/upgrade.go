@@ -0,0 +1,713 @@
+package irc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// UPGRADE_STATE_ENV is the environment variable a process started
+	// by UPGRADE finds the state handed over to it in.
+	UPGRADE_STATE_ENV = "ERIS_UPGRADE_STATE"
+
+	// UPGRADE_STATE_FILE is the name of the file the state is saved in.
+	UPGRADE_STATE_FILE = "state.json"
+
+	UPGRADE_MESSAGE = "Server upgrading, please reconnect"
+
+	upgradeStateVersion = 2
+)
+
+var (
+	ErrUpgradeVersion = errors.New("unsupported upgrade state version")
+	ErrNoSessions     = errors.New("no sessions resumed")
+)
+
+// upgradeState is the state handed over to a new process on UPGRADE.
+// Sockets are passed as file descriptors inherited across exec.
+type upgradeState struct {
+	Version   int
+	Created   time.Time
+	Listeners []upgradeListener
+	Clients   []upgradeClient
+	Channels  []upgradeChannel
+	History   map[Name]HistoryItems
+	Markers   map[string]map[Name]time.Time
+}
+
+type upgradeListener struct {
+	WWW  bool
+	Kind listenerKind
+	Addr string
+	FD   int
+}
+
+// upgradeClient is a registered client. Always-on clients may have no
+// sessions.
+type upgradeClient struct {
+	Nick        Name
+	Username    Name
+	Realname    Text
+	Hostname    Name
+	Hostmask    Name
+	AwayMessage Text
+	Account     string
+	Authorized  bool
+	Modes       string
+	CTime       time.Time
+	ATime       time.Time
+	Sessions    []upgradeSession
+	Replay      []upgradeReplayLine
+	Monitor     []Name
+	Accept      []Name
+	Silence     []Name
+}
+
+// upgradeSession is a session of a client. Input is what was received
+// on it but not yet handled, Output what was queued for it but not yet
+// sent.
+type upgradeSession struct {
+	FD           int
+	Listener     string
+	Capabilities []Capability
+	CapState     CapState
+	Input        string
+	Output       []string
+}
+
+type upgradeReplayLine struct {
+	Tags MessageTags
+	Line string
+}
+
+// upgradeChannel is a channel. Lists and member modes are keyed by
+// mode letter and nickname.
+type upgradeChannel struct {
+	Name         Name
+	Flags        string
+	Key          Text
+	Topic        Text
+	UserLimit    uint64
+	Playback     *Playback
+	JoinThrottle *JoinThrottle
+	FloodLimit   *FloodLimit
+	Forward      Name
+	Lists        map[string][]Name
+	Members      map[Name]string
+}
+
+// inheritableFD duplicates the socket of conn without close-on-exec,
+// so that it is inherited by the new process.
+func inheritableFD(conn syscall.Conn) (fd int, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	var dupErr error
+	err = raw.Control(func(s uintptr) {
+		fd, dupErr = syscall.Dup(int(s))
+	})
+	if err != nil {
+		return -1, err
+	}
+	return fd, dupErr
+}
+
+// canUpgrade reports whether the client can be handed over on
+// UPGRADE, with at least one of its sessions unless it is always-on.
+func (c *Client) canUpgrade() bool {
+	if !c.registered || c.hasQuit.Get() {
+		return false
+	}
+	if c.AlwaysOn() {
+		return true
+	}
+	for _, session := range c.Sessions() {
+		if session.canUpgrade() {
+			return true
+		}
+	}
+	return false
+}
+
+// canUpgrade reports whether the session's connection can be handed
+// over on UPGRADE. TLS session state can't be, and I2P and Tor
+// connections belong to the sessions of their listeners.
+func (s *Session) canUpgrade() bool {
+	if _, ok := s.client.server.Config().ListenerHostname(s.listener); ok {
+		return false
+	}
+	switch s.socket.Conn().(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// freeze asks the session's goroutines to stop, once any command being
+// handled has completed, so that its connection can be handed over.
+// Wait for them with s.loops.Wait().
+func (s *Session) freeze() {
+	s.upgrading.Set(true)
+	s.socket.Conn().SetReadDeadline(time.Now())
+	s.sendq.signal()
+}
+
+// thaw restarts a session frozen for an UPGRADE that failed.
+func (s *Session) thaw(output []string) {
+	s.upgrading.Set(false)
+	s.socket.Conn().SetReadDeadline(time.Time{})
+	s.recvq = make(chan string, s.client.class.Flood().RecvQ+len(s.unhandled))
+	for _, line := range s.unhandled {
+		s.recvq <- line
+	}
+	s.unhandled = nil
+	for _, line := range output {
+		s.sendq.Push(line)
+	}
+	s.start()
+}
+
+func (c *Client) upgradeState() upgradeClient {
+	state := upgradeClient{
+		Nick:        c.nick,
+		Username:    c.username,
+		Realname:    c.realname,
+		Hostname:    c.hostname,
+		Hostmask:    c.hostmask,
+		AwayMessage: c.awayMessage,
+		Account:     c.sasl.Id(),
+		Authorized:  c.authorized,
+		CTime:       c.ctime,
+		ATime:       c.atime,
+	}
+
+	var modes []rune
+	c.modes.Range(func(mode UserMode) bool {
+		modes = append(modes, rune(mode))
+		return true
+	})
+	state.Modes = string(modes)
+	state.Monitor = c.server.monitors.List(c)
+	state.Accept = c.ignores.AcceptList()
+	state.Silence = c.ignores.SilenceList()
+
+	c.sessionsMutex.RLock()
+	for _, line := range c.replay {
+		state.Replay = append(state.Replay, upgradeReplayLine{line.tags, line.line})
+	}
+	c.sessionsMutex.RUnlock()
+
+	return state
+}
+
+func (s *Session) upgradeState(fd int) upgradeSession {
+	state := upgradeSession{
+		FD:       fd,
+		Listener: s.listener,
+		CapState: s.capState,
+	}
+
+	for capability, enabled := range s.capabilities {
+		if enabled {
+			state.Capabilities = append(state.Capabilities, capability)
+		}
+	}
+
+	var input strings.Builder
+	for _, line := range s.unhandled {
+		input.WriteString(line + CRLF)
+	}
+	input.WriteString(s.socket.Unread())
+	state.Input = input.String()
+
+	state.Output, _ = s.sendq.Drain()
+	return state
+}
+
+func (channel *Channel) upgradeState() upgradeChannel {
+	state := upgradeChannel{
+		Name:         channel.name,
+		Key:          channel.key,
+		Topic:        channel.topic,
+		UserLimit:    channel.userLimit,
+		Playback:     channel.playback,
+		JoinThrottle: channel.joinThrottle,
+		FloodLimit:   channel.floodLimit,
+		Forward:      channel.forward,
+		Lists:        make(map[string][]Name),
+		Members:      make(map[Name]string),
+	}
+
+	var flags []rune
+	channel.flags.Range(func(mode ChannelMode) bool {
+		flags = append(flags, rune(mode))
+		return true
+	})
+	state.Flags = string(flags)
+
+	for mode, list := range channel.lists {
+		for mask := range list.masks {
+			state.Lists[string(mode)] = append(state.Lists[string(mode)], mask)
+		}
+	}
+
+	channel.members.Range(func(client *Client, modes *ChannelModeSet) bool {
+		var letters []rune
+		modes.Range(func(mode ChannelMode) bool {
+			letters = append(letters, rune(mode))
+			return true
+		})
+		state.Members[client.nick] = string(letters)
+		return true
+	})
+
+	return state
+}
+
+// Upgrade replaces the running process with a new one executing the
+// server's binary, which may have been replaced on disk. Listeners
+// and the plaintext and unix socket connections of registered clients
+// are handed over with the state of the clients and channels, so those
+// clients don't notice. Other connections are asked to reconnect. Upgrade
+// only returns if the upgrade failed, leaving the server running.
+func (s *Server) Upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// make sure the new binary runs and accepts the config first
+	args := append([]string{"-check"}, os.Args[1:]...)
+	if output, err := exec.Command(exe, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s: %s", exe, err, bytes.TrimSpace(output))
+	}
+
+	s.rehashMutex.Lock()
+	defer s.rehashMutex.Unlock()
+
+	state := &upgradeState{
+		Version: upgradeStateVersion,
+		Created: s.ctime,
+	}
+	var fds []int
+	var frozen []*Session
+	outputs := make(map[*Session][]string)
+
+	// undo hands everything back to this process if the upgrade fails
+	undo := func(err error) error {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		for _, l := range state.Listeners {
+			s.resumeListener(listenerKey{l.WWW, l.Kind, l.Addr}, l.FD)
+		}
+		if _, err := s.updateListeners(); err != nil {
+			s.logger().Errorf("upgrade: %s", err)
+		}
+		for _, session := range frozen {
+			if !session.closed.Get() {
+				session.thaw(outputs[session])
+			}
+		}
+		return err
+	}
+
+	// stop accepting, keeping the sockets of TCP and TLS listeners
+	for _, key := range s.listenerKeys() {
+		l := s.listeners[key]
+		if l.socket != nil {
+			fd, err := inheritableFD(l.socket.(syscall.Conn))
+			if err != nil {
+				return undo(fmt.Errorf("%s: %s", key, err))
+			}
+			state.Listeners = append(state.Listeners, upgradeListener{
+				WWW:  key.www,
+				Kind: key.kind,
+				Addr: key.addr,
+				FD:   fd,
+			})
+			if unix, ok := l.socket.(*net.UnixListener); ok {
+				unix.SetUnlinkOnClose(false)
+			}
+		}
+		l.Close()
+		delete(s.listeners, key)
+	}
+
+	var clients, dropped []*Client
+	s.connected.Range(func(client *Client) bool {
+		if client.canUpgrade() {
+			clients = append(clients, client)
+		} else {
+			dropped = append(dropped, client)
+		}
+		return true
+	})
+	var sessions []*Session
+	for _, client := range clients {
+		for _, session := range client.Sessions() {
+			if session.canUpgrade() {
+				session.freeze()
+				sessions = append(sessions, session)
+			} else {
+				session.serverQuit(NewText(UPGRADE_MESSAGE))
+			}
+		}
+	}
+
+	// a session blocked writing can't be frozen, give up on it
+	ctx, cancel := context.WithTimeout(context.Background(),
+		s.Config().Server.Shutdown.timeout())
+	defer cancel()
+	for _, session := range sessions {
+		stopped := make(chan bool)
+		go func(session *Session) {
+			session.loops.Wait()
+			close(stopped)
+		}(session)
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			session.serverQuit(NewText(UPGRADE_MESSAGE))
+			continue
+		}
+
+		if session.idleTimer != nil {
+			session.idleTimer.Stop()
+		}
+		if session.quitTimer != nil {
+			session.quitTimer.Stop()
+		}
+		frozen = append(frozen, session)
+	}
+
+	s.disconnect(dropped, NewText(UPGRADE_MESSAGE))
+
+	for _, client := range clients {
+		if client.hasQuit.Get() {
+			continue
+		}
+		clientState := client.upgradeState()
+		for _, session := range client.Sessions() {
+			fd, err := inheritableFD(session.socket.Conn().(syscall.Conn))
+			if err != nil {
+				session.serverQuit(NewText(UPGRADE_MESSAGE))
+				continue
+			}
+			fds = append(fds, fd)
+			sessionState := session.upgradeState(fd)
+			outputs[session] = sessionState.Output
+			clientState.Sessions = append(clientState.Sessions, sessionState)
+		}
+		if client.hasQuit.Get() {
+			continue
+		}
+		state.Clients = append(state.Clients, clientState)
+	}
+
+	s.channels.Range(func(_ Name, channel *Channel) bool {
+		state.Channels = append(state.Channels, channel.upgradeState())
+		return true
+	})
+	state.History = s.history.Snapshot()
+	state.Markers = s.markers.Snapshot()
+
+	path, err := writeUpgradeState(state)
+	if err != nil {
+		return undo(err)
+	}
+
+	s.logger().Infof("upgrading: handing over %d listeners, %d clients and %d channels",
+		len(state.Listeners), len(state.Clients), len(state.Channels))
+
+	env := append(os.Environ(), UPGRADE_STATE_ENV+"="+path)
+	err = syscall.Exec(exe, os.Args, env)
+	removeUpgradeState(path)
+	return undo(err)
+}
+
+// writeUpgradeState saves state, which includes history and unsent and
+// unprocessed client lines, readable only by the server, in a directory
+// of its own. It returns the path to hand over to the new process.
+func writeUpgradeState(state *upgradeState) (string, error) {
+	dir, err := ioutil.TempDir("", "eris-upgrade-")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, UPGRADE_STATE_FILE)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	err = json.NewEncoder(file).Encode(state)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		removeUpgradeState(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// removeUpgradeState removes the state saved by writeUpgradeState and
+// its directory.
+func removeUpgradeState(path string) {
+	os.Remove(path)
+	os.Remove(filepath.Dir(path))
+}
+
+// upgrade runs Upgrade for an operator, or a signal if by is nil, and
+// reports failure.
+func (s *Server) upgrade(by *Client) {
+	name := "SIGUSR2"
+	if by != nil {
+		name = by.Nick().String()
+	}
+	s.Wallopsf("Upgrading server (%s)", name)
+
+	err := s.Upgrade()
+	s.logger().Errorf("upgrade failed: %s", err)
+	s.Wallopsf("ERROR: Upgrade failed (%s)", err)
+	if by != nil {
+		by.Reply(RplNotice(s, by, NewText(fmt.Sprintf("UPGRADE: ERROR: %s", err))))
+	}
+}
+
+// loadUpgradeState returns the state handed over by the process that
+// started this one on UPGRADE, or nil if it wasn't.
+func loadUpgradeState() (*upgradeState, error) {
+	path := os.Getenv(UPGRADE_STATE_ENV)
+	if path == "" {
+		return nil, nil
+	}
+	os.Unsetenv(UPGRADE_STATE_ENV)
+
+	data, err := ioutil.ReadFile(path)
+	removeUpgradeState(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &upgradeState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Version != upgradeStateVersion {
+		return nil, ErrUpgradeVersion
+	}
+	return state, nil
+}
+
+// resumeListener serves the listener key on the socket fd handed over
+// by UPGRADE, if it is still configured.
+func (s *Server) resumeListener(key listenerKey, fd int) {
+	file := os.NewFile(uintptr(fd), key.String())
+	defer file.Close()
+
+	config, ok := configuredListeners(s.Config())[key]
+	if !ok {
+		return
+	}
+
+	socket, err := net.FileListener(file)
+	if err != nil {
+		s.logger().Errorf("upgrade: %s: %s", key, err)
+		return
+	}
+
+	l := &serverListener{
+		Listener: socket,
+		config:   config,
+		socket:   socket,
+		closed:   make(chan bool),
+	}
+	if key.kind == ListenTLS {
+		l.cert = &certificate{}
+		if _, err := l.cert.Load(config.(*TLSConfig)); err != nil {
+			s.logger().Errorf("upgrade: %s: %s", key, err)
+			socket.Close()
+			return
+		}
+		l.Listener = s.tlslistener(socket, l.cert)
+	}
+
+	s.listeners[key] = l
+	s.logger().Infof("resumed %s", key)
+	s.serve(key, l)
+}
+
+// resume restores the clients, channels and history handed over by
+// UPGRADE and starts the clients.
+func (s *Server) resume(state *upgradeState) {
+	s.history.Restore(state.History)
+	s.markers.Restore(state.Markers)
+
+	clients := make(map[Name]*Client, len(state.Clients))
+	for _, clientState := range state.Clients {
+		client, err := s.resumeClient(clientState)
+		if err != nil {
+			s.logger().Errorf("upgrade: %s: %s", clientState.Nick, err)
+			continue
+		}
+		clients[client.nick] = client
+	}
+
+	for _, channelState := range state.Channels {
+		s.resumeChannel(channelState, clients)
+	}
+
+	for _, client := range clients {
+		for _, session := range client.Sessions() {
+			session.start()
+		}
+	}
+
+	s.logger().Infof("upgraded to %s: resumed %d clients and %d channels",
+		FullVersion(), len(clients), s.channels.Count())
+	s.Wallopsf("Upgraded server to %s", FullVersion())
+}
+
+func (s *Server) resumeClient(state upgradeClient) (*Client, error) {
+	c := newClient(s)
+	c.nick = state.Nick
+	c.username = state.Username
+	c.realname = state.Realname
+	c.hostname = state.Hostname
+	c.hostmask = state.Hostmask
+	c.awayMessage = state.AwayMessage
+	c.authorized = state.Authorized
+	c.ctime = state.CTime
+	c.atime = state.ATime
+	if state.Account != "" {
+		c.sasl.Login(state.Account)
+	}
+	for _, mode := range state.Modes {
+		c.modes.Set(UserMode(mode))
+	}
+	for _, line := range state.Replay {
+		c.replay = append(c.replay, replayLine{line.Tags, line.Line})
+	}
+
+	for _, sessionState := range state.Sessions {
+		session, err := s.resumeSession(c, sessionState)
+		if err != nil {
+			s.logger().Errorf("upgrade: %s: %s", state.Nick, err)
+			continue
+		}
+		c.sessions = append(c.sessions, session)
+	}
+	if len(state.Sessions) > 0 && len(c.sessions) == 0 {
+		c.destroy()
+		return nil, ErrNoSessions
+	}
+
+	if err := s.clients.Add(c); err != nil {
+		c.serverQuit(NewText(UPGRADE_MESSAGE))
+		return nil, err
+	}
+	c.SetClass(s.classes.Match(c))
+	c.Register()
+	for _, nick := range state.Monitor {
+		s.monitors.Add(c, nick, c.class.MaxMonitor())
+	}
+	for _, nick := range state.Accept {
+		c.ignores.Accept(nick)
+	}
+	for _, mask := range state.Silence {
+		c.ignores.Silence(mask)
+	}
+	return c, nil
+}
+
+func (s *Server) resumeSession(c *Client, state upgradeSession) (*Session, error) {
+	file := os.NewFile(uintptr(state.FD), c.nick.String())
+	if file == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", state.FD)
+	}
+	conn, err := net.FileConn(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := conn.(*tls.Conn); ok {
+		s.metrics.GaugeVec("server", "clients").WithLabelValues("secure").Inc()
+	} else {
+		s.metrics.GaugeVec("server", "clients").WithLabelValues("insecure").Inc()
+	}
+	s.connections.Inc()
+	// the connection was accepted before, so it is kept even if it is
+	// now over the limits, just not counted
+	limit, err := s.limiter.Add(conn.RemoteAddr())
+	if err != nil {
+		s.logger().Warnf("upgrade: %s: %s: %s", c.nick, conn.RemoteAddr(), err)
+	}
+
+	session := newSession(c, conn, state.Listener)
+	session.limit = limit
+	session.capState = state.CapState
+	for _, capability := range state.Capabilities {
+		session.capabilities[capability] = true
+	}
+	session.socket.reader = bufio.NewReader(
+		io.MultiReader(strings.NewReader(state.Input), conn))
+
+	for _, line := range state.Output {
+		session.sendq.Push(line)
+	}
+	return session, nil
+}
+
+func (s *Server) resumeChannel(state upgradeChannel, clients map[Name]*Client) {
+	channel := NewChannel(s, state.Name, false)
+	for _, mode := range state.Flags {
+		channel.flags.Set(ChannelMode(mode))
+	}
+	channel.key = state.Key
+	channel.topic = state.Topic
+	channel.userLimit = state.UserLimit
+	channel.playback = state.Playback
+	channel.joinThrottle = state.JoinThrottle
+	channel.floodLimit = state.FloodLimit
+	channel.forward = state.Forward
+
+	for letter, masks := range state.Lists {
+		for _, mode := range letter {
+			if list, ok := channel.lists[ChannelMode(mode)]; ok {
+				list.AddAll(masks)
+			}
+		}
+	}
+
+	for nick, modes := range state.Members {
+		client, ok := clients[nick]
+		if !ok {
+			continue
+		}
+		client.channels.Add(channel)
+		channel.members.Add(client)
+		for _, mode := range modes {
+			channel.members.Get(client).Set(ChannelMode(mode))
+		}
+	}
+
+	if channel.IsEmpty() {
+		s.channels.Remove(channel)
+	}
+}
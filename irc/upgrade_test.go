@@ -0,0 +1,33 @@
+package irc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpgradeStateFile(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := writeUpgradeState(&upgradeState{Version: upgradeStateVersion})
+	assert.NoError(err)
+
+	info, err := os.Stat(path)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(filepath.Dir(path))
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0700), info.Mode().Perm())
+
+	os.Setenv(UPGRADE_STATE_ENV, path)
+	state, err := loadUpgradeState()
+	assert.NoError(err)
+	assert.Equal(upgradeStateVersion, state.Version)
+
+	// the state is removed once it's been read
+	_, err = os.Stat(filepath.Dir(path))
+	assert.True(os.IsNotExist(err))
+	assert.Empty(os.Getenv(UPGRADE_STATE_ENV))
+}
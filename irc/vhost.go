@@ -0,0 +1,188 @@
+package irc
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ErrInvalidVhost   = errors.New("invalid vhost")
+	ErrNoVhostRequest = errors.New("no pending vhost request")
+	ErrNoVhost        = errors.New("account has no vhost")
+)
+
+// VhostConfig configures account vhosts. Vhosts are saved to File, if
+// set, whenever they are assigned, approved, requested or removed.
+type VhostConfig struct {
+	File string
+}
+
+type vhostFile struct {
+	Vhosts   map[string]string
+	Requests map[string]string
+}
+
+// VhostStore holds the vhosts assigned to accounts and vhosts
+// requested by accounts that are waiting for an operator's approval.
+type VhostStore struct {
+	sync.RWMutex
+	filename string
+	vhosts   map[string]Name
+	requests map[string]Name
+}
+
+func NewVhostStore(config VhostConfig) (*VhostStore, error) {
+	store := &VhostStore{
+		filename: config.File,
+		vhosts:   make(map[string]Name),
+		requests: make(map[string]Name),
+	}
+	if store.filename == "" {
+		return store, nil
+	}
+
+	data, err := ioutil.ReadFile(store.filename)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var file vhostFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for account, vhost := range file.Vhosts {
+		store.vhosts[account] = NewName(vhost)
+	}
+	for account, vhost := range file.Requests {
+		store.requests[account] = NewName(vhost)
+	}
+	return store, nil
+}
+
+// IsVhost returns true if vhost can be used as a visible host.
+func IsVhost(vhost Name) bool {
+	return IsHostname(vhost.String())
+}
+
+func (store *VhostStore) Get(account string) (Name, bool) {
+	store.RLock()
+	defer store.RUnlock()
+	vhost, ok := store.vhosts[account]
+	return vhost, ok
+}
+
+// Set assigns vhost to account, replacing any pending request.
+func (store *VhostStore) Set(account string, vhost Name) error {
+	if !IsVhost(vhost) {
+		return ErrInvalidVhost
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	store.vhosts[account] = vhost
+	delete(store.requests, account)
+	return store.save()
+}
+
+func (store *VhostStore) Delete(account string) error {
+	store.Lock()
+	defer store.Unlock()
+	if _, ok := store.vhosts[account]; !ok {
+		return ErrNoVhost
+	}
+	delete(store.vhosts, account)
+	return store.save()
+}
+
+// Request records a vhost request for account to be approved later.
+func (store *VhostStore) Request(account string, vhost Name) error {
+	if !IsVhost(vhost) {
+		return ErrInvalidVhost
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	store.requests[account] = vhost
+	return store.save()
+}
+
+// Approve assigns the vhost requested by account and returns it.
+func (store *VhostStore) Approve(account string) (Name, error) {
+	store.Lock()
+	defer store.Unlock()
+	vhost, ok := store.requests[account]
+	if !ok {
+		return "", ErrNoVhostRequest
+	}
+	store.vhosts[account] = vhost
+	delete(store.requests, account)
+	return vhost, store.save()
+}
+
+// Reject drops the vhost requested by account and returns it.
+func (store *VhostStore) Reject(account string) (Name, error) {
+	store.Lock()
+	defer store.Unlock()
+	vhost, ok := store.requests[account]
+	if !ok {
+		return "", ErrNoVhostRequest
+	}
+	delete(store.requests, account)
+	return vhost, store.save()
+}
+
+// Requests returns the accounts with pending requests in sorted order.
+func (store *VhostStore) Requests() (accounts []string, vhosts []Name) {
+	store.RLock()
+	defer store.RUnlock()
+	for account := range store.requests {
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+	for _, account := range accounts {
+		vhosts = append(vhosts, store.requests[account])
+	}
+	return
+}
+
+// Save writes the vhosts and requests to the store's file, if any.
+func (store *VhostStore) Save() error {
+	store.RLock()
+	defer store.RUnlock()
+	return store.save()
+}
+
+func (store *VhostStore) save() error {
+	if store.filename == "" {
+		return nil
+	}
+
+	file := vhostFile{
+		Vhosts:   make(map[string]string, len(store.vhosts)),
+		Requests: make(map[string]string, len(store.requests)),
+	}
+	for account, vhost := range store.vhosts {
+		file.Vhosts[account] = vhost.String()
+	}
+	for account, vhost := range store.requests {
+		file.Requests[account] = vhost.String()
+	}
+
+	data, err := yaml.Marshal(&file)
+	if err != nil {
+		return err
+	}
+
+	tmp := store.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, store.filename)
+}
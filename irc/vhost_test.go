@@ -0,0 +1,48 @@
+package irc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVhostStore(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "eris-vhosts")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := VhostConfig{File: filepath.Join(dir, "vhosts.yml")}
+	store, err := NewVhostStore(config)
+	assert.NoError(err)
+
+	assert.Equal(ErrInvalidVhost, store.Set("admin", "not a host"))
+	assert.NoError(store.Set("admin", "staff.example.org"))
+	assert.NoError(store.Request("user", "user.example.org"))
+
+	accounts, vhosts := store.Requests()
+	assert.Equal([]string{"user"}, accounts)
+	assert.Equal([]Name{"user.example.org"}, vhosts)
+
+	store, err = NewVhostStore(config)
+	assert.NoError(err)
+
+	vhost, ok := store.Get("admin")
+	assert.True(ok)
+	assert.Equal(Name("staff.example.org"), vhost)
+
+	vhost, err = store.Approve("user")
+	assert.NoError(err)
+	assert.Equal(Name("user.example.org"), vhost)
+	_, err = store.Approve("user")
+	assert.Equal(ErrNoVhostRequest, err)
+
+	assert.NoError(store.Delete("admin"))
+	assert.Equal(ErrNoVhost, store.Delete("admin"))
+	_, ok = store.Get("admin")
+	assert.False(ok)
+}
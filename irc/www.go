@@ -72,12 +72,13 @@ func (server *Server) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
 			lang = cleaned
 		}
 	}
-	log.Infof("Rendering language: %d %s, %s", len(tmp), lang, server.templates[lang])
-	tmpl, err := template.New(server.config.Network.Name).Parse(server.templates[lang])
+	config, text := server.Config(), server.template(lang)
+	log.Infof("Rendering language: %d %s, %s", len(tmp), lang, text)
+	tmpl, err := template.New(config.Network.Name).Parse(text)
 	if err != nil {
 		log.Fatalf("Template generation error, %s", err)
 	}
-	err = tmpl.Execute(rw, server.config)
+	err = tmpl.Execute(rw, config)
 	if err != nil {
 		log.Fatalf("Template execution error, %s", err)
 	}
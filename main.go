@@ -7,7 +7,6 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
-	"github.com/mmcloughlin/professor"
 	"github.com/prologic/eris/irc"
 )
 
@@ -15,11 +14,13 @@ func main() {
 	var (
 		version    bool
 		debug      bool
+		check      bool
 		configfile string
 	)
 
 	flag.BoolVar(&version, "v", false, "display version information")
 	flag.BoolVar(&debug, "d", false, "enable debug logging")
+	flag.BoolVar(&check, "check", false, "validate the config file and exit")
 	flag.StringVar(&configfile, "c", "ircd.yml", "config file")
 	flag.Parse()
 
@@ -31,17 +32,33 @@ func main() {
 	if debug {
 		log.SetLevel(log.DebugLevel)
 	} else {
-		log.SetLevel(log.WarnLevel)
-	}
-
-	if debug {
-		go professor.Launch(":6060")
+		log.SetLevel(irc.DefaultLogLevel)
 	}
 
 	config, err := irc.LoadConfig(configfile)
+	if check {
+		if err != nil {
+			errs, ok := err.(irc.ConfigErrors)
+			if !ok {
+				errs = irc.ConfigErrors{err}
+			}
+			for _, err := range errs {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", configfile, err)
+			}
+			os.Exit(1)
+		}
+		fmt.Printf("%s: OK\n", configfile)
+		os.Exit(0)
+	}
 	if err != nil {
 		log.Fatal("Config file did not load successfully:", err.Error())
 	}
 
-	irc.NewServer(config).Run()
+	if err := irc.SetupLogging(config.Server.Log, debug); err != nil {
+		log.Fatal("Logging could not be set up:", err.Error())
+	}
+
+	if err := irc.NewServer(config).Run(); err != nil {
+		log.Fatalf("shutdown: %s", err)
+	}
 }
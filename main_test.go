@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/sha256"
 	"flag"
 	"fmt"
 	"os"
@@ -28,6 +27,8 @@ var (
 	debug = flag.Bool("d", false, "enable debug logging")
 )
 
+var cloakConfig = eris.CloakConfig{Keys: []string{"test"}}
+
 func setupServer() *eris.Server {
 	config := &eris.Config{}
 
@@ -35,6 +36,7 @@ func setupServer() *eris.Server {
 	config.Server.Name = "test"
 	config.Server.Description = "Test"
 	config.Server.Listen = []string{":6667"}
+	config.Network.Cloak = cloakConfig
 
 	// SASL
 	config.Account = map[string]*eris.PassConfig{
@@ -242,7 +244,7 @@ func TestUser_WithHostMask(t *testing.T) {
 	client1 := newClient(false)
 	client2 := newClient(false)
 
-	expected := fmt.Sprintf("%x", sha256.Sum256([]byte("localhost")))
+	expected := eris.NewCloaker(cloakConfig).Cloak("localhost").String()
 	actual := make(chan string)
 
 	client1.AddCallback("001", func(e *irc.Event) {